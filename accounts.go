@@ -0,0 +1,124 @@
+package main
+
+import "fmt"
+
+// The account backends of -accounts
+const (
+	accountsAuto    = "auto"
+	accountsShadow  = "shadow"
+	accountsBusyBox = "busybox"
+	accountsFiles   = "files"
+	// the files backend writing to the libnss-extrausers files instead of /etc
+	accountsExtraUsers = "extrausers"
+)
+
+// AccountManager - creates, changes and deletes the users and groups of the machine.
+// The sync only goes through it, so it can run against the shadow-utils commands or a fake.
+type AccountManager interface {
+	GroupAdd(groupName string) error
+	GroupDelete(groupName string) error
+	UserAdd(user ArgoUser, groups []string) error
+	// removeHome false keeps the home directory, for the keep and archive removal policies
+	UserDelete(userName string, removeHome bool) error
+	// lock the user out for the grace period before it is deleted: no password, expired and a nologin shell
+	UserLock(userName string) error
+	// give a locked user back its login and its shell
+	UserUnlock(user ArgoUser) error
+	UserExists(userName string) (bool, error)
+	AddGroupToUser(user string, group string) error
+	RemoveGroupFromUser(user string, group string) error
+	// the uid of the user and the gid of the group named after it, which own the user's files
+	UserIDs(userName string) (int, int, error)
+}
+
+// ShadowAccounts - manages the accounts with useradd, groupadd and the other shadow-utils commands
+type ShadowAccounts struct{}
+
+var _ AccountManager = ShadowAccounts{}
+
+// Tested
+// GroupAdd - add the group with groupadd
+func (ShadowAccounts) GroupAdd(groupName string) error {
+	return groupAdd(groupName)
+}
+
+// Tested
+// GroupDelete - delete the group with groupdel
+func (ShadowAccounts) GroupDelete(groupName string) error {
+	return groupDelete(groupName)
+}
+
+// Tested
+// UserAdd - add the user and its home directory with useradd
+func (ShadowAccounts) UserAdd(user ArgoUser, groups []string) error {
+	return userAdd(user, groups)
+}
+
+// Tested
+// UserDelete - delete the user, and its home directory with removeHome, with userdel
+func (ShadowAccounts) UserDelete(userName string, removeHome bool) error {
+	return userDelete(userName, removeHome)
+}
+
+// Tested
+// UserLock - lock and expire the user and set its shell to nologin with usermod
+func (ShadowAccounts) UserLock(userName string) error {
+	return userLock(userName)
+}
+
+// Tested
+// UserUnlock - unlock the user and give it back its shell with usermod
+func (ShadowAccounts) UserUnlock(user ArgoUser) error {
+	return userUnlock(user)
+}
+
+// Tested
+// UserExists - check the user is in the passwd database
+func (ShadowAccounts) UserExists(userName string) (bool, error) {
+	return userExists(userName)
+}
+
+// Tested
+// AddGroupToUser - add the user to a group with usermod
+func (ShadowAccounts) AddGroupToUser(user string, group string) error {
+	return addGroupToUser(user, group)
+}
+
+// Tested
+// RemoveGroupFromUser - remove the user from a group with gpasswd
+func (ShadowAccounts) RemoveGroupFromUser(user string, group string) error {
+	return removeGroupFromUser(user, group)
+}
+
+// Tested
+// UserIDs - look up the uid of the user and the gid of its group
+func (ShadowAccounts) UserIDs(userName string) (int, int, error) {
+	userID, err := getUIDByUserName(userName)
+	if err != nil {
+		return -1, -1, err
+	}
+
+	groupID, err := getGIDByGroupName(userName)
+	if err != nil {
+		return -1, -1, err
+	}
+	return userID, groupID, nil
+}
+
+// Tested
+// Get the account backend named by -accounts, detecting the one the machine has for auto
+func newAccountManager(backend string) (AccountManager, error) {
+	switch backend {
+	case accountsAuto:
+		return detectAccountManager(), nil
+	case accountsShadow:
+		return ShadowAccounts{}, nil
+	case accountsBusyBox:
+		return BusyBoxAccounts{}, nil
+	case accountsFiles:
+		return FileAccounts{Dir: systemAccountsDir}, nil
+	case accountsExtraUsers:
+		return FileAccounts{Dir: extraUsersDir}, nil
+	}
+	return nil, fmt.Errorf("Unknown accounts backend %q, expected %s, %s, %s, %s or %s", backend, accountsAuto, accountsShadow, accountsBusyBox, accountsFiles, accountsExtraUsers)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeAccounts - an in-memory AccountManager, so the sync can be tested without root.
+// Every call is recorded as the command it stands for, and fail makes a call return an error.
+// A user maps to its groups and a deleted user to nil.
+type fakeAccounts struct {
+	groups map[string]bool
+	users  map[string][]string
+	locked map[string]bool
+	calls  []string
+	fail   map[string]error
+}
+
+func newFakeAccounts() *fakeAccounts {
+	return &fakeAccounts{groups: map[string]bool{}, users: map[string][]string{}, locked: map[string]bool{}, fail: map[string]error{}}
+}
+
+func (f *fakeAccounts) run(call string) error {
+	f.calls = append(f.calls, call)
+	return f.fail[call]
+}
+
+func (f *fakeAccounts) GroupAdd(groupName string) error {
+	if err := f.run("groupadd " + groupName); err != nil {
+		return err
+	}
+	if f.groups[groupName] {
+		return fmt.Errorf("groupadd: group '%s' already exists", groupName)
+	}
+	f.groups[groupName] = true
+	return nil
+}
+
+func (f *fakeAccounts) GroupDelete(groupName string) error {
+	if err := f.run("groupdel " + groupName); err != nil {
+		return err
+	}
+	if !f.groups[groupName] {
+		return fmt.Errorf("groupdel: group '%s' does not exist", groupName)
+	}
+	f.groups[groupName] = false
+	return nil
+}
+
+func (f *fakeAccounts) UserAdd(user ArgoUser, groups []string) error {
+	if err := f.run("useradd " + user.ID); err != nil {
+		return err
+	}
+	if f.users[user.ID] != nil {
+		return fmt.Errorf("useradd: user '%s' already exists", user.ID)
+	}
+	for _, group := range groups {
+		if !f.groups[group] {
+			return fmt.Errorf("useradd: group '%s' does not exist", group)
+		}
+	}
+	f.users[user.ID] = append([]string{}, groups...)
+	return nil
+}
+
+func (f *fakeAccounts) UserDelete(userName string, removeHome bool) error {
+	call := "userdel " + userName
+	if !removeHome {
+		call = "userdel --keep-home " + userName
+	}
+	if err := f.run(call); err != nil {
+		return err
+	}
+	if f.users[userName] == nil {
+		return fmt.Errorf("userdel: user '%s' does not exist", userName)
+	}
+	f.users[userName] = nil
+	f.locked[userName] = false
+	return nil
+}
+
+func (f *fakeAccounts) UserLock(userName string) error {
+	if err := f.run("usermod --lock " + userName); err != nil {
+		return err
+	}
+	if f.users[userName] == nil {
+		return fmt.Errorf("usermod: user '%s' does not exist", userName)
+	}
+	f.locked[userName] = true
+	return nil
+}
+
+func (f *fakeAccounts) UserUnlock(user ArgoUser) error {
+	if err := f.run("usermod --unlock " + user.ID); err != nil {
+		return err
+	}
+	if f.users[user.ID] == nil {
+		return fmt.Errorf("usermod: user '%s' does not exist", user.ID)
+	}
+	f.locked[user.ID] = false
+	return nil
+}
+
+func (f *fakeAccounts) UserExists(userName string) (bool, error) {
+	return f.users[userName] != nil, nil
+}
+
+func (f *fakeAccounts) AddGroupToUser(user string, group string) error {
+	if err := f.run("usermod " + user + " " + group); err != nil {
+		return err
+	}
+	if !f.groups[group] {
+		return fmt.Errorf("usermod: group '%s' does not exist", group)
+	}
+	f.users[user] = append(f.users[user], group)
+	return nil
+}
+
+func (f *fakeAccounts) RemoveGroupFromUser(user string, group string) error {
+	if err := f.run("gpasswd " + user + " " + group); err != nil {
+		return err
+	}
+	if f.users[user] == nil {
+		return fmt.Errorf("gpasswd: user '%s' does not exist", user)
+	}
+	groups := make([]string, 0)
+	for _, g := range f.users[user] {
+		if g != group {
+			groups = append(groups, g)
+		}
+	}
+	f.users[user] = groups
+	return nil
+}
+
+func (f *fakeAccounts) UserIDs(userName string) (int, int, error) {
+	if f.users[userName] == nil {
+		return -1, -1, fmt.Errorf("user: unknown user %s", userName)
+	}
+	return os.Getuid(), os.Getgid(), nil
+}
+
+// the groups of a user on the fake machine, sorted
+func (f *fakeAccounts) userGroups(userName string) []string {
+	groups := append([]string{}, f.users[userName]...)
+	sort.Strings(groups)
+	return groups
+}
+
+// ShadowAccounts.UserIDs
+func TestShadowAccountsUserIDs(t *testing.T) {
+	uid, gid, err := ShadowAccounts{}.UserIDs("root")
+	assert.Nil(t, err)
+	assert.Equal(t, uid, 0)
+	assert.Equal(t, gid, 0)
+
+	_, _, err = ShadowAccounts{}.UserIDs("thiswillfail")
+	assert.NotNil(t, err)
+}
+
+// ShadowAccounts.UserLock, ShadowAccounts.UserUnlock
+func TestShadowAccountsLockMissingUser(t *testing.T) {
+	assert.NotNil(t, ShadowAccounts{}.UserLock("thiswillfail"))
+	assert.NotNil(t, ShadowAccounts{}.UserUnlock(ArgoUser{ID: "thiswillfail", Shell: "/bin/bash"}))
+}
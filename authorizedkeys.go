@@ -0,0 +1,155 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// How long to wait for the key store while a sync is publishing to it
+var keyStoreWait = 2 * time.Second
+
+// The uid that must own the key store. sshd serves whatever keys are in it, so it has to be root's.
+var keyStoreOwner = 0
+
+// Tested
+// Check nobody else can have planted keys in the key store: it must be a directory, not a symlink, owned by root
+// and not group or world writable. A missing key store is fine, the sync creates it.
+func checkKeyStore(location string) error {
+	fi, err := os.Lstat(location)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("Key store %s is not a directory", location)
+	}
+	if uid, _, ok := fileOwner(fi); ok && uid != keyStoreOwner {
+		return fmt.Errorf("Key store %s is owned by uid %d instead of %d", location, uid, keyStoreOwner)
+	}
+	if fi.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("Key store %s is group or world writable (%s)", location, fi.Mode().Perm())
+	}
+	return nil
+}
+
+// Tested
+// Open the key store, waiting while another process has it locked. Read only opens share the lock,
+// so any number of sshd lookups can read at once. A key store anyone but root could have written to is refused,
+// checked again once it is open in case another user created it first.
+func openKeyStore(location string, readOnly bool) (*leveldb.DB, error) {
+	err := checkKeyStore(location)
+	if err != nil {
+		return nil, err
+	}
+
+	options := &opt.Options{ReadOnly: readOnly, ErrorIfMissing: readOnly}
+	deadline := time.Now().Add(keyStoreWait)
+	for {
+		db, err := leveldb.OpenFile(location, options)
+		if err == syscall.EWOULDBLOCK && time.Now().Before(deadline) {
+			time.Sleep(50 * time.Millisecond)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		err = checkKeyStore(location)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		return db, nil
+	}
+}
+
+// Tested
+// Copy the ssh keys of every user in the state store to the key store, removing the users that are gone
+func publishAuthorizedKeys(db *leveldb.DB, location string) error {
+	keyStore, err := openKeyStore(location, false)
+	if err != nil {
+		return err
+	}
+	defer keyStore.Close()
+
+	batch := new(leveldb.Batch)
+	mPublished := make(map[string]bool)
+	iter := db.NewIterator(util.BytesPrefix([]byte("user@")), nil)
+	for iter.Next() {
+		userGroup := byteArrayToUserGroup(iter.Value())
+		batch.Put(iter.Key(), []byte(strings.Join(userGroup.SSHKeys, "\n")))
+		mPublished[string(iter.Key())] = true
+	}
+	iter.Release()
+	if err = iter.Error(); err != nil {
+		return err
+	}
+
+	iter = keyStore.NewIterator(util.BytesPrefix([]byte("user@")), nil)
+	for iter.Next() {
+		if !mPublished[string(iter.Key())] {
+			batch.Delete(iter.Key())
+		}
+	}
+	iter.Release()
+	if err = iter.Error(); err != nil {
+		return err
+	}
+
+	return keyStore.Write(batch, &opt.WriteOptions{Sync: true})
+}
+
+// Tested
+// Read the ssh keys of a user from the key store. An unknown user has no keys.
+func readAuthorizedKeys(location string, userName string) ([]string, error) {
+	keyStore, err := openKeyStore(location, true)
+	if err != nil {
+		return nil, err
+	}
+	defer keyStore.Close()
+
+	data, err := keyStore.Get([]byte("user@"+userName), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	return strings.Split(string(data), "\n"), nil
+}
+
+// Not testable
+// The authorized-keys command prints the keys of a user for sshd's AuthorizedKeysCommand.
+// Only keys go to stdout, sshd reads every line of it as an authorized_keys entry.
+func authorizedKeysCommand(args []string) int {
+	flags := flag.NewFlagSet("authorized-keys", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: argo-lyte [-keystore <dir>] authorized-keys <username>")
+	}
+	userName, err := parseCommandArgs(flags, args)
+	if err != nil {
+		return 1
+	}
+
+	sshKeys, err := readAuthorizedKeys(keyStoreDirectory, userName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	for _, sshKey := range sshKeys {
+		fmt.Println(sshKey)
+	}
+	return 0
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// a temp directory for the key store, which the user running the tests owns in place of root
+func testKeyStoreDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "argo-lyte-test")
+	assert.Nil(t, err)
+	keyStoreOwner = os.Geteuid()
+	return dir, func() {
+		keyStoreOwner = 0
+		os.RemoveAll(dir)
+	}
+}
+
+// checkKeyStore
+func TestCheckKeyStore(t *testing.T) {
+	dir, cleanup := testKeyStoreDir(t)
+	defer cleanup()
+
+	assert.Nil(t, checkKeyStore(dir+"/keys"))
+	assert.Nil(t, os.Mkdir(dir+"/keys", 0755))
+	assert.Nil(t, checkKeyStore(dir+"/keys"))
+
+	assert.Nil(t, os.Chmod(dir+"/keys", 0777))
+	assert.Equal(t, checkKeyStore(dir+"/keys").Error(), "Key store "+dir+"/keys is group or world writable (-rwxrwxrwx)")
+	_, err := openKeyStore(dir+"/keys", false)
+	assert.Equal(t, err.Error(), "Key store "+dir+"/keys is group or world writable (-rwxrwxrwx)")
+	assert.Nil(t, os.Chmod(dir+"/keys", 0775))
+	assert.NotNil(t, checkKeyStore(dir+"/keys"))
+	assert.Nil(t, os.Chmod(dir+"/keys", 0755))
+
+	// a key store someone else created is refused, for reading too
+	keyStoreOwner = os.Geteuid() + 1
+	assert.Equal(t, checkKeyStore(dir+"/keys").Error(), fmt.Sprintf("Key store %s/keys is owned by uid %d instead of %d", dir, os.Geteuid(), os.Geteuid()+1))
+	_, err = readAuthorizedKeys(dir+"/keys", "root")
+	assert.NotNil(t, err)
+	keyStoreOwner = os.Geteuid()
+
+	assert.Nil(t, os.Symlink(dir+"/keys", dir+"/link"))
+	assert.Equal(t, checkKeyStore(dir+"/link").Error(), "Key store "+dir+"/link is not a directory")
+}
+
+// publishAuthorizedKeys, readAuthorizedKeys
+func TestPublishAuthorizedKeys(t *testing.T) {
+	dir, cleanup := testKeyStoreDir(t)
+	defer cleanup()
+
+	db, err := leveldb.OpenFile(dir+"/db", nil)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	bobKey := testSSHKey(t, "bob@laptop")
+	aliceKey := testSSHKey(t, "alice@laptop")
+	db.Put([]byte("user@bob"), userGroupToByteArray(UserGroup{ID: "bob", SSHKeys: []string{bobKey, aliceKey}}), nil)
+	db.Put([]byte("user@alice"), userGroupToByteArray(UserGroup{ID: "alice", SSHKeys: []string{aliceKey}}), nil)
+	db.Put([]byte("group@devs"), []byte("devs"), nil)
+
+	err = publishAuthorizedKeys(db, dir+"/keys")
+	assert.Nil(t, err)
+
+	sshKeys, err := readAuthorizedKeys(dir+"/keys", "bob")
+	assert.Nil(t, err)
+	assert.Equal(t, sshKeys, []string{bobKey, aliceKey})
+
+	// users removed from the state store are removed from the key store
+	db.Delete([]byte("user@alice"), nil)
+	err = publishAuthorizedKeys(db, dir+"/keys")
+	assert.Nil(t, err)
+
+	sshKeys, err = readAuthorizedKeys(dir+"/keys", "alice")
+	assert.Nil(t, err)
+	assert.Equal(t, len(sshKeys), 0)
+
+	sshKeys, err = readAuthorizedKeys(dir+"/keys", "devs")
+	assert.Nil(t, err)
+	assert.Equal(t, len(sshKeys), 0)
+}
+
+func TestReadAuthorizedKeysNoKeys(t *testing.T) {
+	dir, cleanup := testKeyStoreDir(t)
+	defer cleanup()
+
+	db, err := leveldb.OpenFile(dir+"/db", nil)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	db.Put([]byte("user@bob"), userGroupToByteArray(UserGroup{ID: "bob"}), nil)
+	assert.Nil(t, publishAuthorizedKeys(db, dir+"/keys"))
+
+	sshKeys, err := readAuthorizedKeys(dir+"/keys", "bob")
+	assert.Nil(t, err)
+	assert.Equal(t, len(sshKeys), 0)
+}
+
+func TestReadAuthorizedKeysMissing(t *testing.T) {
+	_, err := readAuthorizedKeys("/tmp/thiswillfail-keys", "bob")
+	assert.NotNil(t, err)
+}
+
+// openKeyStore
+func TestOpenKeyStoreShared(t *testing.T) {
+	dir, cleanup := testKeyStoreDir(t)
+	defer cleanup()
+
+	keyStore, err := openKeyStore(dir+"/keys", false)
+	assert.Nil(t, err)
+	keyStore.Close()
+
+	// readers share the lock
+	first, err := openKeyStore(dir+"/keys", true)
+	assert.Nil(t, err)
+	defer first.Close()
+	second, err := openKeyStore(dir+"/keys", true)
+	assert.Nil(t, err)
+	defer second.Close()
+}
+
+func TestOpenKeyStoreLocked(t *testing.T) {
+	dir, cleanup := testKeyStoreDir(t)
+	defer cleanup()
+
+	defaultWait := keyStoreWait
+	keyStoreWait = 200 * time.Millisecond
+	defer func() { keyStoreWait = defaultWait }()
+
+	keyStore, err := openKeyStore(dir+"/keys", false)
+	assert.Nil(t, err)
+
+	// a reader gives up while the store stays locked
+	_, err = openKeyStore(dir+"/keys", true)
+	assert.NotNil(t, err)
+
+	// and gets in once the writer is done
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		keyStore.Close()
+	}()
+	reader, err := openKeyStore(dir+"/keys", true)
+	assert.Nil(t, err)
+	if reader != nil {
+		reader.Close()
+	}
+}
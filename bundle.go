@@ -0,0 +1,488 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Tested
+// Uncompress a local users/groups tarball into the directory without shelling out to tar.
+// Only directories and regular files are extracted and nothing may land outside of dir.
+func extractBundle(bundleFile string, dir string) error {
+	fmt.Printf("Uncompressing bundle: %s into %s\n", bundleFile, dir)
+
+	f, err := os.Open(bundleFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := filepath.Clean(header.Name)
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return errors.New("Bundle entry outside of the bundle: " + header.Name)
+		}
+		target := filepath.Join(dir, name)
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0700)
+			if err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			err = os.MkdirAll(filepath.Dir(target), 0700)
+			if err != nil {
+				return err
+			}
+			out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(out, tr)
+			out.Close()
+			if err != nil {
+				return err
+			}
+		case tar.TypeXGlobalHeader:
+			continue
+		default:
+			return errors.New("Unsupported bundle entry: " + header.Name)
+		}
+	}
+}
+
+// Not testable
+// Get a directory with the users and groups of a bundle tarball, a single file bundle or an uncompressed bundle directory.
+// The returned function removes anything created along the way.
+func openBundle(path string) (string, func(), error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", nil, err
+	}
+	if fi.IsDir() {
+		return path, func() {}, nil
+	}
+
+	dir, err := ioutil.TempDir("", "argo-lyte")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	// single file bundles are copied in as they are
+	if ext := bundleDocumentFormat(path, ""); ext != "" {
+		data, err := ioutil.ReadFile(path)
+		if err == nil {
+			err = ioutil.WriteFile(dir+"/"+bundleDocumentName+ext, data, 0600)
+		}
+		if err != nil {
+			cleanup()
+			return "", nil, err
+		}
+		return dir, cleanup, nil
+	}
+
+	err = extractBundle(path, dir)
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return dir, cleanup, nil
+}
+
+// The manifest pack writes into a bundle and its optional signature
+const manifestFile = "manifest.json"
+const manifestSignatureFile = "manifest.sig"
+
+// Tested
+// List the user, group and ca key files of an uncompressed bundle, relative to the bundle and sorted
+func bundleFiles(dir string) ([]string, error) {
+	bundleFiles := make([]string, 0)
+	for _, subDir := range []string{caKeysDir, "groups", "users"} {
+		files, err := ioutil.ReadDir(dir + "/" + subDir)
+		// the ca folder is optional
+		if subDir == caKeysDir && os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if file.IsDir() {
+				continue
+			}
+			if subDir == caKeysDir && !isCAKeyFile(file.Name()) || subDir != caKeysDir && !isDefinitionFile(file.Name()) {
+				continue
+			}
+			bundleFiles = append(bundleFiles, subDir+"/"+file.Name())
+		}
+	}
+	sort.Strings(bundleFiles)
+	return bundleFiles, nil
+}
+
+// Tested
+// Get the hex encoded sha256 of a file
+func fileDigest(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Tested
+// Build the manifest with the digest of every user and group file in the bundle
+func buildManifest(dir string, serial uint64, created time.Time) (*Manifest, error) {
+	files, err := bundleFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := Manifest{Serial: serial, Created: created.UTC(), Files: make(map[string]string)}
+	for _, file := range files {
+		digest, err := fileDigest(dir + "/" + file)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Files[file] = digest
+	}
+	return &manifest, nil
+}
+
+// Tested
+// Read the manifest of an uncompressed bundle. Bundles without a manifest return nil.
+func readManifest(dir string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(dir + "/" + manifestFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest Manifest
+	err = unmarshalStrict(data, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", manifestFile, err.Error())
+	}
+	return &manifest, nil
+}
+
+// Tested
+// Check the files in the bundle are exactly the files in the manifest with the same digests
+func verifyManifest(dir string, manifest *Manifest) []error {
+	problems := make([]error, 0)
+
+	files, err := bundleFiles(dir)
+	if err != nil {
+		return append(problems, err)
+	}
+	for _, file := range files {
+		if _, ok := manifest.Files[file]; !ok {
+			problems = append(problems, fmt.Errorf("%s: Not in the manifest", file))
+		}
+	}
+
+	for file, expected := range manifest.Files {
+		digest, err := fileDigest(dir + "/" + file)
+		if os.IsNotExist(err) {
+			problems = append(problems, fmt.Errorf("%s: In the manifest but missing from the bundle", file))
+			continue
+		}
+		if err != nil {
+			problems = append(problems, err)
+			continue
+		}
+		if digest != expected {
+			problems = append(problems, fmt.Errorf("%s: Digest %s does not match the manifest digest %s", file, digest, expected))
+		}
+	}
+
+	sort.Slice(problems, func(i, j int) bool { return problems[i].Error() < problems[j].Error() })
+	return problems
+}
+
+// Tested
+// Check an uncompressed bundle against its manifest and the serial of the last bundle applied on this machine.
+// Once a serial has been applied, bundles without a manifest or with a lower serial are refused unless allowRollback is set.
+// With a public key the manifest must be signed by it, which single file bundles can't be.
+func checkManifest(dir string, lastSerial uint64, hasLastSerial bool, allowRollback bool, publicKey ssh.PublicKey) (*Manifest, error) {
+	if document := findBundleDocument(dir); document != "" {
+		return checkBundleDocument(document, lastSerial, hasLastSerial, allowRollback, publicKey)
+	}
+
+	manifest, err := readManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if manifest == nil {
+		if publicKey != nil {
+			return nil, errors.New("Bundle has no manifest to verify the signature of")
+		}
+		if hasLastSerial && !allowRollback {
+			return nil, fmt.Errorf("Bundle has no manifest but serial %d was already applied", lastSerial)
+		}
+		return nil, nil
+	}
+
+	if publicKey != nil {
+		err = verifyBundleSignature(dir, publicKey)
+		if err != nil {
+			return nil, fmt.Errorf("Bundle signature does not verify: %s", err.Error())
+		}
+	}
+
+	problems := verifyManifest(dir, manifest)
+	if len(problems) > 0 {
+		messages := make([]string, 0)
+		for _, problem := range problems {
+			messages = append(messages, problem.Error())
+		}
+		return nil, errors.New("Bundle does not match its manifest: " + strings.Join(messages, ", "))
+	}
+
+	err = checkBundleSerial(manifest, lastSerial, hasLastSerial, allowRollback)
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// Tested
+// Check a single file bundle against the serial of the last bundle applied. It has no manifest, so its serial
+// and creation time are in the document itself and returned as one. A document without a serial is refused once
+// a serial has been applied, like a tarball without a manifest.
+func checkBundleDocument(document string, lastSerial uint64, hasLastSerial bool, allowRollback bool, publicKey ssh.PublicKey) (*Manifest, error) {
+	if publicKey != nil {
+		return nil, errors.New("Single file bundles can't be signed, only tarballs built by pack -signkey are applied with -pubkey")
+	}
+
+	bundle, err := getBundleFromFile(document)
+	if err != nil {
+		return nil, err
+	}
+	if bundle.Serial == 0 {
+		if hasLastSerial && !allowRollback {
+			return nil, fmt.Errorf("Single file bundle has no serial but serial %d was already applied", lastSerial)
+		}
+		return nil, nil
+	}
+
+	manifest := &Manifest{Serial: bundle.Serial, Created: bundle.Created}
+	err = checkBundleSerial(manifest, lastSerial, hasLastSerial, allowRollback)
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// Tested
+// Refuse a bundle with a lower serial than the last one applied, unless allowRollback is set
+func checkBundleSerial(manifest *Manifest, lastSerial uint64, hasLastSerial bool, allowRollback bool) error {
+	if hasLastSerial && manifest.Serial < lastSerial {
+		if !allowRollback {
+			return fmt.Errorf("Bundle serial %d created %s is older than the applied serial %d", manifest.Serial, manifest.Created.Format(time.RFC3339), lastSerial)
+		}
+		fmt.Printf("Rolling back from serial %d to %d\n", lastSerial, manifest.Serial)
+	}
+	return nil
+}
+
+// Tested
+// Read the ssh public key the bundle manifest must be signed with
+func readSigningKey(pubKeyFile string) (ssh.PublicKey, error) {
+	pubKeyData, err := ioutil.ReadFile(pubKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(pubKeyData)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", pubKeyFile, err.Error())
+	}
+	return publicKey, nil
+}
+
+// Tested
+// Check the manifest of an uncompressed bundle is signed by the public key
+func verifyBundleSignature(dir string, publicKey ssh.PublicKey) error {
+	manifestData, err := ioutil.ReadFile(dir + "/" + manifestFile)
+	if err != nil {
+		return err
+	}
+	signatureData, err := ioutil.ReadFile(dir + "/" + manifestSignatureFile)
+	if err != nil {
+		return err
+	}
+	return verifyManifestSignature(manifestData, signatureData, publicKey)
+}
+
+// Tested
+// Sign the manifest with an ssh private key. RSA keys sign with sha256 instead of the ssh-rsa sha1 default.
+func signManifest(manifestData []byte, signer ssh.Signer) ([]byte, error) {
+	var signature *ssh.Signature
+	var err error
+	if algorithmSigner, ok := signer.(ssh.AlgorithmSigner); ok && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		signature, err = algorithmSigner.SignWithAlgorithm(rand.Reader, manifestData, ssh.KeyAlgoRSASHA256)
+	} else {
+		signature, err = signer.Sign(rand.Reader, manifestData)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []byte(base64.StdEncoding.EncodeToString(ssh.Marshal(signature)) + "\n"), nil
+}
+
+// Tested
+// Verify the manifest signature against the ssh public key of the signer
+func verifyManifestSignature(manifestData []byte, signatureData []byte, publicKey ssh.PublicKey) error {
+	wire, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signatureData)))
+	if err != nil {
+		return fmt.Errorf("%s: %s", manifestSignatureFile, err.Error())
+	}
+
+	var signature ssh.Signature
+	err = ssh.Unmarshal(wire, &signature)
+	if err != nil {
+		return fmt.Errorf("%s: %s", manifestSignatureFile, err.Error())
+	}
+
+	err = publicKey.Verify(manifestData, &signature)
+	if err != nil {
+		return fmt.Errorf("%s: %s", manifestSignatureFile, err.Error())
+	}
+	return nil
+}
+
+// Name of a single file bundle in the work directory, followed by the extension of its format
+const bundleDocumentName = "bundle"
+
+// Tested
+// Get the extension of a single file bundle from its content type, or from the url when the content type
+// doesn't say (e.g. S3's binary/octet-stream). An empty string means a tarball.
+func bundleDocumentFormat(bundleURL string, contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/json", "text/json":
+		return ".json"
+	case "application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml":
+		return ".yaml"
+	}
+
+	path := bundleURL
+	if parsedURL, err := url.Parse(bundleURL); err == nil {
+		path = parsedURL.Path
+	}
+	switch filepath.Ext(path) {
+	case ".json":
+		return ".json"
+	case ".yaml", ".yml":
+		return ".yaml"
+	}
+	return ""
+}
+
+// Tested
+// Find the single file bundle in a directory. Empty when the bundle is the users and groups folders.
+func findBundleDocument(dir string) string {
+	for _, ext := range []string{".json", ".yaml"} {
+		document := dir + "/" + bundleDocumentName + ext
+		if _, err := os.Stat(document); err == nil {
+			return document
+		}
+	}
+	return ""
+}
+
+// Tested
+// Pull the users and groups of a single file bundle into the Bundle struct
+func getBundleFromFile(document string) (*Bundle, error) {
+	fmt.Printf("Reading file: %s\n", document)
+	result, err := ioutil.ReadFile(document)
+	if err != nil {
+		return nil, err
+	}
+
+	var bundle Bundle
+	err = unmarshalDefinition(document, result, &bundle)
+	if err != nil {
+		return nil, err
+	}
+	return &bundle, nil
+}
+
+// Tested
+// Load the groups and users of the bundle in dir, from a single file bundle or the users and groups folders.
+// Groups and users that can't be used are returned as failures. An error means the whole bundle can't be used.
+func loadBundle(dir string) ([]ArgoGroup, []ArgoUser, []SyncFailure, error) {
+	document := findBundleDocument(dir)
+	if document == "" {
+		groups, groupFailures, err := loadGroups(dir + "/groups")
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		users, userFailures, err := loadUsers(dir + "/users")
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return groups, users, append(groupFailures, userFailures...), nil
+	}
+
+	bundle, err := getBundleFromFile(document)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	groupSources := make([]string, 0)
+	for i := range bundle.Groups {
+		groupSources = append(groupSources, fmt.Sprintf("groups[%d]", i))
+	}
+	groups, groupFailures := uniqueGroups(bundle.Groups, groupSources)
+	groups, invalidFailures := checkGroups(groups)
+	groupFailures = append(groupFailures, invalidFailures...)
+
+	userSources := make([]string, 0)
+	for i := range bundle.Users {
+		userSources = append(userSources, fmt.Sprintf("users[%d]", i))
+	}
+	users, userFailures := uniqueUsers(bundle.Users, userSources)
+	users, invalidFailures = checkUsers(users)
+	userFailures = append(userFailures, invalidFailures...)
+
+	return groups, users, append(groupFailures, userFailures...), nil
+}
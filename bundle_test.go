@@ -0,0 +1,454 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// write a gzipped tarball with the given entries for tests
+func testBundleFile(t *testing.T, headers []*tar.Header, contents []string) string {
+	f, err := ioutil.TempFile("", "argo-lyte-test")
+	assert.Nil(t, err)
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for i, header := range headers {
+		header.Size = int64(len(contents[i]))
+		assert.Nil(t, tw.WriteHeader(header))
+		_, err = tw.Write([]byte(contents[i]))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, tw.Close())
+	assert.Nil(t, gz.Close())
+	return f.Name()
+}
+
+// extractBundle
+func TestExtractBundlePass(t *testing.T) {
+	bundleFile := testBundleFile(t, []*tar.Header{
+		{Name: "users/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "users/bob.json", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "groups/devs.json", Typeflag: tar.TypeReg, Mode: 0644},
+	}, []string{"", `{"id":"bob"}`, `{"id":"devs"}`})
+	defer os.Remove(bundleFile)
+
+	dir, err := ioutil.TempDir("", "argo-lyte-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	err = extractBundle(bundleFile, dir)
+	assert.Nil(t, err)
+
+	result, err := ioutil.ReadFile(dir + "/users/bob.json")
+	assert.Nil(t, err)
+	assert.Equal(t, string(result), `{"id":"bob"}`)
+
+	result, err = ioutil.ReadFile(dir + "/groups/devs.json")
+	assert.Nil(t, err)
+	assert.Equal(t, string(result), `{"id":"devs"}`)
+}
+
+func TestExtractBundleOutsideDir(t *testing.T) {
+	bundleFile := testBundleFile(t, []*tar.Header{
+		{Name: "../../etc/cron.d/evil", Typeflag: tar.TypeReg, Mode: 0644},
+	}, []string{"* * * * * root true"})
+	defer os.Remove(bundleFile)
+
+	dir, err := ioutil.TempDir("", "argo-lyte-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	err = extractBundle(bundleFile, dir)
+	assert.Equal(t, err.Error(), "Bundle entry outside of the bundle: ../../etc/cron.d/evil")
+}
+
+func TestExtractBundleSymlink(t *testing.T) {
+	bundleFile := testBundleFile(t, []*tar.Header{
+		{Name: "users", Typeflag: tar.TypeSymlink, Linkname: "/etc"},
+	}, []string{""})
+	defer os.Remove(bundleFile)
+
+	dir, err := ioutil.TempDir("", "argo-lyte-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	err = extractBundle(bundleFile, dir)
+	assert.Equal(t, err.Error(), "Unsupported bundle entry: users")
+}
+
+// a fixed time in the given year for tests
+func testTime(year int) time.Time {
+	return time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// bundleFiles
+func TestBundleFiles(t *testing.T) {
+	dir := testBundleDir(t, map[string]string{
+		"users/bob.json":    `{}`,
+		"users/alice.json":  `{}`,
+		"users/notes.txt":   `skipped`,
+		"groups/devs.json":  `{}`,
+		"manifest.json":     `{}`,
+		"groups/admin.json": `{}`,
+	})
+	defer os.RemoveAll(dir)
+
+	files, err := bundleFiles(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"groups/admin.json", "groups/devs.json", "users/alice.json", "users/bob.json"}, files)
+}
+
+func TestBundleFilesCA(t *testing.T) {
+	dir := testBundleDir(t, map[string]string{
+		"users/bob.json":   `{}`,
+		"groups/devs.json": `{}`,
+	})
+	defer os.RemoveAll(dir)
+
+	assert.Nil(t, os.Mkdir(dir+"/ca", 0700))
+	assert.Nil(t, ioutil.WriteFile(dir+"/ca/prod.pub", []byte("ssh-ed25519 AAAA prod-ca\n"), 0600))
+	assert.Nil(t, ioutil.WriteFile(dir+"/ca/notes.txt", []byte("skipped\n"), 0600))
+
+	files, err := bundleFiles(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"ca/prod.pub", "groups/devs.json", "users/bob.json"}, files)
+}
+
+// fileDigest
+func TestFileDigest(t *testing.T) {
+	dir := testBundleDir(t, map[string]string{"users/bob.json": "hello\n"})
+	defer os.RemoveAll(dir)
+
+	digest, err := fileDigest(dir + "/users/bob.json")
+	assert.Nil(t, err)
+	assert.Equal(t, digest, "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03")
+}
+
+// verifyManifest
+func TestVerifyManifestPass(t *testing.T) {
+	dir := testBundleDir(t, map[string]string{
+		"users/bob.json":   `{"id":"bob"}`,
+		"groups/devs.json": `{"id":"devs"}`,
+	})
+	defer os.RemoveAll(dir)
+
+	manifest, err := buildManifest(dir, 1, testTime(2026))
+	assert.Nil(t, err)
+	assert.Equal(t, len(verifyManifest(dir, manifest)), 0)
+}
+
+func TestVerifyManifestFail(t *testing.T) {
+	dir := testBundleDir(t, map[string]string{
+		"users/bob.json":   `{"id":"bob"}`,
+		"users/alice.json": `{"id":"alice"}`,
+		"groups/devs.json": `{"id":"devs"}`,
+	})
+	defer os.RemoveAll(dir)
+
+	manifest, err := buildManifest(dir, 1, testTime(2026))
+	assert.Nil(t, err)
+
+	assert.Nil(t, ioutil.WriteFile(dir+"/users/bob.json", []byte(`{"id":"root"}`), 0600))
+	assert.Nil(t, os.Remove(dir+"/users/alice.json"))
+	assert.Nil(t, ioutil.WriteFile(dir+"/users/mallory.json", []byte(`{"id":"mallory"}`), 0600))
+
+	problems := verifyManifest(dir, manifest)
+	assert.Equal(t, len(problems), 3)
+	assert.Equal(t, problems[0].Error(), "users/alice.json: In the manifest but missing from the bundle")
+	assert.Contains(t, problems[1].Error(), "users/bob.json: Digest ")
+	assert.Equal(t, problems[2].Error(), "users/mallory.json: Not in the manifest")
+}
+
+// checkManifest
+func TestCheckManifestPass(t *testing.T) {
+	dir := testBundleDir(t, map[string]string{"users/bob.json": `{"id":"bob"}`})
+	defer os.RemoveAll(dir)
+	testWriteManifest(t, dir, 5)
+
+	// first bundle with a manifest
+	manifest, err := checkManifest(dir, 0, false, false, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, manifest.Serial, uint64(5))
+
+	// same bundle again
+	manifest, err = checkManifest(dir, 5, true, false, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, manifest.Serial, uint64(5))
+
+	// newer bundle
+	manifest, err = checkManifest(dir, 4, true, false, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, manifest.Serial, uint64(5))
+}
+
+func TestCheckManifestRollback(t *testing.T) {
+	dir := testBundleDir(t, map[string]string{"users/bob.json": `{"id":"bob"}`})
+	defer os.RemoveAll(dir)
+	testWriteManifest(t, dir, 5)
+
+	_, err := checkManifest(dir, 6, true, false, nil)
+	assert.Equal(t, err.Error(), "Bundle serial 5 created 2026-01-01T00:00:00Z is older than the applied serial 6")
+
+	manifest, err := checkManifest(dir, 6, true, true, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, manifest.Serial, uint64(5))
+}
+
+func TestCheckManifestMissing(t *testing.T) {
+	dir := testBundleDir(t, map[string]string{"users/bob.json": `{"id":"bob"}`})
+	defer os.RemoveAll(dir)
+
+	// bundles without a manifest are fine until one with a manifest was applied
+	manifest, err := checkManifest(dir, 0, false, false, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, manifest)
+
+	_, err = checkManifest(dir, 6, true, false, nil)
+	assert.Equal(t, err.Error(), "Bundle has no manifest but serial 6 was already applied")
+}
+
+func TestCheckManifestDigestMismatch(t *testing.T) {
+	dir := testBundleDir(t, map[string]string{"users/bob.json": `{"id":"bob"}`})
+	defer os.RemoveAll(dir)
+	testWriteManifest(t, dir, 5)
+	assert.Nil(t, ioutil.WriteFile(dir+"/users/mallory.json", []byte(`{"id":"mallory"}`), 0600))
+
+	_, err := checkManifest(dir, 0, false, false, nil)
+	assert.Equal(t, err.Error(), "Bundle does not match its manifest: users/mallory.json: Not in the manifest")
+}
+
+func TestCheckManifestSignature(t *testing.T) {
+	dir := testBundleDir(t, map[string]string{"users/bob.json": `{"id":"bob"}`})
+	defer os.RemoveAll(dir)
+	testWriteManifest(t, dir, 5)
+	signer := testSigner(t)
+
+	// an unsigned bundle is refused when a public key is set
+	_, err := checkManifest(dir, 0, false, false, signer.PublicKey())
+	assert.Equal(t, err.Error(), "Bundle signature does not verify: open "+dir+"/manifest.sig: no such file or directory")
+
+	manifestData, err := ioutil.ReadFile(dir + "/" + manifestFile)
+	assert.Nil(t, err)
+	signatureData, err := signManifest(manifestData, signer)
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(dir+"/"+manifestSignatureFile, signatureData, 0600))
+	manifest, err := checkManifest(dir, 0, false, false, signer.PublicKey())
+	assert.Nil(t, err)
+	assert.Equal(t, manifest.Serial, uint64(5))
+
+	_, err = checkManifest(dir, 0, false, false, testSigner(t).PublicKey())
+	assert.Contains(t, err.Error(), "Bundle signature does not verify: manifest.sig: ")
+
+	// so is a bundle without a manifest, even with -allowrollback
+	assert.Nil(t, os.Remove(dir+"/"+manifestFile))
+	_, err = checkManifest(dir, 0, false, true, signer.PublicKey())
+	assert.Equal(t, err.Error(), "Bundle has no manifest to verify the signature of")
+}
+
+// checkBundleDocument
+func TestCheckManifestDocument(t *testing.T) {
+	dir := testBundleDir(t, map[string]string{"bundle.json": `{"users":[],"groups":[],"serial":7,"created":"2026-01-01T00:00:00Z"}`})
+	defer os.RemoveAll(dir)
+
+	// the serial of a single file bundle is in the document
+	manifest, err := checkManifest(dir, 6, true, false, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, manifest.Serial, uint64(7))
+	assert.Equal(t, manifest.Created, testTime(2026))
+
+	_, err = checkManifest(dir, 8, true, false, nil)
+	assert.Equal(t, err.Error(), "Bundle serial 7 created 2026-01-01T00:00:00Z is older than the applied serial 8")
+	manifest, err = checkManifest(dir, 8, true, true, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, manifest.Serial, uint64(7))
+
+	// single file bundles can't be signed
+	_, err = checkManifest(dir, 0, false, false, testSigner(t).PublicKey())
+	assert.Equal(t, err.Error(), "Single file bundles can't be signed, only tarballs built by pack -signkey are applied with -pubkey")
+
+	// without a serial it is fine until a serial was applied
+	assert.Nil(t, ioutil.WriteFile(dir+"/bundle.json", []byte(`{"users":[],"groups":[]}`), 0600))
+	manifest, err = checkManifest(dir, 0, false, false, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, manifest)
+	_, err = checkManifest(dir, 6, true, false, nil)
+	assert.Equal(t, err.Error(), "Single file bundle has no serial but serial 6 was already applied")
+}
+
+// readSigningKey
+func TestReadSigningKey(t *testing.T) {
+	dir := testBundleDir(t, map[string]string{})
+	defer os.RemoveAll(dir)
+	signer := testSigner(t)
+	assert.Nil(t, ioutil.WriteFile(dir+"/argo.pub", ssh.MarshalAuthorizedKey(signer.PublicKey()), 0600))
+	assert.Nil(t, ioutil.WriteFile(dir+"/bad.pub", []byte("not a key\n"), 0600))
+
+	publicKey, err := readSigningKey(dir + "/argo.pub")
+	assert.Nil(t, err)
+	assert.Equal(t, publicKey.Marshal(), signer.PublicKey().Marshal())
+
+	_, err = readSigningKey(dir + "/bad.pub")
+	assert.Equal(t, err.Error(), dir+"/bad.pub: ssh: no key found")
+}
+
+// an ssh signer with a new key for tests
+func testSigner(t *testing.T) ssh.Signer {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	assert.Nil(t, err)
+	return signer
+}
+
+// write the manifest of a bundle directory for tests
+func testWriteManifest(t *testing.T, dir string, serial uint64) {
+	manifest, err := buildManifest(dir, serial, testTime(2026))
+	assert.Nil(t, err)
+	data, err := json.Marshal(manifest)
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(dir+"/"+manifestFile, data, 0600))
+}
+
+// readManifest
+func TestReadManifestMissing(t *testing.T) {
+	dir := testBundleDir(t, map[string]string{})
+	defer os.RemoveAll(dir)
+
+	manifest, err := readManifest(dir)
+	assert.Nil(t, err)
+	assert.Nil(t, manifest)
+}
+
+// signManifest
+func TestSignManifestRSA(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	assert.Nil(t, err)
+
+	manifestData := []byte(`{"files":{}}`)
+	signatureData, err := signManifest(manifestData, signer)
+	assert.Nil(t, err)
+	assert.Nil(t, verifyManifestSignature(manifestData, signatureData, signer.PublicKey()))
+	assert.NotNil(t, verifyManifestSignature([]byte(`{"files":{"users/root.json":""}}`), signatureData, signer.PublicKey()))
+}
+
+// bundleDocumentFormat
+func TestBundleDocumentFormat(t *testing.T) {
+	assert.Equal(t, bundleDocumentFormat("https://example.com/argo", "application/json; charset=utf-8"), ".json")
+	assert.Equal(t, bundleDocumentFormat("https://example.com/argo", "application/x-yaml"), ".yaml")
+	assert.Equal(t, bundleDocumentFormat("https://bucket.s3.amazonaws.com/argo.json?X-Amz-Expires=60", "binary/octet-stream"), ".json")
+	assert.Equal(t, bundleDocumentFormat("https://bucket.s3.amazonaws.com/argo.yml", ""), ".yaml")
+	assert.Equal(t, bundleDocumentFormat("https://bucket.s3.amazonaws.com/argo.tgz", "application/gzip"), "")
+	assert.Equal(t, bundleDocumentFormat("/tmp/argo.tar.gz", ""), "")
+}
+
+// findBundleDocument
+func TestFindBundleDocument(t *testing.T) {
+	dir := testBundleDir(t, map[string]string{})
+	defer os.RemoveAll(dir)
+	assert.Equal(t, findBundleDocument(dir), "")
+
+	assert.Nil(t, ioutil.WriteFile(dir+"/bundle.yaml", []byte("users: []\n"), 0600))
+	assert.Equal(t, findBundleDocument(dir), dir+"/bundle.yaml")
+}
+
+// loadBundle
+func TestLoadBundleDocument(t *testing.T) {
+	dir, err := ioutil.TempDir("", "argo-lyte-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	document := `{
+		"users": [
+			{"id": "bob", "shell": "/bin/sh", "ssh_keys": []},
+			{"id": "alice", "shell": "/bin/sh", "ssh_keys": []},
+			{"id": "alice", "shell": "/bin/zsh", "ssh_keys": []}
+		],
+		"groups": [
+			{"id": "devs", "users": ["bob", "alice"], "admins": []}
+		]
+	}`
+	assert.Nil(t, ioutil.WriteFile(dir+"/bundle.json", []byte(document), 0600))
+
+	groups, users, failures, err := loadBundle(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, []ArgoGroup{{"devs", []string{"bob", "alice"}, []string{}}}, groups)
+	assert.Equal(t, []ArgoUser{{SSHkeys: []SSHKey{}, ID: "bob", Shell: "/bin/sh"}}, users)
+	assert.Equal(t, len(failures), 1)
+	assert.Equal(t, failures[0].Kind, "user")
+	assert.Equal(t, failures[0].Err.Error(), "User alice is defined more than once: users[1], users[2]")
+}
+
+func TestLoadBundleDocumentYAML(t *testing.T) {
+	dir, err := ioutil.TempDir("", "argo-lyte-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	document := "users:\n  - id: bob\n    shell: /bin/sh\n    ssh_keys: []\ngroups:\n  - id: devs\n    users: [bob]\n    admins: []\n"
+	assert.Nil(t, ioutil.WriteFile(dir+"/bundle.yaml", []byte(document), 0600))
+
+	groups, users, failures, err := loadBundle(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, []ArgoGroup{{"devs", []string{"bob"}, []string{}}}, groups)
+	assert.Equal(t, []ArgoUser{{SSHkeys: []SSHKey{}, ID: "bob", Shell: "/bin/sh"}}, users)
+	assert.Equal(t, len(failures), 0)
+}
+
+func TestLoadBundleDocumentFail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "argo-lyte-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// a broken single file bundle fails the whole bundle instead of deleting everyone
+	assert.Nil(t, ioutil.WriteFile(dir+"/bundle.json", []byte(`{"users": [{"id": "bob"`), 0600))
+
+	_, _, _, err = loadBundle(dir)
+	assert.Equal(t, err.Error(), "unexpected EOF")
+}
+
+func TestLoadBundleDir(t *testing.T) {
+	dir := testBundleDir(t, map[string]string{
+		"users/bob.json":   `{"id":"bob","shell":"/bin/sh","ssh_keys":[]}`,
+		"groups/devs.json": `{"id":"devs","users":["bob"],"admins":[]}`,
+	})
+	defer os.RemoveAll(dir)
+
+	groups, users, failures, err := loadBundle(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, len(groups), 1)
+	assert.Equal(t, len(users), 1)
+	assert.Equal(t, len(failures), 0)
+}
+
+func TestLoadBundleInvalidIDs(t *testing.T) {
+	dir := testBundleDir(t, map[string]string{
+		"bundle.json": `{"users":[{"id":"bob","shell":"/bin/sh"},{"id":"..","shell":"/bin/sh"},` +
+			`{"id":"eve","shell":"/bin/sh\nevil::0:0::/root:/bin/sh"}],"groups":[{"id":"devs"},{"id":"../etc"}]}`,
+	})
+	defer os.RemoveAll(dir)
+
+	// ids and shells that can't be used are failures that reconcile never sees
+	groups, users, failures, err := loadBundle(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, groups, []ArgoGroup{{ID: "devs"}})
+	assert.Equal(t, len(users), 1)
+	assert.Equal(t, users[0].ID, "bob")
+	assert.Equal(t, failures, []SyncFailure{
+		{Kind: "group", ID: "../etc", Err: errors.New(`Id "../etc" is not a valid user or group name`)},
+		{Kind: "user", ID: "..", Err: errors.New(`Id ".." is not a valid user or group name`)},
+		{Kind: "user", ID: "eve", Err: errors.New(`Shell "/bin/sh\nevil::0:0::/root:/bin/sh" contains ':' or a newline`)},
+	})
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// BusyBoxAccounts - manages the accounts with the adduser, addgroup, deluser and delgroup applets of BusyBox,
+// for Alpine and other images without shadow-utils. BusyBox has no --root, so with -root the applets run chrooted.
+type BusyBoxAccounts struct{}
+
+var _ AccountManager = BusyBoxAccounts{}
+
+// Tested
+// Run a BusyBox applet, inside the alternate root when there is one
+func runBusyBox(applet string, args ...string) error {
+	var cmd *exec.Cmd
+	if rootDirectory == "" {
+		cmd = exec.Command(applet, args...)
+	} else {
+		cmd = exec.Command("chroot", append([]string{rootDirectory, applet}, args...)...)
+	}
+
+	var out bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		errString := fmt.Sprint(err) + ": " + stderr.String()
+		return errors.New(errString)
+	}
+
+	return nil
+}
+
+// Tested
+// GroupAdd - add the group with addgroup
+func (BusyBoxAccounts) GroupAdd(groupName string) error {
+	fmt.Printf("Creating group: %v\n", groupName)
+	return runBusyBox("addgroup", groupName)
+}
+
+// Tested
+// GroupDelete - delete the group with delgroup
+func (BusyBoxAccounts) GroupDelete(groupName string) error {
+	fmt.Printf("Deleting group: %v\n", groupName)
+	return runBusyBox("delgroup", groupName)
+}
+
+// Tested
+// UserAdd - add the user without a password with adduser, which also creates the group of the user,
+// then add it to its groups with addgroup. BusyBox adduser can only set the primary group.
+// When its password or a group can't be set the user is deleted again, so the next run creates it from scratch.
+func (BusyBoxAccounts) UserAdd(user ArgoUser, groups []string) error {
+	fmt.Printf("Creating user: %v and adding to these groups: %v\n", user.ID, groups)
+	err := runBusyBox("adduser", "-D", "-s", user.Shell, "-h", "/home/"+user.ID, user.ID)
+	if err != nil {
+		return err
+	}
+
+	// adduser -D locks the password, which sshd without PAM takes as a locked account even for key logins
+	err = FileAccounts{Dir: systemAccountsDir}.setNoPassword(user.ID)
+	if err != nil {
+		return undoBusyBoxUserAdd(user.ID, err)
+	}
+
+	for _, group := range groups {
+		err = runBusyBox("addgroup", user.ID, group)
+		if err != nil {
+			return undoBusyBoxUserAdd(user.ID, err)
+		}
+	}
+	return nil
+}
+
+// Tested
+// Delete a user UserAdd failed to set up, rather than leave it on the system without a leveldb record
+func undoBusyBoxUserAdd(userName string, err error) error {
+	if undoErr := runBusyBox("deluser", userName); undoErr != nil {
+		return fmt.Errorf("%s, and removing user %s again failed: %s", err, userName, undoErr)
+	}
+	return err
+}
+
+// Tested
+// UserDelete - delete the user, and its home directory with removeHome, with deluser
+func (BusyBoxAccounts) UserDelete(userName string, removeHome bool) error {
+	fmt.Printf("Deleting user: %v\n", userName)
+	if removeHome {
+		return runBusyBox("deluser", "--remove-home", userName)
+	}
+	return runBusyBox("deluser", userName)
+}
+
+// Tested
+// UserLock - lock the user by editing /etc/passwd and /etc/shadow, as BusyBox has no usermod to expire it or change its shell
+func (BusyBoxAccounts) UserLock(userName string) error {
+	return FileAccounts{Dir: systemAccountsDir}.UserLock(userName)
+}
+
+// Tested
+// UserUnlock - unlock the user by editing /etc/passwd and /etc/shadow
+func (BusyBoxAccounts) UserUnlock(user ArgoUser) error {
+	return FileAccounts{Dir: systemAccountsDir}.UserUnlock(user)
+}
+
+// Tested
+// UserExists - check the user is in the passwd database
+func (BusyBoxAccounts) UserExists(userName string) (bool, error) {
+	return userExists(userName)
+}
+
+// Tested
+// AddGroupToUser - add the user to a group with addgroup
+func (BusyBoxAccounts) AddGroupToUser(user string, group string) error {
+	fmt.Printf("Adding group: %s to user: %s\n", group, user)
+	return runBusyBox("addgroup", user, group)
+}
+
+// Tested
+// RemoveGroupFromUser - remove the user from a group with delgroup
+func (BusyBoxAccounts) RemoveGroupFromUser(user string, group string) error {
+	fmt.Printf("Deleting group: %s from user: %s\n", group, user)
+	return runBusyBox("delgroup", user, group)
+}
+
+// Tested
+// UserIDs - look up the uid of the user and the gid of its group
+func (BusyBoxAccounts) UserIDs(userName string) (int, int, error) {
+	return ShadowAccounts{}.UserIDs(userName)
+}
+
+// Tested
+// Check a command is a BusyBox applet: a link to the busybox binary, or a binary whose help says BusyBox
+func isBusyBox(path string) bool {
+	target, err := filepath.EvalSymlinks(path)
+	if err == nil && filepath.Base(target) == "busybox" {
+		return true
+	}
+	// BusyBox applets print their help on stderr and exit non zero
+	out, _ := exec.Command(path, "--help").CombinedOutput()
+	return strings.Contains(string(out), "BusyBox")
+}
+
+// Tested
+// Pick the account backend of the machine: the shadow-utils commands when useradd is there,
+// BusyBox when adduser is a BusyBox applet, and the files backend otherwise
+func detectAccountManager() AccountManager {
+	if _, err := exec.LookPath("useradd"); err == nil {
+		return ShadowAccounts{}
+	}
+	if path, err := exec.LookPath("adduser"); err == nil && isBusyBox(path) {
+		return BusyBoxAccounts{}
+	}
+	return FileAccounts{Dir: systemAccountsDir}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A fake BusyBox applet: it logs its name and arguments, and fails when <applet>.fail exists,
+// also when it is the applet the fake chroot runs. It only uses shell builtins, as the PATH only has the fake applets.
+const testFakeApplet = `#!/bin/sh
+echo "${0##*/} $*" >> "${0%/*}/calls.log"
+applet="${0##*/}"
+if [ "$applet" = chroot ]; then
+	applet="$2"
+fi
+if [ -e "${0%/*}/$applet.fail" ]; then
+	read -r message < "${0%/*}/$applet.fail"
+	echo "$applet: $message" >&2
+	exit 1
+fi
+`
+
+// put fake BusyBox applets, links to a fake busybox binary, first in the PATH
+func testFakeBusyBox(t *testing.T) (string, func()) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The fake applets are shell scripts")
+	}
+	dir, err := ioutil.TempDir("", "argo-lyte-busybox")
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(dir+"/busybox", []byte(testFakeApplet), 0755))
+	for _, applet := range []string{"adduser", "addgroup", "deluser", "delgroup", "chroot"} {
+		assert.Nil(t, os.Symlink(dir+"/busybox", dir+"/"+applet))
+	}
+
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir)
+	return dir, func() {
+		os.Setenv("PATH", path)
+		os.RemoveAll(dir)
+	}
+}
+
+// the applet calls logged by the fake applets
+func testBusyBoxCalls(t *testing.T, dir string) []string {
+	data, err := ioutil.ReadFile(dir + "/calls.log")
+	if os.IsNotExist(err) {
+		return []string{}
+	}
+	assert.Nil(t, err)
+	os.Remove(dir + "/calls.log")
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// an alternate root where bob and alice have the locked password adduser -D leaves, as the fake adduser doesn't add them
+func testBusyBoxRoot(t *testing.T) (string, func()) {
+	root, cleanup := testFileAccountsRoot(t)
+	passwd := "root:x:0:0:root:/root:/bin/bash\nbob:x:1001:1001::/home/bob:/bin/ash\nalice:x:1002:1002::/home/alice:/bin/ash\n"
+	assert.Nil(t, ioutil.WriteFile(root+"/etc/passwd", []byte(passwd), 0644))
+	shadow := "root:*:17000:0:99999:7:::\nbob:!:17000:0:99999:7:::\nalice:!:17000:0:99999:7:::\n"
+	assert.Nil(t, ioutil.WriteFile(root+"/etc/shadow", []byte(shadow), 0640))
+	return root, cleanup
+}
+
+// BusyBoxAccounts
+func TestBusyBoxAccounts(t *testing.T) {
+	dir, cleanup := testFakeBusyBox(t)
+	defer cleanup()
+	root, cleanupRoot := testBusyBoxRoot(t)
+	defer cleanupRoot()
+	chroot := "chroot " + root + " "
+
+	accounts := BusyBoxAccounts{}
+	assert.Nil(t, accounts.GroupAdd("admins"))
+	assert.Equal(t, testBusyBoxCalls(t, dir), []string{chroot + "addgroup admins"})
+
+	assert.Nil(t, accounts.UserAdd(ArgoUser{ID: "bob", Shell: "/bin/ash"}, []string{"admins", "devs"}))
+	assert.Equal(t, testBusyBoxCalls(t, dir), []string{chroot + "adduser -D -s /bin/ash -h /home/bob bob", chroot + "addgroup bob admins", chroot + "addgroup bob devs"})
+
+	assert.Nil(t, accounts.UserAdd(ArgoUser{ID: "alice", Shell: "/bin/ash"}, nil))
+	assert.Equal(t, testBusyBoxCalls(t, dir), []string{chroot + "adduser -D -s /bin/ash -h /home/alice alice"})
+
+	// the users have no password rather than a locked one
+	assert.Equal(t, testReadRootFile(t, root, "/etc/shadow"), "root:*:17000:0:99999:7:::\nbob:*:17000:0:99999:7:::\nalice:*:17000:0:99999:7:::\n")
+
+	assert.Nil(t, accounts.AddGroupToUser("bob", "ops"))
+	assert.Equal(t, testBusyBoxCalls(t, dir), []string{chroot + "addgroup bob ops"})
+
+	assert.Nil(t, accounts.RemoveGroupFromUser("bob", "ops"))
+	assert.Equal(t, testBusyBoxCalls(t, dir), []string{chroot + "delgroup bob ops"})
+
+	assert.Nil(t, accounts.UserDelete("bob", true))
+	assert.Equal(t, testBusyBoxCalls(t, dir), []string{chroot + "deluser --remove-home bob"})
+
+	assert.Nil(t, accounts.UserDelete("alice", false))
+	assert.Equal(t, testBusyBoxCalls(t, dir), []string{chroot + "deluser alice"})
+
+	assert.Nil(t, accounts.GroupDelete("admins"))
+	assert.Equal(t, testBusyBoxCalls(t, dir), []string{chroot + "delgroup admins"})
+}
+
+func TestBusyBoxAccountsFailures(t *testing.T) {
+	dir, cleanup := testFakeBusyBox(t)
+	defer cleanup()
+	root, cleanupRoot := testBusyBoxRoot(t)
+	defer cleanupRoot()
+	chroot := "chroot " + root + " "
+
+	// the output of the applet is the error, and a failed adduser doesn't go on to the groups
+	assert.Nil(t, ioutil.WriteFile(dir+"/adduser.fail", []byte("user 'bob' in use"), 0644))
+	err := BusyBoxAccounts{}.UserAdd(ArgoUser{ID: "bob", Shell: "/bin/ash"}, []string{"admins"})
+	assert.Equal(t, err.Error(), "exit status 1: adduser: user 'bob' in use\n")
+	assert.Equal(t, testBusyBoxCalls(t, dir), []string{chroot + "adduser -D -s /bin/ash -h /home/bob bob"})
+
+	assert.Nil(t, ioutil.WriteFile(dir+"/addgroup.fail", []byte("unknown group admins"), 0644))
+	err = BusyBoxAccounts{}.AddGroupToUser("alice", "admins")
+	assert.Equal(t, err.Error(), "exit status 1: addgroup: unknown group admins\n")
+	testBusyBoxCalls(t, dir)
+
+	// a user whose groups can't be added is deleted again
+	assert.Nil(t, os.Remove(dir+"/adduser.fail"))
+	err = BusyBoxAccounts{}.UserAdd(ArgoUser{ID: "alice", Shell: "/bin/ash"}, []string{"admins"})
+	assert.Equal(t, err.Error(), "exit status 1: addgroup: unknown group admins\n")
+	assert.Equal(t, testBusyBoxCalls(t, dir), []string{chroot + "adduser -D -s /bin/ash -h /home/alice alice", chroot + "addgroup alice admins", chroot + "deluser alice"})
+
+	// and so is one whose password can't be set
+	err = BusyBoxAccounts{}.UserAdd(ArgoUser{ID: "carol", Shell: "/bin/ash"}, nil)
+	assert.Equal(t, err.Error(), "User 'carol' does not exist")
+	assert.Equal(t, testBusyBoxCalls(t, dir), []string{chroot + "adduser -D -s /bin/ash -h /home/carol carol", chroot + "deluser carol"})
+
+	assert.Nil(t, ioutil.WriteFile(dir+"/deluser.fail", []byte("user alice is busy"), 0644))
+	err = BusyBoxAccounts{}.UserAdd(ArgoUser{ID: "alice", Shell: "/bin/ash"}, []string{"admins"})
+	assert.Equal(t, err.Error(), "exit status 1: addgroup: unknown group admins\n, and removing user alice again failed: exit status 1: deluser: user alice is busy\n")
+}
+
+// BusyBoxAccounts.UserLock, BusyBoxAccounts.UserUnlock
+func TestBusyBoxAccountsLock(t *testing.T) {
+	root, cleanup := testFileAccountsRoot(t)
+	defer cleanup()
+
+	// the files are edited, without running an applet
+	assert.Nil(t, BusyBoxAccounts{}.UserLock("bob"))
+	assert.Contains(t, testReadRootFile(t, root, "/etc/shadow"), "\nbob:!:17000:0:99999:7::1:\n")
+	assert.Nil(t, BusyBoxAccounts{}.UserUnlock(ArgoUser{ID: "bob", Shell: "/bin/ash"}))
+	assert.Contains(t, testReadRootFile(t, root, "/etc/passwd"), "\nbob:x:1001:1001::/home/bob:/bin/ash\n")
+}
+
+// runBusyBox
+func TestRunBusyBoxInRoot(t *testing.T) {
+	dir, cleanup := testFakeBusyBox(t)
+	defer cleanup()
+
+	rootDirectory = "/mnt/image"
+	defer func() { rootDirectory = "" }()
+	assert.Nil(t, runBusyBox("addgroup", "admins"))
+	assert.Equal(t, testBusyBoxCalls(t, dir), []string{"chroot /mnt/image addgroup admins"})
+}
+
+// isBusyBox, detectAccountManager
+func TestDetectAccountManager(t *testing.T) {
+	dir, cleanup := testFakeBusyBox(t)
+	defer cleanup()
+
+	assert.True(t, isBusyBox(dir+"/adduser"))
+	assert.Equal(t, detectAccountManager(), BusyBoxAccounts{})
+
+	// a Debian adduser isn't BusyBox
+	assert.Nil(t, os.Remove(dir+"/adduser"))
+	assert.Nil(t, ioutil.WriteFile(dir+"/adduser", []byte("#!/bin/sh\necho 'adduser [--home DIR] [--shell SHELL] USER'\n"), 0755))
+	assert.False(t, isBusyBox(dir+"/adduser"))
+	assert.Equal(t, detectAccountManager(), FileAccounts{Dir: "/etc"})
+
+	// an adduser that is a copy of busybox says so in its help
+	assert.Nil(t, ioutil.WriteFile(dir+"/adduser", []byte("#!/bin/sh\necho 'BusyBox v1.36.1 multi-call binary.' >&2\nexit 1\n"), 0755))
+	assert.True(t, isBusyBox(dir+"/adduser"))
+
+	assert.Nil(t, ioutil.WriteFile(dir+"/useradd", []byte(testFakeApplet), 0755))
+	assert.Equal(t, detectAccountManager(), ShadowAccounts{})
+}
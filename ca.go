@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// Directory of a bundle with the public keys of the ssh certificate authorities, one or more keys per .pub file
+const caKeysDir = "ca"
+
+// leveldb key of the ca keys written to the TrustedUserCAKeys file
+const caKeysKey = "ca@keys"
+
+// Tested
+// Check the file is a ca public key file
+func isCAKeyFile(fileName string) bool {
+	return filepath.Ext(fileName) == ".pub"
+}
+
+// Tested
+// Read the keys of a ca public key file, skipping blank and comment lines
+func readCAKeyFile(caKeyFile string) ([]string, error) {
+	fmt.Printf("Reading file: %s\n", caKeyFile)
+	data, err := ioutil.ReadFile(caKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	caKeys := make([]string, 0)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		caKeys = append(caKeys, line)
+	}
+	return caKeys, nil
+}
+
+// Tested
+// Load the ca keys of the bundle in dir, from the single file bundle or the ca folder. A bundle without ca keys has none.
+func loadCAKeys(dir string) ([]string, error) {
+	if document := findBundleDocument(dir); document != "" {
+		bundle, err := getBundleFromFile(document)
+		if err != nil {
+			return nil, err
+		}
+		return bundle.CAKeys, nil
+	}
+
+	caKeys := make([]string, 0)
+	files, err := ioutil.ReadDir(dir + "/" + caKeysDir)
+	if os.IsNotExist(err) {
+		return caKeys, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if file.IsDir() || !isCAKeyFile(file.Name()) {
+			continue
+		}
+		fileKeys, err := readCAKeyFile(dir + "/" + caKeysDir + "/" + file.Name())
+		if err != nil {
+			return nil, err
+		}
+		caKeys = append(caKeys, fileKeys...)
+	}
+	return caKeys, nil
+}
+
+// Tested
+// Normalize the ca keys of the bundle. Keys that don't parse, have options, are listed twice or break the key policy
+// are dropped and returned as problems.
+func normalizeCAKeys(caKeys []string, policy KeyPolicy) ([]string, []error) {
+	problems := make([]error, 0)
+	validKeys := make([]string, 0)
+	for _, caKey := range caKeys {
+		keyProblems := validateCAKey(caKey)
+		if len(keyProblems) > 0 {
+			problems = append(problems, keyProblems...)
+			continue
+		}
+		validKeys = append(validKeys, caKey)
+	}
+
+	normalizedKeys, keyProblems := normalizeSSHKeys(validKeys)
+	problems = append(problems, keyProblems...)
+	normalizedKeys, keyProblems = applyKeyPolicy(policy, normalizedKeys)
+	return normalizedKeys, append(problems, keyProblems...)
+}
+
+// Tested
+// Check a principal can be written to an AuthorizedPrincipalsFile
+func validatePrincipal(principal string) error {
+	if principal == "" {
+		return errors.New("Empty principal")
+	}
+	if strings.ContainsAny(principal, " \t\r\n,") || strings.HasPrefix(principal, "#") {
+		return fmt.Errorf("Invalid principal %q", principal)
+	}
+	return nil
+}
+
+// Tested
+// Drop the principals that can't be written to an AuthorizedPrincipalsFile and the ones listed twice, returning them as problems
+func normalizePrincipals(principals []string) ([]string, []error) {
+	validPrincipals := make([]string, 0)
+	problems := make([]error, 0)
+	for _, principal := range principals {
+		if err := validatePrincipal(principal); err != nil {
+			problems = append(problems, err)
+			continue
+		}
+		if contains(validPrincipals, principal) {
+			problems = append(problems, fmt.Errorf("Duplicate principal %q", principal))
+			continue
+		}
+		validPrincipals = append(validPrincipals, principal)
+	}
+	return validPrincipals, problems
+}
+
+// Tested
+// Check two lists have the same strings in the same order
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Tested
+// Render a file with one entry per line under the argo-lyte header
+func renderLines(lines []string) string {
+	fileText := "# Generated by argo-lyte\n"
+	fileText += "# Local modifications will be overwritten.\n\n"
+	for _, line := range lines {
+		fileText += line + "\n"
+	}
+	return fileText
+}
+
+// Tested
+// Write the AuthorizedPrincipalsFile of a user, readable by sshd and not writable by the user
+func writePrincipalsFile(principalsDir string, user string, principals []string) error {
+	err := os.MkdirAll(principalsDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	principalsFile := principalsDir + "/" + user
+	fmt.Printf("Creating principals file: %s\n", principalsFile)
+	return writeFileAtomic(principalsFile, []byte(renderLines(principals)), 0644, -1, -1)
+}
+
+// Tested
+// Delete the AuthorizedPrincipalsFile of a user. A missing file is already deleted.
+func deletePrincipalsFile(principalsDir string, user string) error {
+	principalsFile := principalsDir + "/" + user
+	fmt.Printf("Deleting principals file: %s\n", principalsFile)
+	err := os.Remove(principalsFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Tested
+// Get the ca keys last written to the TrustedUserCAKeys file
+func getAppliedCAKeys(db *leveldb.DB) ([]string, error) {
+	data, err := db.Get([]byte(caKeysKey), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	return strings.Split(string(data), "\n"), nil
+}
+
+// Tested
+// Write the TrustedUserCAKeys file when the ca keys changed and remember them. The file is deleted when
+// the bundle has no ca keys anymore, and left alone when argo-lyte never wrote it.
+func syncCAKeys(db *leveldb.DB, caKeysFile string, caKeys []string) error {
+	appliedCAKeys, err := getAppliedCAKeys(db)
+	if err != nil {
+		return err
+	}
+	if equalStrings(appliedCAKeys, caKeys) {
+		return nil
+	}
+
+	if len(caKeys) == 0 {
+		fmt.Printf("Deleting ca keys file: %s\n", caKeysFile)
+		err = os.Remove(caKeysFile)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return db.Delete([]byte(caKeysKey), nil)
+	}
+
+	fmt.Printf("Creating ca keys file: %s\n", caKeysFile)
+	err = writeFileAtomic(caKeysFile, []byte(renderLines(caKeys)), 0644, -1, -1)
+	if err != nil {
+		return err
+	}
+	return db.Put([]byte(caKeysKey), []byte(strings.Join(caKeys, "\n")), nil)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// isCAKeyFile
+func TestIsCAKeyFile(t *testing.T) {
+	assert.True(t, isCAKeyFile("users_ca.pub"))
+	assert.False(t, isCAKeyFile("users_ca"))
+	assert.False(t, isCAKeyFile("README.txt"))
+}
+
+// readCAKeyFile
+func TestReadCAKeyFile(t *testing.T) {
+	dir := testBundleDir(t, map[string]string{"users/ca.pub": "# prod ca\nssh-ed25519 AAAA prod-ca\n\n  ssh-ed25519 BBBB next-ca  \n"})
+	defer os.RemoveAll(dir)
+
+	caKeys, err := readCAKeyFile(dir + "/users/ca.pub")
+	assert.Nil(t, err)
+	assert.Equal(t, caKeys, []string{"ssh-ed25519 AAAA prod-ca", "ssh-ed25519 BBBB next-ca"})
+}
+
+// loadCAKeys
+func TestLoadCAKeysDir(t *testing.T) {
+	dir := testBundleDir(t, map[string]string{})
+	defer os.RemoveAll(dir)
+
+	caKeys, err := loadCAKeys(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, len(caKeys), 0)
+
+	assert.Nil(t, os.Mkdir(dir+"/ca", 0700))
+	assert.Nil(t, ioutil.WriteFile(dir+"/ca/prod.pub", []byte("ssh-ed25519 AAAA prod-ca\n"), 0600))
+	assert.Nil(t, ioutil.WriteFile(dir+"/ca/README.txt", []byte("skipped\n"), 0600))
+
+	caKeys, err = loadCAKeys(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, caKeys, []string{"ssh-ed25519 AAAA prod-ca"})
+}
+
+func TestLoadCAKeysDocument(t *testing.T) {
+	dir, err := ioutil.TempDir("", "argo-lyte-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.Nil(t, ioutil.WriteFile(dir+"/bundle.json", []byte(`{"users":[],"groups":[],"ca_keys":["ssh-ed25519 AAAA prod-ca"]}`), 0600))
+
+	caKeys, err := loadCAKeys(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, caKeys, []string{"ssh-ed25519 AAAA prod-ca"})
+}
+
+// normalizeCAKeys
+func TestNormalizeCAKeys(t *testing.T) {
+	caKey := testSSHKey(t, "prod-ca")
+	policy := KeyPolicy{SecurityKeys: securityKeysAllow}
+
+	caKeys, problems := normalizeCAKeys([]string{caKey, "ssh_key1", `cert-authority ` + caKey, caKey + "  "}, policy)
+	assert.Equal(t, caKeys, []string{caKey})
+	assert.Equal(t, len(problems), 3)
+	assert.Equal(t, problems[0].Error(), `Invalid ssh key "ssh_key1": ssh: no key found`)
+	assert.Equal(t, problems[1].Error(), `Ca key "cert-authority `+caKey+`" can't have options`)
+	assert.True(t, strings.HasPrefix(problems[2].Error(), "Duplicate ssh key SHA256:"))
+
+	policy.AllowedTypes = []string{"ssh-rsa"}
+	caKeys, problems = normalizeCAKeys([]string{caKey}, policy)
+	assert.Equal(t, len(caKeys), 0)
+	assert.Equal(t, len(problems), 1)
+}
+
+// validatePrincipal
+func TestValidatePrincipal(t *testing.T) {
+	assert.Nil(t, validatePrincipal("bob"))
+	assert.Nil(t, validatePrincipal("deploy@prod"))
+	assert.Equal(t, validatePrincipal("").Error(), "Empty principal")
+	assert.Equal(t, validatePrincipal("bob smith").Error(), `Invalid principal "bob smith"`)
+	assert.Equal(t, validatePrincipal("bob,root").Error(), `Invalid principal "bob,root"`)
+	assert.Equal(t, validatePrincipal("#bob").Error(), `Invalid principal "#bob"`)
+}
+
+// normalizePrincipals
+func TestNormalizePrincipals(t *testing.T) {
+	principals, problems := normalizePrincipals([]string{"bob", "bob smith", "oncall", "bob"})
+	assert.Equal(t, principals, []string{"bob", "oncall"})
+	assert.Equal(t, len(problems), 2)
+	assert.Equal(t, problems[1].Error(), `Duplicate principal "bob"`)
+}
+
+// equalStrings
+func TestEqualStrings(t *testing.T) {
+	assert.True(t, equalStrings(nil, []string{}))
+	assert.True(t, equalStrings([]string{"a", "b"}, []string{"a", "b"}))
+	assert.False(t, equalStrings([]string{"a", "b"}, []string{"b", "a"}))
+	assert.False(t, equalStrings([]string{"a"}, []string{"a", "b"}))
+}
+
+// renderLines
+func TestRenderLines(t *testing.T) {
+	assert.Equal(t, renderLines([]string{"bob", "oncall"}), "# Generated by argo-lyte\n# Local modifications will be overwritten.\n\nbob\noncall\n")
+}
+
+// writePrincipalsFile, deletePrincipalsFile
+func TestPrincipalsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "argo-lyte-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	principalsDir := dir + "/auth_principals"
+	err = writePrincipalsFile(principalsDir, "bob", []string{"bob", "oncall"})
+	assert.Nil(t, err)
+
+	data, err := ioutil.ReadFile(principalsDir + "/bob")
+	assert.Nil(t, err)
+	assert.Equal(t, string(data), renderLines([]string{"bob", "oncall"}))
+
+	fi, err := os.Stat(principalsDir + "/bob")
+	assert.Nil(t, err)
+	assert.Equal(t, fi.Mode().Perm(), os.FileMode(0644))
+
+	assert.Nil(t, deletePrincipalsFile(principalsDir, "bob"))
+	assert.Nil(t, deletePrincipalsFile(principalsDir, "bob"))
+	_, err = os.Stat(principalsDir + "/bob")
+	assert.True(t, os.IsNotExist(err))
+}
+
+// syncCAKeys, getAppliedCAKeys
+func TestSyncCAKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "argo-lyte-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := leveldb.OpenFile(dir+"/db", nil)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	caKeysFile := dir + "/user_ca_keys"
+
+	// nothing to write and nothing written before leaves the file alone
+	assert.Nil(t, ioutil.WriteFile(caKeysFile, []byte("local\n"), 0644))
+	assert.Nil(t, syncCAKeys(db, caKeysFile, nil))
+	data, err := ioutil.ReadFile(caKeysFile)
+	assert.Nil(t, err)
+	assert.Equal(t, string(data), "local\n")
+
+	assert.Nil(t, syncCAKeys(db, caKeysFile, []string{"ssh-ed25519 AAAA prod-ca"}))
+	data, err = ioutil.ReadFile(caKeysFile)
+	assert.Nil(t, err)
+	assert.Equal(t, string(data), renderLines([]string{"ssh-ed25519 AAAA prod-ca"}))
+
+	caKeys, err := getAppliedCAKeys(db)
+	assert.Nil(t, err)
+	assert.Equal(t, caKeys, []string{"ssh-ed25519 AAAA prod-ca"})
+
+	// the ca keys going away from the bundle removes the file
+	assert.Nil(t, syncCAKeys(db, caKeysFile, []string{}))
+	_, err = os.Stat(caKeysFile)
+	assert.True(t, os.IsNotExist(err))
+
+	caKeys, err = getAppliedCAKeys(db)
+	assert.Nil(t, err)
+	assert.Equal(t, len(caKeys), 0)
+}
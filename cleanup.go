@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Where cron keeps the crontabs of the users: Debian, Red Hat and Alpine
+var crontabDirectories = []string{"/var/spool/cron/crontabs", "/var/spool/cron", "/etc/crontabs"}
+
+// Where at keeps its jobs, owned by the user that queued them: Debian and Red Hat
+var atJobDirectories = []string{"/var/spool/cron/atjobs", "/var/spool/at"}
+
+// Where the mail spools of the users are
+var mailDirectories = []string{"/var/mail", "/var/spool/mail"}
+
+// What -orphanaction does with the files still owned by a deleted user
+const (
+	orphanReport = "report"
+	orphanChown  = "chown"
+)
+
+// How many orphaned files a warning lists
+const orphanReportLimit = 10
+
+// Tested
+// Check the orphan action is one argo-lyte knows
+func checkOrphanAction(action string) error {
+	if action != orphanReport && action != orphanChown {
+		return fmt.Errorf("Unknown orphan action %q, expected %s or %s", action, orphanReport, orphanChown)
+	}
+	return nil
+}
+
+// Tested
+// Remove a file if it is a regular file. The bool is false when there was none.
+func removeRegularFile(path string) (bool, error) {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !fi.Mode().IsRegular() {
+		return false, nil
+	}
+	return true, os.Remove(path)
+}
+
+// Tested
+// Get the regular files directly in the directories that are owned by the uid
+func ownedSpoolFiles(dirs []string, uid int) ([]string, error) {
+	owned := make([]string, 0)
+	for _, dir := range dirs {
+		files, err := filepath.Glob(rootPath(dir) + "/*")
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			fi, err := os.Lstat(file)
+			if err != nil {
+				continue
+			}
+			if owner, _, ok := fileOwner(fi); ok && owner == uid && fi.Mode().IsRegular() {
+				owned = append(owned, file)
+			}
+		}
+	}
+	return owned, nil
+}
+
+// Tested
+// Find the files under a directory owned by the uid, without following symlinks.
+// Files that vanish or can't be read while walking are skipped. A missing directory has none.
+func findOwnedFiles(dir string, uid int) ([]string, error) {
+	owned := make([]string, 0)
+	if _, err := os.Lstat(dir); os.IsNotExist(err) {
+		return owned, nil
+	}
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			return nil
+		}
+		if owner, _, ok := fileOwner(fi); ok && owner == uid {
+			owned = append(owned, path)
+		}
+		return nil
+	})
+	return owned, err
+}
+
+// Tested
+// Get the uid and primary gid of the quarantine account, from the passwd file of the alternate root when there is one
+func quarantineIDs(userName string) (int, int, error) {
+	if rootDirectory != "" {
+		uid, err := getUIDByUserName(userName)
+		if err != nil {
+			return -1, -1, err
+		}
+		gid, err := primaryGIDInFile(rootPath("/etc/passwd"), userName)
+		return uid, gid, err
+	}
+
+	account, err := user.Lookup(userName)
+	if err != nil {
+		return -1, -1, err
+	}
+	uid, err := strconv.Atoi(account.Uid)
+	if err != nil {
+		return -1, -1, err
+	}
+	gid, err := strconv.Atoi(account.Gid)
+	if err != nil {
+		return -1, -1, err
+	}
+	return uid, gid, nil
+}
+
+// Tested
+// Get the primary gid of a user from a passwd file
+func primaryGIDInFile(file string, userName string) (int, error) {
+	passwd, err := readAccountFile(file)
+	if err != nil {
+		return -1, err
+	}
+	fields := passwd.entry(userName)
+	if fields == nil {
+		return -1, user.UnknownUserError(userName)
+	}
+	gid, err := strconv.Atoi(fieldAt(fields, 3))
+	if err != nil {
+		return -1, fmt.Errorf("Invalid gid %q of %s in %s", fieldAt(fields, 3), userName, file)
+	}
+	return gid, nil
+}
+
+// Tested
+// Clean up after a deleted user, so the next user given its uid inherits nothing: remove its crontab, at jobs
+// and, unless -removal keeps its files, its mail. Then report, or chown to -quarantineuser, the files under -orphanpaths
+// it still owns. A uid below 0 is unknown and only the crontab and mail are removed, as they are for uid 0.
+func cleanupUser(userName string, uid int, gid int) error {
+	if uid == 0 {
+		uid = -1
+	}
+	removed := make([]string, 0)
+	spools := make([]string, 0)
+	for _, dir := range crontabDirectories {
+		spools = append(spools, rootPath(dir+"/"+userName))
+	}
+	if removalPolicy != removalKeep {
+		for _, dir := range mailDirectories {
+			spools = append(spools, rootPath(dir+"/"+userName))
+		}
+	}
+	if uid >= 0 {
+		atJobs, err := ownedSpoolFiles(atJobDirectories, uid)
+		if err != nil {
+			return err
+		}
+		spools = append(spools, atJobs...)
+	}
+	for _, spool := range spools {
+		found, err := removeRegularFile(spool)
+		if err != nil {
+			return err
+		}
+		if found {
+			removed = append(removed, spool)
+		}
+	}
+	if len(removed) > 0 {
+		fmt.Printf("Removed the crontab, at jobs and mail of %s: %s\n", userName, strings.Join(removed, ", "))
+	}
+
+	if uid < 0 || orphanPaths == "" {
+		return nil
+	}
+	orphans := make([]string, 0)
+	for _, path := range strings.Split(orphanPaths, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		owned, err := findOwnedFiles(rootPath(path), uid)
+		if err != nil {
+			return err
+		}
+		orphans = append(orphans, owned...)
+	}
+	if len(orphans) == 0 {
+		return nil
+	}
+
+	listed := orphans
+	if len(listed) > orphanReportLimit {
+		listed = listed[:orphanReportLimit]
+	}
+	report := fmt.Sprintf("%d files still owned by uid %d: %s", len(orphans), uid, strings.Join(listed, ", "))
+	if len(orphans) > len(listed) {
+		report += ", ..."
+	}
+
+	if orphanAction == orphanChown {
+		quarantineUID, quarantineGID, err := quarantineIDs(quarantineUser)
+		if err != nil {
+			return err
+		}
+		for _, orphan := range orphans {
+			fi, err := os.Lstat(orphan)
+			if err != nil {
+				continue
+			}
+			// the group is only changed when it was the deleted user's, which can be given out again as well
+			newGID := -1
+			if _, fileGID, ok := fileOwner(fi); ok && fileGID == gid {
+				newGID = quarantineGID
+			}
+			err = os.Lchown(orphan, quarantineUID, newGID)
+			if err != nil {
+				return err
+			}
+		}
+		report = fmt.Sprintf("chowned to %s the %s", quarantineUser, report)
+	}
+	recordWarning("user", userName, errors.New(report))
+	return nil
+}
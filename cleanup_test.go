@@ -0,0 +1,137 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// a file of the alternate root owned by uid and gid
+func testOwnedFile(t *testing.T, root string, path string, uid int, gid int) {
+	assert.Nil(t, os.MkdirAll(filepath.Dir(root+path), 0755))
+	assert.Nil(t, ioutil.WriteFile(root+path, []byte("data\n"), 0600))
+	assert.Nil(t, os.Lchown(root+path, uid, gid))
+}
+
+// checkOrphanAction
+func TestCheckOrphanAction(t *testing.T) {
+	assert.Nil(t, checkOrphanAction("report"))
+	assert.Nil(t, checkOrphanAction("chown"))
+	assert.Equal(t, checkOrphanAction("delete").Error(), `Unknown orphan action "delete", expected report or chown`)
+}
+
+// removeRegularFile
+func TestRemoveRegularFile(t *testing.T) {
+	root, cleanup := testRootDirectory(t)
+	defer cleanup()
+
+	assert.Nil(t, ioutil.WriteFile(root+"/crontab", []byte("* * * * * true\n"), 0600))
+	found, err := removeRegularFile(root + "/crontab")
+	assert.Nil(t, err)
+	assert.True(t, found)
+	found, err = removeRegularFile(root + "/crontab")
+	assert.Nil(t, err)
+	assert.False(t, found)
+
+	// a directory or symlink isn't a spool file
+	found, err = removeRegularFile(root + "/etc")
+	assert.Nil(t, err)
+	assert.False(t, found)
+	assert.Nil(t, os.Symlink("/etc/passwd", root+"/link"))
+	found, err = removeRegularFile(root + "/link")
+	assert.Nil(t, err)
+	assert.False(t, found)
+}
+
+// primaryGIDInFile, quarantineIDs
+func TestQuarantineIDs(t *testing.T) {
+	root, cleanup := testRootDirectory(t)
+	defer cleanup()
+	assert.Nil(t, ioutil.WriteFile(root+"/etc/passwd", []byte("nobody:x:65534:65533::/nonexistent:/usr/sbin/nologin\nbad:x:1:x::/:/bin/false\n"), 0644))
+
+	uid, gid, err := quarantineIDs("nobody")
+	assert.Nil(t, err)
+	assert.Equal(t, uid, 65534)
+	assert.Equal(t, gid, 65533)
+
+	_, err = primaryGIDInFile(root+"/etc/passwd", "bad")
+	assert.Equal(t, err.Error(), `Invalid gid "x" of bad in `+root+"/etc/passwd")
+	_, _, err = quarantineIDs("alice")
+	assert.NotNil(t, err)
+}
+
+// cleanupUser, ownedSpoolFiles, findOwnedFiles
+func TestCleanupUser(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Creating files owned by another user needs root")
+	}
+	root, cleanup := testRootDirectory(t)
+	defer cleanup()
+	defer func() { orphanPaths, orphanAction, warnings = "", orphanReport, nil }()
+	warnings = nil
+
+	testOwnedFile(t, root, "/var/spool/cron/crontabs/alice", 4242, 4242)
+	testOwnedFile(t, root, "/var/spool/cron/atjobs/a0001", 4242, 4242)
+	testOwnedFile(t, root, "/var/spool/cron/atjobs/a0002", 1001, 1001)
+	testOwnedFile(t, root, "/var/mail/alice", 4242, 4242)
+	testOwnedFile(t, root, "/srv/data/report.csv", 4242, 4242)
+	testOwnedFile(t, root, "/srv/data/shared.csv", 4242, 100)
+	testOwnedFile(t, root, "/srv/data/bob.csv", 1001, 1001)
+
+	orphanPaths = "/srv, /missing"
+	orphanAction = orphanReport
+	assert.Nil(t, cleanupUser("alice", 4242, 4242))
+	for _, path := range []string{"/var/spool/cron/crontabs/alice", "/var/spool/cron/atjobs/a0001", "/var/mail/alice"} {
+		_, err := os.Lstat(root + path)
+		assert.True(t, os.IsNotExist(err), path)
+	}
+	_, err := os.Lstat(root + "/var/spool/cron/atjobs/a0002")
+	assert.Nil(t, err)
+	assert.Equal(t, len(warnings), 1)
+	assert.Equal(t, warnings[0].Message, "2 files still owned by uid 4242: "+root+"/srv/data/report.csv, "+root+"/srv/data/shared.csv")
+
+	// chowned to the quarantine account, the group only when it was the user's
+	assert.Nil(t, ioutil.WriteFile(root+"/etc/passwd", []byte("nobody:x:65534:65533::/nonexistent:/usr/sbin/nologin\n"), 0644))
+	orphanAction = orphanChown
+	quarantineUser = "nobody"
+	warnings = nil
+	assert.Nil(t, cleanupUser("alice", 4242, 4242))
+	assert.Equal(t, warnings[0].Message, "chowned to nobody the 2 files still owned by uid 4242: "+root+"/srv/data/report.csv, "+root+"/srv/data/shared.csv")
+	for path, gid := range map[string]int{"/srv/data/report.csv": 65533, "/srv/data/shared.csv": 100} {
+		fi, err := os.Lstat(root + path)
+		assert.Nil(t, err)
+		uid, fileGID, _ := fileOwner(fi)
+		assert.Equal(t, uid, 65534)
+		assert.Equal(t, fileGID, gid)
+	}
+
+	// nothing is searched for uid 0
+	testOwnedFile(t, root, "/var/spool/cron/atjobs/a0003", 0, 0)
+	warnings = nil
+	assert.Nil(t, cleanupUser("root", 0, 0))
+	_, err = os.Lstat(root + "/var/spool/cron/atjobs/a0003")
+	assert.Nil(t, err)
+	assert.Equal(t, len(warnings), 0)
+}
+
+// cleanupUser with -removal keep
+func TestCleanupUserKeepsMail(t *testing.T) {
+	root, cleanup := testRootDirectory(t)
+	defer cleanup()
+	defer func() { removalPolicy = removalRemove }()
+
+	assert.Nil(t, os.MkdirAll(root+"/var/mail", 0755))
+	assert.Nil(t, ioutil.WriteFile(root+"/var/mail/alice", []byte("mail\n"), 0600))
+	assert.Nil(t, os.MkdirAll(root+"/etc/crontabs", 0755))
+	assert.Nil(t, ioutil.WriteFile(root+"/etc/crontabs/alice", []byte("* * * * * true\n"), 0600))
+
+	removalPolicy = removalKeep
+	assert.Nil(t, cleanupUser("alice", -1, -1))
+	_, err := os.Lstat(root + "/var/mail/alice")
+	assert.Nil(t, err)
+	_, err = os.Lstat(root + "/etc/crontabs/alice")
+	assert.True(t, os.IsNotExist(err))
+}
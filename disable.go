@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Tested
+// Get the groups of -sudogroups
+func sudoGroupList() []string {
+	groups := make([]string, 0)
+	for _, group := range strings.Split(sudoGroups, ",") {
+		group = strings.TrimSpace(group)
+		if group != "" {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// Tested
+// Get the groups without the sudo groups, which a disabled user is taken out of
+func withoutSudoGroups(groups []string) []string {
+	sudo := sudoGroupList()
+	kept := make([]string, 0)
+	for _, group := range groups {
+		if !contains(sudo, group) {
+			kept = append(kept, group)
+		}
+	}
+	return kept
+}
+
+// Tested
+// Lock and expire a user disabled in the bundle, unless it is locked already, and mark its record disabled.
+// Its keys, principals and sudo groups are withheld by reconcile like any other change, and given back the same
+// way when it is enabled again. The bool is false when the lock failed.
+func disableUser(accounts AccountManager, user ArgoUser, userGroup *UserGroup) bool {
+	if userGroup.LockedAt.IsZero() && !userGroup.Disabled {
+		err := terminateUserSessions(accounts, user.ID)
+		if err != nil {
+			recordFailure("user", user.ID, err)
+		}
+		err = accounts.UserLock(user.ID)
+		if err != nil {
+			recordFailure("user", user.ID, err)
+			return false
+		}
+	}
+	userGroup.Disabled = true
+	userGroup.DisabledReason = user.DisabledReason
+	// a disabled user is no longer offboarding, it stays locked until the bundle enables it
+	userGroup.LockedAt = time.Time{}
+	if user.DisabledReason != "" {
+		fmt.Printf("User %s is disabled: %s\n", user.ID, user.DisabledReason)
+	} else {
+		fmt.Printf("User %s is disabled.\n", user.ID)
+	}
+	return true
+}
+
+// Tested
+// Unlock a user enabled again in the bundle, or back in it within the lock grace period. The bool is false when the unlock failed.
+func enableUser(accounts AccountManager, user ArgoUser, userGroup *UserGroup) bool {
+	err := accounts.UserUnlock(user)
+	if err != nil {
+		recordFailure("user", user.ID, err)
+		return false
+	}
+	if userGroup.Disabled {
+		fmt.Printf("User %s is enabled again. Unlocked it.\n", user.ID)
+	} else {
+		fmt.Printf("User %s is back in the bundle. Unlocked it.\n", user.ID)
+	}
+	userGroup.Disabled = false
+	userGroup.DisabledReason = ""
+	userGroup.LockedAt = time.Time{}
+	return true
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// sudoGroupList, withoutSudoGroups
+func TestWithoutSudoGroups(t *testing.T) {
+	defer func() { sudoGroups = "" }()
+
+	sudoGroups = ""
+	assert.Equal(t, sudoGroupList(), []string{})
+	assert.Equal(t, withoutSudoGroups([]string{"admins", "devs"}), []string{"admins", "devs"})
+
+	sudoGroups = "admins, wheel,"
+	assert.Equal(t, sudoGroupList(), []string{"admins", "wheel"})
+	assert.Equal(t, withoutSudoGroups([]string{"admins", "devs", "wheel"}), []string{"devs"})
+	assert.Equal(t, withoutSudoGroups(nil), []string{})
+}
+
+// disableUser, enableUser
+func TestDisableUser(t *testing.T) {
+	failures = nil
+	defer func() { failures = nil }()
+	terminateSessions = false
+	accounts := newFakeAccounts()
+	assert.Nil(t, accounts.UserAdd(ArgoUser{ID: "bob"}, nil))
+	bob := ArgoUser{ID: "bob", Disabled: true, DisabledReason: "on leave"}
+
+	// a user in the lock grace period is locked already
+	userGroup := &UserGroup{ID: "bob", LockedAt: time.Now()}
+	assert.True(t, disableUser(accounts, bob, userGroup))
+	assert.Equal(t, len(accounts.calls), 1)
+	assert.True(t, userGroup.Disabled)
+	assert.Equal(t, userGroup.DisabledReason, "on leave")
+	assert.True(t, userGroup.LockedAt.IsZero())
+
+	assert.True(t, enableUser(accounts, bob, userGroup))
+	assert.False(t, userGroup.Disabled)
+	assert.Equal(t, userGroup.DisabledReason, "")
+
+	accounts.fail["usermod --lock bob"] = errors.New("usermod: cannot lock /etc/shadow")
+	assert.False(t, disableUser(accounts, bob, userGroup))
+	assert.False(t, userGroup.Disabled)
+	assert.Equal(t, len(failures), 1)
+
+	accounts.fail = map[string]error{}
+	assert.True(t, disableUser(accounts, bob, userGroup))
+	assert.True(t, accounts.locked["bob"])
+	accounts.fail["usermod --unlock bob"] = errors.New("usermod: cannot lock /etc/shadow")
+	assert.False(t, enableUser(accounts, bob, userGroup))
+	assert.True(t, userGroup.Disabled)
+}
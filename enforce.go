@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// Tested
+// Compare the authorized_keys file on disk with the file argo-lyte renders and return what differs:
+// a missing file, its contents, its mode or its owner. Nothing differs when the file is as argo-lyte left it.
+func keyFileDrift(sshFile string, expected []byte, uid int, gid int) ([]string, error) {
+	fi, err := os.Lstat(sshFile)
+	if os.IsNotExist(err) {
+		return []string{"missing"}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return []string{"not a regular file"}, nil
+	}
+
+	drift := make([]string, 0)
+	data, err := ioutil.ReadFile(sshFile)
+	if err != nil {
+		return nil, err
+	}
+	expectedDigest := sha256.Sum256(expected)
+	digest := sha256.Sum256(data)
+	if !bytes.Equal(digest[:], expectedDigest[:]) {
+		drift = append(drift, "contents")
+	}
+	if fi.Mode().Perm() != 0600 {
+		drift = append(drift, fmt.Sprintf("mode %04o", fi.Mode().Perm()))
+	}
+	if fileUID, fileGID, ok := fileOwner(fi); ok && (fileUID != uid || fileGID != gid) {
+		drift = append(drift, fmt.Sprintf("owner %d:%d", fileUID, fileGID))
+	}
+	return drift, nil
+}
+
+// Not testable
+// Put back the authorized_keys file of a user when it was changed on the host and return what was changed.
+// A user without keys and without a file is left alone.
+func enforceAuthorizedKeyFile(accounts AccountManager, userName string, sshKeys []string) ([]string, error) {
+	sshFile := homeDirectory(userName) + "/.ssh/authorized_keys"
+
+	userID, groupID, err := accounts.UserIDs(userName)
+	if err != nil {
+		return nil, err
+	}
+
+	// only block mode keeps what is in the file, so only then must it be the user's own
+	ownerID := -1
+	if keyFileMode == keyFileBlock {
+		ownerID = userID
+	}
+	existing, err := readRegularFile(sshFile, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	if existing == nil && len(sshKeys) == 0 {
+		return nil, nil
+	}
+
+	expected, err := renderAuthorizedKeys(string(existing), sshKeys, keyFileMode)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", sshFile, err.Error())
+	}
+
+	drift, err := keyFileDrift(sshFile, []byte(expected), userID, groupID)
+	if err != nil || len(drift) == 0 {
+		return nil, err
+	}
+	return drift, updateAuthorizedKeyFile(accounts, userName, sshKeys)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fileOwner
+func TestFileOwner(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Files have no uid and gid on windows")
+	}
+	dir, err := ioutil.TempDir("", "argo-lyte-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	fi, err := os.Stat(dir)
+	assert.Nil(t, err)
+	uid, gid, ok := fileOwner(fi)
+	assert.True(t, ok)
+	assert.Equal(t, uid, os.Getuid())
+	assert.Equal(t, gid, os.Getgid())
+}
+
+// fileLinks
+func TestFileLinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Hard links aren't counted on windows")
+	}
+	dir, err := ioutil.TempDir("", "argo-lyte-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.Nil(t, ioutil.WriteFile(dir+"/file", []byte("data\n"), 0600))
+	assert.Nil(t, os.Link(dir+"/file", dir+"/link"))
+	fi, err := os.Stat(dir + "/file")
+	assert.Nil(t, err)
+	links, ok := fileLinks(fi)
+	assert.True(t, ok)
+	assert.Equal(t, links, 2)
+}
+
+// keyFileDrift
+func TestKeyFileDrift(t *testing.T) {
+	dir, err := ioutil.TempDir("", "argo-lyte-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	sshFile := dir + "/authorized_keys"
+	expected := []byte("ssh-ed25519 AAAA bob\n")
+
+	drift, err := keyFileDrift(sshFile, expected, os.Getuid(), os.Getgid())
+	assert.Nil(t, err)
+	assert.Equal(t, drift, []string{"missing"})
+
+	assert.Nil(t, ioutil.WriteFile(sshFile, expected, 0600))
+	assert.Nil(t, os.Chmod(sshFile, 0600))
+	drift, err = keyFileDrift(sshFile, expected, os.Getuid(), os.Getgid())
+	assert.Nil(t, err)
+	assert.Equal(t, len(drift), 0)
+
+	assert.Nil(t, ioutil.WriteFile(sshFile, []byte("ssh-ed25519 AAAA bob\nssh-ed25519 BBBB mallory\n"), 0600))
+	assert.Nil(t, os.Chmod(sshFile, 0644))
+	drift, err = keyFileDrift(sshFile, expected, os.Getuid(), os.Getgid())
+	assert.Nil(t, err)
+	assert.Equal(t, drift, []string{"contents", "mode 0644"})
+
+	if runtime.GOOS != "windows" {
+		assert.Nil(t, ioutil.WriteFile(sshFile, expected, 0600))
+		assert.Nil(t, os.Chmod(sshFile, 0600))
+		drift, err = keyFileDrift(sshFile, expected, os.Getuid()+1, os.Getgid())
+		assert.Nil(t, err)
+		assert.Equal(t, len(drift), 1)
+		assert.Equal(t, drift[0][:6], "owner ")
+	}
+
+	assert.Nil(t, os.Remove(sshFile))
+	assert.Nil(t, os.Symlink(dir+"/elsewhere", sshFile))
+	drift, err = keyFileDrift(sshFile, expected, os.Getuid(), os.Getgid())
+	assert.Nil(t, err)
+	assert.Equal(t, drift, []string{"not a regular file"})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Tested
+// Get the names of the users or groups tracked in leveldb under a key prefix, user@ or group@
+func trackedNames(db *leveldb.DB, prefix string) (map[string]bool, error) {
+	names := make(map[string]bool)
+	iter := db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	for iter.Next() {
+		names[strings.TrimPrefix(string(iter.Key()), prefix)] = true
+	}
+	iter.Release()
+	return names, iter.Error()
+}
+
+// Tested
+// Regenerate the libnss-extrausers files from the users and groups tracked in leveldb: entries argo-lyte
+// no longer tracks, and members that aren't its users, are dropped, and every file is rewritten atomically.
+// The files only ever hold argo-lyte's accounts, so removing them removes every account it made.
+func (a FileAccounts) regenerate(db *leveldb.DB) error {
+	users, err := trackedNames(db, "user@")
+	if err != nil {
+		return err
+	}
+	groups, err := trackedNames(db, "group@")
+	if err != nil {
+		return err
+	}
+
+	return a.update(func(pdb *passwdDatabase) error {
+		for _, fields := range pdb.passwd.entries() {
+			if !users[fields[0]] {
+				fmt.Printf("Dropping user %s from %s\n", fields[0], pdb.passwd.path)
+				pdb.passwd.remove(fields[0])
+			}
+		}
+		for _, fields := range pdb.shadow.entries() {
+			if !users[fields[0]] {
+				pdb.shadow.remove(fields[0])
+			}
+		}
+
+		// a user's own group goes with the user. The members of group and the admins and members of gshadow must be its users.
+		memberFields := map[*accountFile][]int{pdb.group: {3}, pdb.gshadow: {2, 3}}
+		for _, file := range []*accountFile{pdb.group, pdb.gshadow} {
+			for _, fields := range file.entries() {
+				if !groups[fields[0]] && !users[fields[0]] {
+					fmt.Printf("Dropping group %s from %s\n", fields[0], file.path)
+					file.remove(fields[0])
+					continue
+				}
+				for _, index := range memberFields[file] {
+					for _, member := range splitMembers(fieldAt(fields, index)) {
+						if !users[member] {
+							fields = removeMember(fields, index, member)
+						}
+					}
+				}
+				file.set(fields)
+			}
+		}
+
+		for _, file := range []*accountFile{pdb.group, pdb.gshadow, pdb.passwd, pdb.shadow} {
+			file.changed = true
+		}
+		return nil
+	})
+}
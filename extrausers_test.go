@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// FileAccounts.extraUsers, FileAccounts.systemAccounts
+func TestFileAccountsExtraUsers(t *testing.T) {
+	root, cleanup := testFileAccountsRoot(t)
+	defer cleanup()
+
+	assert.False(t, FileAccounts{Dir: systemAccountsDir}.extraUsers())
+	system, err := FileAccounts{Dir: systemAccountsDir}.systemAccounts()
+	assert.Nil(t, err)
+	assert.Equal(t, len(system.passwd.entries()), 0)
+
+	accounts := FileAccounts{Dir: extraUsersDir}
+	assert.True(t, accounts.extraUsers())
+	system, err = accounts.systemAccounts()
+	assert.Nil(t, err)
+	assert.Equal(t, system.passwd.path, root+"/etc/passwd")
+	assert.NotNil(t, system.passwd.entry("bob"))
+}
+
+// FileAccounts.GroupAdd with extrausers
+func TestExtraUsersGroups(t *testing.T) {
+	root, cleanup := testFileAccountsRoot(t)
+	defer cleanup()
+
+	// the group gets a gid the system doesn't use, and the system's files are left alone
+	accounts := FileAccounts{Dir: extraUsersDir}
+	assert.Nil(t, accounts.GroupAdd("devs"))
+	assert.Equal(t, testReadRootFile(t, root, "/var/lib/extrausers/group"), "devs:x:1003:\n")
+	assert.Equal(t, testReadRootFile(t, root, "/etc/group"), "root:x:0:\nbob:x:1001:\nadmins:x:1002:bob\n")
+	_, err := os.Stat(root + "/var/lib/extrausers/gshadow")
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Equal(t, accounts.GroupAdd("admins").Error(), "Group 'admins' already exists in "+root+"/etc/group")
+}
+
+// FileAccounts.UserAdd, FileAccounts.UserDelete with extrausers
+func TestExtraUsersUsers(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Creating a home directory owned by another user needs root")
+	}
+	root, cleanup := testFileAccountsRoot(t)
+	defer cleanup()
+
+	accounts := FileAccounts{Dir: extraUsersDir}
+	assert.Equal(t, accounts.UserAdd(ArgoUser{ID: "bob", Shell: "/bin/sh"}, nil).Error(), "User 'bob' already exists in "+root+"/etc/passwd")
+	assert.Equal(t, accounts.UserAdd(ArgoUser{ID: "admins", Shell: "/bin/sh"}, nil).Error(), "Group 'admins' already exists in "+root+"/etc/group")
+
+	// uid 1002 is free in /etc/passwd but gid 1002 is taken in /etc/group
+	assert.Nil(t, accounts.GroupAdd("devs"))
+	assert.Nil(t, accounts.UserAdd(ArgoUser{ID: "alice", Shell: "/bin/sh"}, []string{"devs"}))
+	assert.Equal(t, testReadRootFile(t, root, "/var/lib/extrausers/passwd"), "alice:x:1002:1004::/home/alice:/bin/sh\n")
+	assert.Equal(t, testReadRootFile(t, root, "/var/lib/extrausers/group"), "devs:x:1003:alice\nalice:x:1004:\n")
+	assert.Contains(t, testReadRootFile(t, root, "/var/lib/extrausers/shadow"), "alice:*:")
+	assert.Equal(t, testReadRootFile(t, root, "/etc/passwd"), "root:x:0:0:root:/root:/bin/bash\nbob:x:1001:1001::/home/bob:/bin/bash\n")
+
+	uid, gid, err := accounts.UserIDs("alice")
+	assert.Nil(t, err)
+	assert.Equal(t, uid, 1002)
+	assert.Equal(t, gid, 1004)
+
+	assert.Nil(t, accounts.UserDelete("alice", true))
+	assert.Equal(t, testReadRootFile(t, root, "/var/lib/extrausers/passwd"), "")
+	assert.Equal(t, testReadRootFile(t, root, "/var/lib/extrausers/group"), "devs:x:1003:\n")
+}
+
+// trackedNames, FileAccounts.regenerate
+func TestExtraUsersRegenerate(t *testing.T) {
+	root, cleanup := testFileAccountsRoot(t)
+	defer cleanup()
+
+	db, err := leveldb.OpenFile(root+"/db", nil)
+	assert.Nil(t, err)
+	defer db.Close()
+	assert.Nil(t, db.Put([]byte("user@alice"), []byte{}, nil))
+	assert.Nil(t, db.Put([]byte("group@devs"), []byte{}, nil))
+
+	names, err := trackedNames(db, "user@")
+	assert.Nil(t, err)
+	assert.Equal(t, names, map[string]bool{"alice": true})
+
+	// entries and members leveldb doesn't track, like an account added by hand, are dropped
+	dir := root + extraUsersDir
+	assert.Nil(t, os.MkdirAll(dir, 0755))
+	assert.Nil(t, writeFileAtomic(dir+"/passwd", []byte("alice:x:1002:1004::/home/alice:/bin/sh\nmallory:x:0:0::/root:/bin/sh\n"), 0644, -1, -1))
+	assert.Nil(t, writeFileAtomic(dir+"/shadow", []byte("alice:!:17000:0:99999:7:::\nmallory:!:17000:0:99999:7:::\n"), 0640, -1, -1))
+	assert.Nil(t, writeFileAtomic(dir+"/group", []byte("devs:x:1003:alice,mallory\nalice:x:1004:\nwheel:x:10:mallory\n"), 0644, -1, -1))
+
+	accounts := FileAccounts{Dir: extraUsersDir}
+	assert.Nil(t, accounts.regenerate(db))
+	assert.Equal(t, testReadRootFile(t, root, "/var/lib/extrausers/passwd"), "alice:x:1002:1004::/home/alice:/bin/sh\n")
+	assert.Equal(t, testReadRootFile(t, root, "/var/lib/extrausers/shadow"), "alice:!:17000:0:99999:7:::\n")
+	assert.Equal(t, testReadRootFile(t, root, "/var/lib/extrausers/group"), "devs:x:1003:alice\nalice:x:1004:\n")
+
+	// once leveldb tracks nothing the files are empty
+	assert.Nil(t, db.Delete([]byte("user@alice"), nil))
+	assert.Nil(t, db.Delete([]byte("group@devs"), nil))
+	assert.Nil(t, accounts.regenerate(db))
+	assert.Equal(t, testReadRootFile(t, root, "/var/lib/extrausers/passwd"), "")
+	assert.Equal(t, testReadRootFile(t, root, "/var/lib/extrausers/group"), "")
+}
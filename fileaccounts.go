@@ -0,0 +1,631 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FileAccounts - manages the accounts by editing the passwd, group, shadow and gshadow files directly,
+// for images without the shadow-utils commands. The files are locked like shadow-utils locks them.
+type FileAccounts struct {
+	// directory of the files: /etc, or /var/lib/extrausers to keep the accounts apart from the system's
+	Dir string
+}
+
+var _ AccountManager = FileAccounts{}
+
+// Directory of the passwd database of the system
+const systemAccountsDir = "/etc"
+
+// Directory of the passwd database libnss-extrausers reads
+const extraUsersDir = "/var/lib/extrausers"
+
+// Password of an account without one, which isn't locked either
+const noPassword = "*"
+
+// Tested
+// Check the accounts are kept apart from the system's, in files of their own
+func (a FileAccounts) extraUsers() bool {
+	return a.Dir != systemAccountsDir
+}
+
+// Tested
+// Lock, change and write back the passwd database of the accounts. A database apart from the system's starts out empty.
+func (a FileAccounts) update(change func(db *passwdDatabase) error) error {
+	return updatePasswdDatabase(rootPath(a.Dir), a.extraUsers(), change)
+}
+
+// Tested
+// Get the passwd database of the system the accounts must not clash with, an empty one when the accounts are the system's
+func (a FileAccounts) systemAccounts() (*passwdDatabase, error) {
+	if !a.extraUsers() {
+		empty := func() *accountFile { return &accountFile{lines: make([]string, 0), missing: true} }
+		return &passwdDatabase{group: empty(), gshadow: empty(), passwd: empty(), shadow: empty()}, nil
+	}
+	return readPasswdDatabase(rootPath(systemAccountsDir))
+}
+
+// Tested
+// Merge the ids used by the system into the ids used by the accounts
+func mergeIDs(used map[int]bool, system map[int]bool) map[int]bool {
+	for id := range system {
+		used[id] = true
+	}
+	return used
+}
+
+// Tested
+// GroupAdd - add the group with the next free gid of the GID_MIN-GID_MAX range of login.defs
+func (a FileAccounts) GroupAdd(groupName string) error {
+	fmt.Printf("Creating group: %v\n", groupName)
+	err := validatePosixName(groupName)
+	if err != nil {
+		return err
+	}
+	return a.update(func(db *passwdDatabase) error {
+		if db.group.entry(groupName) != nil {
+			return fmt.Errorf("Group '%s' already exists", groupName)
+		}
+		system, err := a.systemAccounts()
+		if err != nil {
+			return err
+		}
+		if system.group.entry(groupName) != nil {
+			return fmt.Errorf("Group '%s' already exists in %s", groupName, system.group.path)
+		}
+		defs, err := readLoginDefs(rootPath("/etc/login.defs"))
+		if err != nil {
+			return err
+		}
+		gidMin, gidMax, err := loginDefsRange(defs, "GID")
+		if err != nil {
+			return err
+		}
+		gid, err := allocateID(mergeIDs(usedIDs(db.group), usedIDs(system.group)), gidMin, gidMax)
+		if err != nil {
+			return err
+		}
+
+		db.group.set([]string{groupName, "x", strconv.Itoa(gid), ""})
+		db.gshadow.set([]string{groupName, "!", "", ""})
+		return nil
+	})
+}
+
+// Tested
+// GroupDelete - delete the group, refusing to delete the primary group of a user
+func (a FileAccounts) GroupDelete(groupName string) error {
+	fmt.Printf("Deleting group: %v\n", groupName)
+	return a.update(func(db *passwdDatabase) error {
+		group := db.group.entry(groupName)
+		if group == nil {
+			return fmt.Errorf("Group '%s' does not exist", groupName)
+		}
+		for _, fields := range db.passwd.entries() {
+			if len(fields) > 3 && len(group) > 2 && fields[3] == group[2] {
+				return fmt.Errorf("Cannot remove the primary group of user '%s'", fields[0])
+			}
+		}
+
+		db.group.remove(groupName)
+		db.gshadow.remove(groupName)
+		return nil
+	})
+}
+
+// Tested
+// UserAdd - add the user with the next free uid of the UID_MIN-UID_MAX range of login.defs and a group of its own,
+// add it to its groups and create its home directory from /etc/skel. When the home directory can't be created
+// the user is deleted again, so the next run creates it from scratch.
+func (a FileAccounts) UserAdd(user ArgoUser, groups []string) error {
+	fmt.Printf("Creating user: %v and adding to these groups: %v\n", user.ID, groups)
+	err := validatePosixName(user.ID)
+	if err != nil {
+		return err
+	}
+	err = validateShellLine(user.Shell)
+	if err != nil {
+		return err
+	}
+	homeDir := "/home/" + user.ID
+	err = checkHomeDirectory(homeDir)
+	if err != nil {
+		return err
+	}
+
+	var uid, gid int
+	var homeMode os.FileMode
+	err = a.update(func(db *passwdDatabase) error {
+		if db.passwd.entry(user.ID) != nil {
+			return fmt.Errorf("User '%s' already exists", user.ID)
+		}
+		if db.group.entry(user.ID) != nil {
+			return fmt.Errorf("Group '%s' already exists", user.ID)
+		}
+		system, err := a.systemAccounts()
+		if err != nil {
+			return err
+		}
+		if system.passwd.entry(user.ID) != nil {
+			return fmt.Errorf("User '%s' already exists in %s", user.ID, system.passwd.path)
+		}
+		if system.group.entry(user.ID) != nil {
+			return fmt.Errorf("Group '%s' already exists in %s", user.ID, system.group.path)
+		}
+		for _, group := range groups {
+			if db.group.entry(group) == nil {
+				return fmt.Errorf("Group '%s' does not exist", group)
+			}
+		}
+
+		defs, err := readLoginDefs(rootPath("/etc/login.defs"))
+		if err != nil {
+			return err
+		}
+		homeMode, err = loginDefsHomeMode(defs)
+		if err != nil {
+			return err
+		}
+		uidMin, uidMax, err := loginDefsRange(defs, "UID")
+		if err != nil {
+			return err
+		}
+		uid, err = allocateID(mergeIDs(usedIDs(db.passwd), usedIDs(system.passwd)), uidMin, uidMax)
+		if err != nil {
+			return err
+		}
+
+		// the group of the user gets the uid as its gid when it is free, like useradd does
+		gid = uid
+		usedGIDs := mergeIDs(usedIDs(db.group), usedIDs(system.group))
+		if usedGIDs[gid] {
+			gidMin, gidMax, err := loginDefsRange(defs, "GID")
+			if err != nil {
+				return err
+			}
+			gid, err = allocateID(usedGIDs, gidMin, gidMax)
+			if err != nil {
+				return err
+			}
+		}
+
+		db.group.set([]string{user.ID, "x", strconv.Itoa(gid), ""})
+		db.gshadow.set([]string{user.ID, "!", "", ""})
+		for _, group := range groups {
+			db.group.set(addMember(db.group.entry(group), 3, user.ID))
+			if fields := db.gshadow.entry(group); fields != nil {
+				db.gshadow.set(addMember(fields, 3, user.ID))
+			}
+		}
+
+		// users log in with their ssh keys and have no password. It is * rather than ! which only UserLock sets:
+		// sshd without PAM, like Alpine's, refuses key logins to an account with a locked password.
+		password := "x"
+		if db.shadow.missing && db.shadow.create == 0 {
+			password = noPassword
+		}
+		lastChange := strconv.FormatInt(time.Now().Unix()/86400, 10)
+		db.passwd.set([]string{user.ID, password, strconv.Itoa(uid), strconv.Itoa(gid), "", homeDir, user.Shell})
+		db.shadow.set([]string{user.ID, noPassword, lastChange, "0", "99999", "7", "", "", ""})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = createHomeDirectory(rootPath(homeDir), homeMode, uid, gid)
+	if err != nil {
+		// the user is removed again rather than left in the files without a leveldb record
+		if undoErr := a.UserDelete(user.ID, false); undoErr != nil {
+			return fmt.Errorf("%s, and removing user %s again failed: %s", err, user.ID, undoErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// Tested
+// UserDelete - delete the user, its group when no other user has it as primary group,
+// and with removeHome its home directory and its mail like userdel --remove
+func (a FileAccounts) UserDelete(userName string, removeHome bool) error {
+	fmt.Printf("Deleting user: %v\n", userName)
+	err := validatePosixName(userName)
+	if err != nil {
+		return err
+	}
+
+	homeDir := ""
+	err = a.update(func(db *passwdDatabase) error {
+		user := db.passwd.entry(userName)
+		if user == nil {
+			return fmt.Errorf("User '%s' does not exist", userName)
+		}
+		homeDir = fieldAt(user, 5)
+		// the user is kept rather than deleted with its home directory left behind
+		if removeHome && homeDir != "" {
+			err := checkHomeDirectory(homeDir)
+			if err != nil {
+				return err
+			}
+		}
+		db.passwd.remove(userName)
+		db.shadow.remove(userName)
+
+		for _, fields := range db.group.entries() {
+			if contains(splitMembers(fieldAt(fields, 3)), userName) {
+				db.group.set(removeMember(fields, 3, userName))
+			}
+		}
+		for _, fields := range db.gshadow.entries() {
+			if contains(splitMembers(fieldAt(fields, 2)), userName) || contains(splitMembers(fieldAt(fields, 3)), userName) {
+				db.gshadow.set(removeMember(removeMember(fields, 2, userName), 3, userName))
+			}
+		}
+
+		group := db.group.entry(userName)
+		if group == nil || len(user) < 4 || fieldAt(group, 2) != user[3] || fieldAt(group, 3) != "" {
+			return nil
+		}
+		for _, fields := range db.passwd.entries() {
+			if fieldAt(fields, 3) == user[3] {
+				return nil
+			}
+		}
+		db.group.remove(userName)
+		db.gshadow.remove(userName)
+		return nil
+	})
+	if err != nil || !removeHome {
+		return err
+	}
+
+	if homeDir != "" {
+		// a home directory replaced by a symlink is left alone rather than followed
+		if _, err := checkDirectory(rootPath(homeDir)); err == nil {
+			fmt.Printf("Deleting home directory: %s\n", rootPath(homeDir))
+			err = os.RemoveAll(rootPath(homeDir))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = os.Remove(rootPath("/var/mail/" + userName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Tested
+// UserLock - lock the password of the user, expire it and set its shell to nologin, like usermod --lock --expiredate 1
+func (a FileAccounts) UserLock(userName string) error {
+	fmt.Printf("Locking user: %v\n", userName)
+	return a.update(func(db *passwdDatabase) error {
+		user := db.passwd.entry(userName)
+		if user == nil {
+			return fmt.Errorf("User '%s' does not exist", userName)
+		}
+		for len(user) < 7 {
+			user = append(user, "")
+		}
+		user[6] = nologinShell()
+
+		// without a shadow file the password is in passwd
+		shadow := db.shadow.entry(userName)
+		if shadow == nil {
+			user[1] = lockPassword(user[1])
+		} else {
+			for len(shadow) < 9 {
+				shadow = append(shadow, "")
+			}
+			shadow[1] = lockPassword(shadow[1])
+			shadow[7] = "1"
+			db.shadow.set(shadow)
+		}
+		db.passwd.set(user)
+		return nil
+	})
+}
+
+// Tested
+// UserUnlock - unlock the password of the user, remove its expiry date and give it back its shell
+func (a FileAccounts) UserUnlock(user ArgoUser) error {
+	fmt.Printf("Unlocking user: %v\n", user.ID)
+	err := validateShellLine(user.Shell)
+	if err != nil {
+		return err
+	}
+	return a.update(func(db *passwdDatabase) error {
+		fields := db.passwd.entry(user.ID)
+		if fields == nil {
+			return fmt.Errorf("User '%s' does not exist", user.ID)
+		}
+		for len(fields) < 7 {
+			fields = append(fields, "")
+		}
+		fields[6] = user.Shell
+
+		// like usermod --unlock, one ! is removed and a password that would be left empty stays locked
+		shadow := db.shadow.entry(user.ID)
+		if shadow == nil {
+			fields[1] = unlockPassword(fields[1])
+		} else {
+			for len(shadow) < 9 {
+				shadow = append(shadow, "")
+			}
+			shadow[1] = unlockPassword(shadow[1])
+			shadow[7] = ""
+			db.shadow.set(shadow)
+		}
+		db.passwd.set(fields)
+		return nil
+	})
+}
+
+// Tested
+// Check a home directory is a directory under /home once cleaned, so creating or deleting it can't touch anything else
+func checkHomeDirectory(homeDir string) error {
+	cleaned := filepath.Clean(homeDir)
+	if !strings.HasPrefix(cleaned, "/home/") {
+		return fmt.Errorf("Refusing to use home directory %s: not under /home", homeDir)
+	}
+	return nil
+}
+
+// Tested
+// Replace the locked password ! a new user gets from adduser -D by *, so the user has no password but isn't locked
+func (a FileAccounts) setNoPassword(userName string) error {
+	return a.update(func(db *passwdDatabase) error {
+		user := db.passwd.entry(userName)
+		if user == nil {
+			return fmt.Errorf("User '%s' does not exist", userName)
+		}
+
+		// without a shadow file the password is in passwd
+		shadow := db.shadow.entry(userName)
+		if shadow == nil {
+			if fieldAt(user, 1) == "!" {
+				user[1] = noPassword
+				db.passwd.set(user)
+			}
+		} else if fieldAt(shadow, 1) == "!" {
+			shadow[1] = noPassword
+			db.shadow.set(shadow)
+		}
+		return nil
+	})
+}
+
+// Tested
+// Put a ! in front of a password to lock it, like usermod --lock leaving a locked password as it is so locking twice is harmless
+func lockPassword(password string) string {
+	if strings.HasPrefix(password, "!") {
+		return password
+	}
+	return "!" + password
+}
+
+// Tested
+// Remove the ! a lock put in front of a password, leaving a password that would become empty locked
+func unlockPassword(password string) string {
+	if len(password) > 1 && password[0] == '!' {
+		return password[1:]
+	}
+	return password
+}
+
+// Tested
+// UserExists - check the user is in the passwd file
+func (a FileAccounts) UserExists(userName string) (bool, error) {
+	db, err := readPasswdDatabase(rootPath(a.Dir))
+	if err != nil {
+		return false, err
+	}
+	return db.passwd.entry(userName) != nil, nil
+}
+
+// Tested
+// AddGroupToUser - add the user to the members of a group
+func (a FileAccounts) AddGroupToUser(user string, group string) error {
+	fmt.Printf("Adding group: %s to user: %s\n", group, user)
+	return a.update(func(db *passwdDatabase) error {
+		if db.passwd.entry(user) == nil {
+			return fmt.Errorf("User '%s' does not exist", user)
+		}
+		fields := db.group.entry(group)
+		if fields == nil {
+			return fmt.Errorf("Group '%s' does not exist", group)
+		}
+
+		db.group.set(addMember(fields, 3, user))
+		if fields := db.gshadow.entry(group); fields != nil {
+			db.gshadow.set(addMember(fields, 3, user))
+		}
+		return nil
+	})
+}
+
+// Tested
+// RemoveGroupFromUser - remove the user from the members of a group
+func (a FileAccounts) RemoveGroupFromUser(user string, group string) error {
+	fmt.Printf("Deleting group: %s from user: %s\n", group, user)
+	return a.update(func(db *passwdDatabase) error {
+		fields := db.group.entry(group)
+		if fields == nil {
+			return fmt.Errorf("Group '%s' does not exist", group)
+		}
+		if !contains(splitMembers(fieldAt(fields, 3)), user) {
+			return fmt.Errorf("User '%s' is not a member of '%s'", user, group)
+		}
+
+		db.group.set(removeMember(fields, 3, user))
+		if fields := db.gshadow.entry(group); fields != nil {
+			db.gshadow.set(removeMember(fields, 3, user))
+		}
+		return nil
+	})
+}
+
+// Tested
+// UserIDs - look up the uid of the user and the gid of its group in the passwd and group files
+func (a FileAccounts) UserIDs(userName string) (int, int, error) {
+	db, err := readPasswdDatabase(rootPath(a.Dir))
+	if err != nil {
+		return -1, -1, err
+	}
+	user := db.passwd.entry(userName)
+	if user == nil {
+		return -1, -1, fmt.Errorf("User '%s' does not exist", userName)
+	}
+	group := db.group.entry(userName)
+	if group == nil {
+		return -1, -1, fmt.Errorf("Group '%s' does not exist", userName)
+	}
+
+	uid, err := strconv.Atoi(fieldAt(user, 2))
+	if err != nil {
+		return -1, -1, fmt.Errorf("Invalid uid %q of %s", fieldAt(user, 2), userName)
+	}
+	gid, err := strconv.Atoi(fieldAt(group, 2))
+	if err != nil {
+		return -1, -1, fmt.Errorf("Invalid gid %q of %s", fieldAt(group, 2), userName)
+	}
+	return uid, gid, nil
+}
+
+// Tested
+// Get a field of an entry, empty when the entry is too short to have it
+func fieldAt(fields []string, index int) string {
+	if index >= len(fields) {
+		return ""
+	}
+	return fields[index]
+}
+
+// Tested
+// Get the mode of new home directories from login.defs: HOME_MODE, or the permissions UMASK leaves
+func loginDefsHomeMode(defs map[string]string) (os.FileMode, error) {
+	name, value := "HOME_MODE", defs["HOME_MODE"]
+	umask := false
+	if value == "" {
+		name, value, umask = "UMASK", defs["UMASK"], true
+	}
+	if value == "" {
+		value = "022"
+	}
+
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("Invalid %s %q in login.defs", name, value)
+	}
+	if umask {
+		return os.FileMode(0777 &^ mode), nil
+	}
+	return os.FileMode(mode), nil
+}
+
+// Tested
+// Create the home directory of a new user with a copy of /etc/skel, all owned by the user.
+// A home directory that already exists is left as it is, like useradd leaves it.
+func createHomeDirectory(homeDir string, mode os.FileMode, uid int, gid int) error {
+	_, err := os.Lstat(homeDir)
+	if err == nil {
+		fmt.Printf("Home directory %s already exists, not copying /etc/skel into it\n", homeDir)
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	fmt.Printf("Creating directory: %s\n", homeDir)
+	err = os.MkdirAll(filepath.Dir(homeDir), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.Mkdir(homeDir, mode)
+	if err != nil {
+		return err
+	}
+	err = populateHomeDirectory(homeDir, mode, uid, gid)
+	if err != nil {
+		// the home directory was created here, a partial one isn't left behind
+		os.RemoveAll(homeDir)
+		return err
+	}
+	return nil
+}
+
+// Tested
+// Set the mode and owner of a new home directory and copy /etc/skel into it
+func populateHomeDirectory(homeDir string, mode os.FileMode, uid int, gid int) error {
+	// Mkdir is subject to the umask of the process
+	err := os.Chmod(homeDir, mode)
+	if err != nil {
+		return err
+	}
+	err = os.Lchown(homeDir, uid, gid)
+	if err != nil {
+		return err
+	}
+
+	skelDir := rootPath("/etc/skel")
+	if _, err := checkDirectory(skelDir); err != nil {
+		return nil
+	}
+	return filepath.Walk(skelDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || path == skelDir {
+			return err
+		}
+		rel, err := filepath.Rel(skelDir, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(homeDir, rel)
+
+		switch {
+		case fi.IsDir():
+			err = os.Mkdir(target, fi.Mode().Perm())
+		case fi.Mode()&os.ModeSymlink != 0:
+			var link string
+			link, err = os.Readlink(path)
+			if err == nil {
+				err = os.Symlink(link, target)
+			}
+		case fi.Mode().IsRegular():
+			err = copyFile(path, target, fi.Mode().Perm())
+		default:
+			// devices, sockets and fifos aren't copied
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return os.Lchown(target, uid, gid)
+	})
+}
+
+// Tested
+// Copy a regular file to a new file with the given mode
+func copyFile(source string, target string, mode os.FileMode) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// an alternate root with shadow files and a skel directory for the files backend
+func testFileAccountsRoot(t *testing.T) (string, func()) {
+	root, cleanup := testRootDirectory(t)
+	assert.Nil(t, ioutil.WriteFile(root+"/etc/shadow", []byte("root:*:17000:0:99999:7:::\nbob:!:17000:0:99999:7:::\n"), 0640))
+	assert.Nil(t, ioutil.WriteFile(root+"/etc/gshadow", []byte("root:*::\nbob:!::\nadmins:!::bob\n"), 0640))
+	assert.Nil(t, os.MkdirAll(root+"/etc/skel/.config", 0755))
+	assert.Nil(t, ioutil.WriteFile(root+"/etc/skel/.bashrc", []byte("# bashrc\n"), 0644))
+	assert.Nil(t, os.Symlink(".bashrc", root+"/etc/skel/.profile"))
+	return root, cleanup
+}
+
+// read a file of the alternate root
+func testReadRootFile(t *testing.T, root string, path string) string {
+	data, err := ioutil.ReadFile(root + path)
+	assert.Nil(t, err)
+	return string(data)
+}
+
+// FileAccounts.GroupAdd, FileAccounts.GroupDelete
+func TestFileAccountsGroups(t *testing.T) {
+	root, cleanup := testFileAccountsRoot(t)
+	defer cleanup()
+
+	accounts := FileAccounts{Dir: systemAccountsDir}
+	assert.Nil(t, accounts.GroupAdd("devs"))
+	assert.Equal(t, testReadRootFile(t, root, "/etc/group"), "root:x:0:\nbob:x:1001:\nadmins:x:1002:bob\ndevs:x:1003:\n")
+	assert.Equal(t, testReadRootFile(t, root, "/etc/gshadow"), "root:*::\nbob:!::\nadmins:!::bob\ndevs:!::\n")
+	assert.Equal(t, accounts.GroupAdd("devs").Error(), "Group 'devs' already exists")
+
+	assert.Nil(t, accounts.GroupDelete("devs"))
+	assert.Equal(t, testReadRootFile(t, root, "/etc/group"), "root:x:0:\nbob:x:1001:\nadmins:x:1002:bob\n")
+	assert.Equal(t, testReadRootFile(t, root, "/etc/gshadow"), "root:*::\nbob:!::\nadmins:!::bob\n")
+	assert.Equal(t, accounts.GroupDelete("devs").Error(), "Group 'devs' does not exist")
+	assert.Equal(t, accounts.GroupDelete("bob").Error(), "Cannot remove the primary group of user 'bob'")
+}
+
+// FileAccounts.UserAdd
+func TestFileAccountsUserAdd(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Creating a home directory owned by another user needs root")
+	}
+	root, cleanup := testFileAccountsRoot(t)
+	defer cleanup()
+
+	accounts := FileAccounts{Dir: systemAccountsDir}
+	user := ArgoUser{ID: "alice", Shell: "/bin/sh"}
+	assert.Equal(t, accounts.UserAdd(user, []string{"devs"}).Error(), "Group 'devs' does not exist")
+	assert.Equal(t, accounts.UserAdd(ArgoUser{ID: "bob", Shell: "/bin/sh"}, nil).Error(), "User 'bob' already exists")
+
+	// uid 1002 is free but gid 1002 is taken by admins, so the group of alice gets the next free gid
+	assert.Nil(t, accounts.UserAdd(user, []string{"admins"}))
+	assert.Contains(t, testReadRootFile(t, root, "/etc/passwd"), "\nalice:x:1002:1003::/home/alice:/bin/sh\n")
+	assert.Contains(t, testReadRootFile(t, root, "/etc/group"), "admins:x:1002:bob,alice\nalice:x:1003:\n")
+	assert.Contains(t, testReadRootFile(t, root, "/etc/gshadow"), "admins:!::bob,alice\nalice:!::\n")
+	assert.Contains(t, testReadRootFile(t, root, "/etc/shadow"), "\nalice:*:")
+
+	uid, gid, err := accounts.UserIDs("alice")
+	assert.Nil(t, err)
+	assert.Equal(t, uid, 1002)
+	assert.Equal(t, gid, 1003)
+
+	exists, err := accounts.UserExists("alice")
+	assert.Nil(t, err)
+	assert.True(t, exists)
+
+	// the home directory is a copy of /etc/skel owned by the user
+	fi, err := os.Stat(root + "/home/alice")
+	assert.Nil(t, err)
+	assert.Equal(t, fi.Mode().Perm(), os.FileMode(0755))
+	owner, group, ok := fileOwner(fi)
+	if ok {
+		assert.Equal(t, owner, 1002)
+		assert.Equal(t, group, 1003)
+	}
+	assert.Equal(t, testReadRootFile(t, root, "/home/alice/.bashrc"), "# bashrc\n")
+	link, err := os.Readlink(root + "/home/alice/.profile")
+	assert.Nil(t, err)
+	assert.Equal(t, link, ".bashrc")
+	_, err = checkDirectory(root + "/home/alice/.config")
+	assert.Nil(t, err)
+}
+
+func TestFileAccountsUserAddHomeFails(t *testing.T) {
+	root, cleanup := testFileAccountsRoot(t)
+	defer cleanup()
+	assert.Nil(t, ioutil.WriteFile(root+"/home", []byte("not a directory\n"), 0644))
+
+	// a user whose home directory can't be created is deleted again
+	accounts := FileAccounts{Dir: systemAccountsDir}
+	err := accounts.UserAdd(ArgoUser{ID: "alice", Shell: "/bin/sh"}, []string{"admins"})
+	assert.NotNil(t, err)
+	assert.Equal(t, testReadRootFile(t, root, "/etc/passwd"), "root:x:0:0:root:/root:/bin/bash\nbob:x:1001:1001::/home/bob:/bin/bash\n")
+	assert.Equal(t, testReadRootFile(t, root, "/etc/shadow"), "root:*:17000:0:99999:7:::\nbob:!:17000:0:99999:7:::\n")
+	assert.Equal(t, testReadRootFile(t, root, "/etc/group"), "root:x:0:\nbob:x:1001:\nadmins:x:1002:bob\n")
+	assert.Equal(t, testReadRootFile(t, root, "/etc/gshadow"), "root:*::\nbob:!::\nadmins:!::bob\n")
+}
+
+// FileAccounts.AddGroupToUser, FileAccounts.RemoveGroupFromUser
+func TestFileAccountsMembers(t *testing.T) {
+	root, cleanup := testFileAccountsRoot(t)
+	defer cleanup()
+
+	accounts := FileAccounts{Dir: systemAccountsDir}
+	assert.Nil(t, accounts.GroupAdd("devs"))
+	assert.Nil(t, accounts.AddGroupToUser("bob", "devs"))
+	assert.Contains(t, testReadRootFile(t, root, "/etc/group"), "devs:x:1003:bob\n")
+	assert.Contains(t, testReadRootFile(t, root, "/etc/gshadow"), "devs:!::bob\n")
+	assert.Equal(t, accounts.AddGroupToUser("alice", "devs").Error(), "User 'alice' does not exist")
+	assert.Equal(t, accounts.AddGroupToUser("bob", "ops").Error(), "Group 'ops' does not exist")
+
+	assert.Nil(t, accounts.RemoveGroupFromUser("bob", "devs"))
+	assert.Contains(t, testReadRootFile(t, root, "/etc/group"), "devs:x:1003:\n")
+	assert.Contains(t, testReadRootFile(t, root, "/etc/gshadow"), "devs:!::\n")
+	assert.Equal(t, accounts.RemoveGroupFromUser("bob", "devs").Error(), "User 'bob' is not a member of 'devs'")
+}
+
+// FileAccounts.UserDelete
+func TestFileAccountsUserDelete(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Creating a home directory owned by another user needs root")
+	}
+	root, cleanup := testFileAccountsRoot(t)
+	defer cleanup()
+
+	accounts := FileAccounts{Dir: systemAccountsDir}
+	assert.Nil(t, accounts.UserAdd(ArgoUser{ID: "alice", Shell: "/bin/sh"}, []string{"admins"}))
+	assert.Nil(t, os.MkdirAll(root+"/var/mail", 0755))
+	assert.Nil(t, ioutil.WriteFile(root+"/var/mail/alice", []byte("mail\n"), 0600))
+
+	// keeping the home directory keeps the mail too, like userdel without --remove
+	assert.Nil(t, accounts.UserAdd(ArgoUser{ID: "carol", Shell: "/bin/sh"}, nil))
+	assert.Nil(t, ioutil.WriteFile(root+"/var/mail/carol", []byte("mail\n"), 0600))
+	assert.Nil(t, accounts.UserDelete("carol", false))
+	_, err := checkDirectory(root + "/home/carol")
+	assert.Nil(t, err)
+	_, err = os.Stat(root + "/var/mail/carol")
+	assert.Nil(t, err)
+
+	assert.Nil(t, accounts.UserDelete("alice", true))
+	assert.Equal(t, testReadRootFile(t, root, "/etc/passwd"), "root:x:0:0:root:/root:/bin/bash\nbob:x:1001:1001::/home/bob:/bin/bash\n")
+	assert.Equal(t, testReadRootFile(t, root, "/etc/shadow"), "root:*:17000:0:99999:7:::\nbob:!:17000:0:99999:7:::\n")
+	assert.Equal(t, testReadRootFile(t, root, "/etc/group"), "root:x:0:\nbob:x:1001:\nadmins:x:1002:bob\n")
+	assert.Equal(t, testReadRootFile(t, root, "/etc/gshadow"), "root:*::\nbob:!::\nadmins:!::bob\n")
+	_, err = os.Stat(root + "/home/alice")
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(root + "/var/mail/alice")
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Equal(t, accounts.UserDelete("alice", true).Error(), "User 'alice' does not exist")
+	exists, err := accounts.UserExists("alice")
+	assert.Nil(t, err)
+	assert.False(t, exists)
+}
+
+// FileAccounts.GroupAdd, FileAccounts.UserAdd, FileAccounts.UserDelete, FileAccounts.UserUnlock
+func TestFileAccountsInvalidNames(t *testing.T) {
+	root, cleanup := testFileAccountsRoot(t)
+	defer cleanup()
+	passwd := "root:x:0:0:root:/root:/bin/bash\nbob:x:1001:1001::/home/bob:/bin/bash\neve:x:1005:1001::/home/..:/bin/sh\n"
+	assert.Nil(t, ioutil.WriteFile(root+"/etc/passwd", []byte(passwd), 0644))
+
+	// nothing is written for a name or a shell that can't go into the files
+	accounts := FileAccounts{Dir: systemAccountsDir}
+	assert.Equal(t, accounts.GroupAdd("../devs").Error(), "Id \"../devs\" is not a valid user or group name")
+	assert.Equal(t, accounts.UserAdd(ArgoUser{ID: "..", Shell: "/bin/sh"}, nil).Error(), "Id \"..\" is not a valid user or group name")
+	assert.Equal(t, accounts.UserAdd(ArgoUser{ID: "alice", Shell: "/bin/sh\nroot2::0:0::/root:/bin/sh"}, nil).Error(),
+		"Shell \"/bin/sh\\nroot2::0:0::/root:/bin/sh\" contains ':' or a newline")
+	assert.Equal(t, accounts.UserUnlock(ArgoUser{ID: "bob", Shell: "/bin/sh:x"}).Error(), "Shell \"/bin/sh:x\" contains ':' or a newline")
+	assert.Equal(t, accounts.UserDelete("..", true).Error(), "Id \"..\" is not a valid user or group name")
+
+	// a home directory outside of /home is never removed, and the user is kept
+	assert.Equal(t, accounts.UserDelete("eve", true).Error(), "Refusing to use home directory /home/..: not under /home")
+	assert.Equal(t, testReadRootFile(t, root, "/etc/passwd"), passwd)
+	assert.Equal(t, testReadRootFile(t, root, "/etc/group"), "root:x:0:\nbob:x:1001:\nadmins:x:1002:bob\n")
+}
+
+// checkHomeDirectory
+func TestCheckHomeDirectory(t *testing.T) {
+	assert.Nil(t, checkHomeDirectory("/home/alice"))
+	assert.Nil(t, checkHomeDirectory("/home/alice/../bob"))
+	assert.Equal(t, checkHomeDirectory("/home/..").Error(), "Refusing to use home directory /home/..: not under /home")
+	assert.Equal(t, checkHomeDirectory("/home/").Error(), "Refusing to use home directory /home/: not under /home")
+	assert.Equal(t, checkHomeDirectory("/home/alice/../../etc").Error(), "Refusing to use home directory /home/alice/../../etc: not under /home")
+	assert.Equal(t, checkHomeDirectory("home/alice").Error(), "Refusing to use home directory home/alice: not under /home")
+}
+
+// FileAccounts.UserLock, FileAccounts.UserUnlock, lockPassword, unlockPassword
+func TestFileAccountsLock(t *testing.T) {
+	root, cleanup := testFileAccountsRoot(t)
+	defer cleanup()
+
+	accounts := FileAccounts{Dir: systemAccountsDir}
+	assert.Nil(t, accounts.UserLock("bob"))
+	assert.Contains(t, testReadRootFile(t, root, "/etc/passwd"), "\nbob:x:1001:1001::/home/bob:/bin/false\n")
+	assert.Contains(t, testReadRootFile(t, root, "/etc/shadow"), "\nbob:!:17000:0:99999:7::1:\n")
+	assert.Equal(t, accounts.UserLock("alice").Error(), "User 'alice' does not exist")
+
+	assert.Nil(t, accounts.UserUnlock(ArgoUser{ID: "bob", Shell: "/bin/zsh"}))
+	assert.Contains(t, testReadRootFile(t, root, "/etc/passwd"), "\nbob:x:1001:1001::/home/bob:/bin/zsh\n")
+	assert.Contains(t, testReadRootFile(t, root, "/etc/shadow"), "\nbob:!:17000:0:99999:7:::\n")
+
+	// without a shadow file the password in passwd is locked
+	assert.Nil(t, os.Remove(root+"/etc/shadow"))
+	assert.Nil(t, accounts.UserLock("bob"))
+	assert.Contains(t, testReadRootFile(t, root, "/etc/passwd"), "\nbob:!x:1001:1001::/home/bob:/bin/false\n")
+	assert.Nil(t, accounts.UserUnlock(ArgoUser{ID: "bob", Shell: "/bin/bash"}))
+	assert.Contains(t, testReadRootFile(t, root, "/etc/passwd"), "\nbob:x:1001:1001::/home/bob:/bin/bash\n")
+
+	assert.Equal(t, lockPassword("$6$salt$hash"), "!$6$salt$hash")
+	assert.Equal(t, lockPassword("!$6$salt$hash"), "!$6$salt$hash")
+	assert.Equal(t, unlockPassword("!$6$salt$hash"), "$6$salt$hash")
+	assert.Equal(t, unlockPassword("!"), "!")
+	assert.Equal(t, unlockPassword("*"), "*")
+	assert.Equal(t, unlockPassword(lockPassword(noPassword)), noPassword)
+}
+
+// FileAccounts.setNoPassword
+func TestFileAccountsSetNoPassword(t *testing.T) {
+	root, cleanup := testFileAccountsRoot(t)
+	defer cleanup()
+
+	accounts := FileAccounts{Dir: systemAccountsDir}
+	assert.Nil(t, accounts.setNoPassword("bob"))
+	assert.Contains(t, testReadRootFile(t, root, "/etc/shadow"), "\nbob:*:17000:0:99999:7:::\n")
+	assert.Equal(t, accounts.setNoPassword("alice").Error(), "User 'alice' does not exist")
+
+	// a password that was set is kept
+	assert.Nil(t, ioutil.WriteFile(root+"/etc/shadow", []byte("bob:$6$salt$hash:17000:0:99999:7:::\n"), 0640))
+	assert.Nil(t, accounts.setNoPassword("bob"))
+	assert.Equal(t, testReadRootFile(t, root, "/etc/shadow"), "bob:$6$salt$hash:17000:0:99999:7:::\n")
+
+	// without a shadow file the password is in passwd
+	assert.Nil(t, os.Remove(root+"/etc/shadow"))
+	assert.Nil(t, ioutil.WriteFile(root+"/etc/passwd", []byte("bob:!:1001:1001::/home/bob:/bin/ash\n"), 0644))
+	assert.Nil(t, accounts.setNoPassword("bob"))
+	assert.Equal(t, testReadRootFile(t, root, "/etc/passwd"), "bob:*:1001:1001::/home/bob:/bin/ash\n")
+}
+
+// fieldAt
+func TestFieldAt(t *testing.T) {
+	assert.Equal(t, fieldAt([]string{"bob", "x", "1001"}, 2), "1001")
+	assert.Equal(t, fieldAt([]string{"bob", "x", "1001"}, 3), "")
+}
+
+// loginDefsHomeMode
+func TestLoginDefsHomeMode(t *testing.T) {
+	mode, err := loginDefsHomeMode(map[string]string{})
+	assert.Nil(t, err)
+	assert.Equal(t, mode, os.FileMode(0755))
+
+	mode, err = loginDefsHomeMode(map[string]string{"UMASK": "077"})
+	assert.Nil(t, err)
+	assert.Equal(t, mode, os.FileMode(0700))
+
+	mode, err = loginDefsHomeMode(map[string]string{"UMASK": "022", "HOME_MODE": "0750"})
+	assert.Nil(t, err)
+	assert.Equal(t, mode, os.FileMode(0750))
+
+	_, err = loginDefsHomeMode(map[string]string{"HOME_MODE": "999"})
+	assert.Equal(t, err.Error(), `Invalid HOME_MODE "999" in login.defs`)
+}
+
+// createHomeDirectory, copyFile
+func TestCreateHomeDirectoryExists(t *testing.T) {
+	root, cleanup := testFileAccountsRoot(t)
+	defer cleanup()
+
+	// an existing home directory is left as it is
+	assert.Nil(t, os.MkdirAll(root+"/home/bob", 0700))
+	assert.Nil(t, createHomeDirectory(root+"/home/bob", 0755, os.Getuid(), os.Getgid()))
+	_, err := os.Stat(root + "/home/bob/.bashrc")
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Nil(t, copyFile(root+"/etc/skel/.bashrc", root+"/home/bob/.bashrc", 0600))
+	assert.NotNil(t, copyFile(root+"/etc/skel/.bashrc", root+"/home/bob/.bashrc", 0600))
+}
+
+func TestCreateHomeDirectoryFails(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("Root can give the home directory to another user")
+	}
+	root, cleanup := testFileAccountsRoot(t)
+	defer cleanup()
+
+	// a home directory that can't be given to the user isn't left behind
+	err := createHomeDirectory(root+"/home/alice", 0755, os.Getuid()+1, os.Getgid())
+	assert.NotNil(t, err)
+	_, err = os.Lstat(root + "/home/alice")
+	assert.True(t, os.IsNotExist(err))
+}
+
+// newAccountManager
+func TestNewAccountManager(t *testing.T) {
+	accounts, err := newAccountManager("files")
+	assert.Nil(t, err)
+	assert.Equal(t, accounts, FileAccounts{Dir: "/etc"})
+
+	accounts, err = newAccountManager("extrausers")
+	assert.Nil(t, err)
+	assert.Equal(t, accounts, FileAccounts{Dir: "/var/lib/extrausers"})
+
+	accounts, err = newAccountManager("shadow")
+	assert.Nil(t, err)
+	assert.Equal(t, accounts, ShadowAccounts{})
+
+	_, err = newAccountManager("ldap")
+	assert.Equal(t, err.Error(), `Unknown accounts backend "ldap", expected auto, shadow, busybox, files or extrausers`)
+}
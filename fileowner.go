@@ -0,0 +1,29 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Tested
+// Get the owner of a file. The bool is false when the platform doesn't have unix owners.
+func fileOwner(fi os.FileInfo) (int, int, bool) {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(stat.Uid), int(stat.Gid), true
+}
+
+// Tested
+// Get the number of hard links of a file. The bool is false when the platform doesn't say.
+func fileLinks(fi os.FileInfo) (int, bool) {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return int(stat.Nlink), true
+}
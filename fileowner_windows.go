@@ -0,0 +1,15 @@
+package main
+
+import "os"
+
+// Not testable
+// Windows files don't have unix owners
+func fileOwner(fi os.FileInfo) (int, int, bool) {
+	return 0, 0, false
+}
+
+// Not testable
+// Windows hard links aren't counted here
+func fileLinks(fi os.FileInfo) (int, bool) {
+	return 0, false
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// Tested
+// Check the file is a user or group file in one of the supported formats
+func isDefinitionFile(fileName string) bool {
+	switch filepath.Ext(fileName) {
+	case ".json", ".yaml", ".yml", ".toml":
+		return true
+	}
+	return false
+}
+
+// Tested
+// Unmarshal a user or group file by its extension, rejecting unknown fields in every format
+func unmarshalDefinition(fileName string, data []byte, v interface{}) error {
+	switch filepath.Ext(fileName) {
+	case ".json":
+		return unmarshalStrict(data, v)
+	case ".yaml", ".yml":
+		return yaml.UnmarshalStrict(data, v)
+	case ".toml":
+		md, err := toml.Decode(string(data), v)
+		if err != nil {
+			return err
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			keys := make([]string, 0)
+			for _, key := range undecoded {
+				// toml leaves the fields of ssh key objects undecoded, the ssh keys check their fields themselves
+				if len(key) > 1 && key[0] == "ssh_keys" {
+					continue
+				}
+				keys = append(keys, key.String())
+			}
+			if len(keys) > 0 {
+				return errors.New("Unknown fields: " + strings.Join(keys, ", "))
+			}
+		}
+		return nil
+	}
+	return errors.New("Unsupported file format: " + fileName)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// isDefinitionFile
+func TestIsDefinitionFile(t *testing.T) {
+	assert.Equal(t, isDefinitionFile("bob.json"), true)
+	assert.Equal(t, isDefinitionFile("bob.yaml"), true)
+	assert.Equal(t, isDefinitionFile("bob.yml"), true)
+	assert.Equal(t, isDefinitionFile("bob.toml"), true)
+	assert.Equal(t, isDefinitionFile("bob.json.bak"), false)
+	assert.Equal(t, isDefinitionFile("README.md"), false)
+}
+
+// unmarshalDefinition
+func TestUnmarshalDefinitionYAML(t *testing.T) {
+	var user ArgoUser
+	data := "id: bob\nshell: /bin/bash\nssh_keys:\n  - ssh-ed25519 AAAA bob@laptop\n"
+	err := unmarshalDefinition("bob.yaml", []byte(data), &user)
+	assert.Nil(t, err)
+	assert.Equal(t, user, ArgoUser{SSHkeys: []SSHKey{{Key: "ssh-ed25519 AAAA bob@laptop"}}, ID: "bob", Shell: "/bin/bash"})
+}
+
+func TestUnmarshalDefinitionYAMLUnknownField(t *testing.T) {
+	var user ArgoUser
+	err := unmarshalDefinition("bob.yml", []byte("id: bob\nsshkeys: []\n"), &user)
+	assert.Equal(t, err.Error(), "yaml: unmarshal errors:\n  line 2: field sshkeys not found in type main.ArgoUser")
+}
+
+func TestUnmarshalDefinitionTOML(t *testing.T) {
+	var group ArgoGroup
+	data := "id = \"devs\"\nusers = [\"bob\", \"alice\"]\nadmins = []\n"
+	err := unmarshalDefinition("devs.toml", []byte(data), &group)
+	assert.Nil(t, err)
+	assert.Equal(t, group, ArgoGroup{"devs", []string{"bob", "alice"}, []string{}})
+}
+
+func TestUnmarshalDefinitionTOMLUnknownField(t *testing.T) {
+	var group ArgoGroup
+	err := unmarshalDefinition("devs.toml", []byte("id = \"devs\"\nmembers = [\"bob\"]\n"), &group)
+	assert.Equal(t, err.Error(), "Unknown fields: members")
+}
+
+func TestUnmarshalDefinitionUnsupported(t *testing.T) {
+	var group ArgoGroup
+	err := unmarshalDefinition("devs.xml", []byte("<group/>"), &group)
+	assert.Equal(t, err.Error(), "Unsupported file format: devs.xml")
+}
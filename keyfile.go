@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// How the authorized_keys files are written
+const (
+	// the whole file is argo-lyte's
+	keyFileOverwrite = "overwrite"
+	// only the lines between the markers are argo-lyte's, the rest of the file is kept
+	keyFileBlock = "block"
+)
+
+// Markers of the block argo-lyte manages in block mode
+const (
+	keyBlockBegin = "# BEGIN argo-lyte managed keys"
+	keyBlockEnd   = "# END argo-lyte managed keys"
+)
+
+// Tested
+// Check the authorized_keys file mode of the command line
+func checkKeyFileMode(mode string) error {
+	if mode != keyFileOverwrite && mode != keyFileBlock {
+		return fmt.Errorf("Invalid key file mode %q, use overwrite or block", mode)
+	}
+	return nil
+}
+
+// Tested
+// Render the contents of an authorized_keys file. In overwrite mode existing is ignored. In block mode
+// only the managed block of existing is replaced, and the block is appended when existing has none.
+func renderAuthorizedKeys(existing string, sshKeys []string, mode string) (string, error) {
+	if mode != keyFileBlock {
+		fileText := "# Generated by argo-lyte\n"
+		fileText += "# Local modifications will be overwritten.\n\n"
+		for _, sshKey := range sshKeys {
+			fileText += sshKey + "\n"
+		}
+		return fileText, nil
+	}
+
+	block := keyBlockBegin + "\n"
+	block += "# Lines between these markers are overwritten, add local keys outside of them.\n"
+	for _, sshKey := range sshKeys {
+		block += sshKey + "\n"
+	}
+	block += keyBlockEnd + "\n"
+
+	lines := strings.SplitAfter(existing, "\n")
+	begin, end := -1, -1
+	for i, line := range lines {
+		switch strings.TrimSpace(line) {
+		case keyBlockBegin:
+			if begin != -1 {
+				return "", fmt.Errorf("More than one %q marker", keyBlockBegin)
+			}
+			begin = i
+		case keyBlockEnd:
+			if begin == -1 || end != -1 {
+				return "", fmt.Errorf("Unexpected %q marker", keyBlockEnd)
+			}
+			end = i
+		}
+	}
+
+	// a block that isn't closed can't be told apart from local keys, so leave the file alone
+	if begin != -1 && end == -1 {
+		return "", fmt.Errorf("Missing %q marker", keyBlockEnd)
+	}
+
+	if begin == -1 {
+		if existing != "" && !strings.HasSuffix(existing, "\n") {
+			existing += "\n"
+		}
+		return existing + block, nil
+	}
+	return strings.Join(lines[:begin], "") + block + strings.Join(lines[end+1:], ""), nil
+}
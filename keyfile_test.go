@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// checkKeyFileMode
+func TestCheckKeyFileMode(t *testing.T) {
+	assert.Nil(t, checkKeyFileMode("overwrite"))
+	assert.Nil(t, checkKeyFileMode("block"))
+	assert.Equal(t, checkKeyFileMode("merge").Error(), `Invalid key file mode "merge", use overwrite or block`)
+}
+
+// renderAuthorizedKeys
+func TestRenderAuthorizedKeysOverwrite(t *testing.T) {
+	fileText, err := renderAuthorizedKeys("ssh-ed25519 LOCAL backup\n", []string{"ssh-ed25519 AAAA bob@laptop"}, keyFileOverwrite)
+	assert.Nil(t, err)
+	assert.Equal(t, fileText, "# Generated by argo-lyte\n# Local modifications will be overwritten.\n\nssh-ed25519 AAAA bob@laptop\n")
+}
+
+func TestRenderAuthorizedKeysBlockNew(t *testing.T) {
+	block := keyBlockBegin + "\n" +
+		"# Lines between these markers are overwritten, add local keys outside of them.\n" +
+		"ssh-ed25519 AAAA bob@laptop\n" +
+		keyBlockEnd + "\n"
+
+	fileText, err := renderAuthorizedKeys("", []string{"ssh-ed25519 AAAA bob@laptop"}, keyFileBlock)
+	assert.Nil(t, err)
+	assert.Equal(t, fileText, block)
+
+	// keys already in the file stay in front of the new block
+	fileText, err = renderAuthorizedKeys("ssh-ed25519 LOCAL backup", []string{"ssh-ed25519 AAAA bob@laptop"}, keyFileBlock)
+	assert.Nil(t, err)
+	assert.Equal(t, fileText, "ssh-ed25519 LOCAL backup\n"+block)
+}
+
+func TestRenderAuthorizedKeysBlockReplace(t *testing.T) {
+	existing := "ssh-ed25519 LOCAL backup\n" +
+		keyBlockBegin + "\n" +
+		"ssh-ed25519 OLD bob@laptop\n" +
+		keyBlockEnd + "\n" +
+		"ssh-ed25519 LOCAL monitoring\n"
+
+	fileText, err := renderAuthorizedKeys(existing, []string{"ssh-ed25519 NEW bob@laptop"}, keyFileBlock)
+	assert.Nil(t, err)
+	assert.Equal(t, fileText, "ssh-ed25519 LOCAL backup\n"+
+		keyBlockBegin+"\n"+
+		"# Lines between these markers are overwritten, add local keys outside of them.\n"+
+		"ssh-ed25519 NEW bob@laptop\n"+
+		keyBlockEnd+"\n"+
+		"ssh-ed25519 LOCAL monitoring\n")
+
+	// rendering again gives the same file
+	again, err := renderAuthorizedKeys(fileText, []string{"ssh-ed25519 NEW bob@laptop"}, keyFileBlock)
+	assert.Nil(t, err)
+	assert.Equal(t, again, fileText)
+}
+
+func TestRenderAuthorizedKeysBlockFail(t *testing.T) {
+	_, err := renderAuthorizedKeys(keyBlockBegin+"\nssh-ed25519 AAAA\n", nil, keyFileBlock)
+	assert.Equal(t, err.Error(), `Missing "# END argo-lyte managed keys" marker`)
+
+	_, err = renderAuthorizedKeys(keyBlockEnd+"\n", nil, keyFileBlock)
+	assert.Equal(t, err.Error(), `Unexpected "# END argo-lyte managed keys" marker`)
+
+	_, err = renderAuthorizedKeys(keyBlockBegin+"\n"+keyBlockEnd+"\n"+keyBlockBegin+"\n"+keyBlockEnd+"\n", nil, keyFileBlock)
+	assert.Equal(t, err.Error(), `More than one "# BEGIN argo-lyte managed keys" marker`)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Security key settings of the key policy
+const (
+	securityKeysAllow   = "allow"
+	securityKeysRequire = "require"
+	securityKeysForbid  = "forbid"
+)
+
+// KeyPolicy - the ssh keys allowed in authorized_keys
+type KeyPolicy struct {
+	// key types allowed, e.g. ssh-ed25519 or sk-ssh-ed25519@openssh.com. Empty allows every type.
+	AllowedTypes []string
+	// minimum size of rsa keys, 0 for no minimum
+	MinRSABits int
+	// allow, require or forbid security keys (sk-*)
+	SecurityKeys string
+}
+
+// Tested
+// Build the key policy from the command line flags
+func parseKeyPolicy(keyTypes string, minRSABits int, securityKeys string) (KeyPolicy, error) {
+	policy := KeyPolicy{AllowedTypes: make([]string, 0), MinRSABits: minRSABits, SecurityKeys: securityKeys}
+	for _, keyType := range strings.Split(keyTypes, ",") {
+		keyType = strings.TrimSpace(keyType)
+		if keyType != "" {
+			policy.AllowedTypes = append(policy.AllowedTypes, keyType)
+		}
+	}
+
+	if minRSABits < 0 {
+		return policy, fmt.Errorf("Invalid minimum rsa size %d", minRSABits)
+	}
+
+	switch securityKeys {
+	case securityKeysAllow, securityKeysRequire, securityKeysForbid:
+	default:
+		return policy, fmt.Errorf("Invalid security key setting %q, use allow, require or forbid", securityKeys)
+	}
+	return policy, nil
+}
+
+// Tested
+// Check a key against the key policy
+func checkKeyPolicy(policy KeyPolicy, publicKey ssh.PublicKey) error {
+	keyType := publicKey.Type()
+
+	// security key types may be listed with or without their @openssh.com suffix
+	if len(policy.AllowedTypes) > 0 && !contains(policy.AllowedTypes, keyType) && !contains(policy.AllowedTypes, strings.TrimSuffix(keyType, "@openssh.com")) {
+		return fmt.Errorf("Key type %s is not allowed", keyType)
+	}
+
+	isSecurityKey := strings.HasPrefix(keyType, "sk-")
+	if policy.SecurityKeys == securityKeysRequire && !isSecurityKey {
+		return errors.New("Only security keys are allowed")
+	}
+	if policy.SecurityKeys == securityKeysForbid && isSecurityKey {
+		return errors.New("Security keys are not allowed")
+	}
+
+	if policy.MinRSABits > 0 && keyType == ssh.KeyAlgoRSA {
+		cryptoKey, ok := publicKey.(ssh.CryptoPublicKey)
+		if !ok {
+			return errors.New("Can't read the size of the rsa key")
+		}
+		rsaKey, ok := cryptoKey.CryptoPublicKey().(*rsa.PublicKey)
+		if !ok {
+			return errors.New("Can't read the size of the rsa key")
+		}
+		if bits := rsaKey.N.BitLen(); bits < policy.MinRSABits {
+			return fmt.Errorf("Rsa key of %d bits is under the minimum of %d bits", bits, policy.MinRSABits)
+		}
+	}
+	return nil
+}
+
+// Tested
+// Drop the normalized keys that break the key policy. Every key left out is returned as a problem with its fingerprint.
+func applyKeyPolicy(policy KeyPolicy, sshKeys []string) ([]string, []error) {
+	allowedKeys := make([]string, 0)
+	problems := make([]error, 0)
+	for _, sshKey := range sshKeys {
+		publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(sshKey))
+		if err != nil {
+			problems = append(problems, fmt.Errorf("Invalid ssh key %q: %s", sshKey, err.Error()))
+			continue
+		}
+		err = checkKeyPolicy(policy, publicKey)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("Key %s excluded by the key policy: %s", ssh.FingerprintSHA256(publicKey), err.Error()))
+			continue
+		}
+		allowedKeys = append(allowedKeys, sshKey)
+	}
+	return allowedKeys, problems
+}
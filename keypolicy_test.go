@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// generate an rsa authorized_keys line of the given size for tests
+func testRSAKey(t *testing.T, bits int) string {
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	assert.Nil(t, err)
+	sshPub, err := ssh.NewPublicKey(&key.PublicKey)
+	assert.Nil(t, err)
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub))) + " rsa@laptop"
+}
+
+// build a sk-ssh-ed25519 authorized_keys line for tests
+func testSecurityKey(t *testing.T) string {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	keyType := "sk-ssh-ed25519@openssh.com"
+	wire := ssh.Marshal(struct {
+		Name        string
+		KeyBytes    []byte
+		Application string
+	}{keyType, pub, "ssh:"})
+	return keyType + " " + base64.StdEncoding.EncodeToString(wire) + " yubikey"
+}
+
+// parse an authorized_keys line for tests
+func testParseKey(t *testing.T, sshKey string) ssh.PublicKey {
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(sshKey))
+	assert.Nil(t, err)
+	return publicKey
+}
+
+// parseKeyPolicy
+func TestParseKeyPolicyPass(t *testing.T) {
+	policy, err := parseKeyPolicy("ssh-ed25519, sk-ssh-ed25519,,", 3072, "allow")
+	assert.Nil(t, err)
+	assert.Equal(t, policy.AllowedTypes, []string{"ssh-ed25519", "sk-ssh-ed25519"})
+	assert.Equal(t, policy.MinRSABits, 3072)
+
+	policy, err = parseKeyPolicy("", 0, "forbid")
+	assert.Nil(t, err)
+	assert.Equal(t, len(policy.AllowedTypes), 0)
+}
+
+func TestParseKeyPolicyFail(t *testing.T) {
+	_, err := parseKeyPolicy("", 0, "maybe")
+	assert.Equal(t, err.Error(), `Invalid security key setting "maybe", use allow, require or forbid`)
+
+	_, err = parseKeyPolicy("", -1, "allow")
+	assert.Equal(t, err.Error(), "Invalid minimum rsa size -1")
+}
+
+// checkKeyPolicy
+func TestCheckKeyPolicyTypes(t *testing.T) {
+	policy := KeyPolicy{AllowedTypes: []string{"ssh-ed25519", "sk-ssh-ed25519"}, SecurityKeys: securityKeysAllow}
+	assert.Nil(t, checkKeyPolicy(policy, testParseKey(t, testSSHKey(t, "bob@laptop"))))
+	assert.Nil(t, checkKeyPolicy(policy, testParseKey(t, testSecurityKey(t))))
+
+	err := checkKeyPolicy(policy, testParseKey(t, testRSAKey(t, 1024)))
+	assert.Equal(t, err.Error(), "Key type ssh-rsa is not allowed")
+}
+
+func TestCheckKeyPolicyRSABits(t *testing.T) {
+	policy := KeyPolicy{MinRSABits: 2048, SecurityKeys: securityKeysAllow}
+	assert.Nil(t, checkKeyPolicy(policy, testParseKey(t, testRSAKey(t, 2048))))
+	assert.Nil(t, checkKeyPolicy(policy, testParseKey(t, testSSHKey(t, "bob@laptop"))))
+
+	err := checkKeyPolicy(policy, testParseKey(t, testRSAKey(t, 1024)))
+	assert.Equal(t, err.Error(), "Rsa key of 1024 bits is under the minimum of 2048 bits")
+}
+
+func TestCheckKeyPolicySecurityKeys(t *testing.T) {
+	securityKey := testParseKey(t, testSecurityKey(t))
+	plainKey := testParseKey(t, testSSHKey(t, "bob@laptop"))
+
+	policy := KeyPolicy{SecurityKeys: securityKeysRequire}
+	assert.Nil(t, checkKeyPolicy(policy, securityKey))
+	assert.Equal(t, checkKeyPolicy(policy, plainKey).Error(), "Only security keys are allowed")
+
+	policy = KeyPolicy{SecurityKeys: securityKeysForbid}
+	assert.Nil(t, checkKeyPolicy(policy, plainKey))
+	assert.Equal(t, checkKeyPolicy(policy, securityKey).Error(), "Security keys are not allowed")
+}
+
+// applyKeyPolicy
+func TestApplyKeyPolicy(t *testing.T) {
+	policy := KeyPolicy{AllowedTypes: []string{"ssh-ed25519"}, SecurityKeys: securityKeysAllow}
+	bobKey := testSSHKey(t, "bob@laptop")
+	rsaKey := testRSAKey(t, 1024)
+
+	sshKeys, problems := applyKeyPolicy(policy, []string{rsaKey, bobKey})
+	assert.Equal(t, sshKeys, []string{bobKey})
+	assert.Equal(t, len(problems), 1)
+	fingerprint := ssh.FingerprintSHA256(testParseKey(t, rsaKey))
+	assert.Equal(t, problems[0].Error(), "Key "+fingerprint+" excluded by the key policy: Key type ssh-rsa is not allowed")
+}
@@ -3,20 +3,20 @@ package main
 import (
 	"bytes"
 	"encoding/gob"
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"os/user"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/util"
+	"golang.org/x/crypto/ssh"
 )
 
 //////// All tests were run on a vagrant ubuntu 14.04 image; other os's will be supported in the future ///////////
@@ -41,9 +41,65 @@ func checkWithoutPanic(e error) {
 	}
 }
 
+// Failures recorded during the run. A user or group that fails is skipped and retried
+// on the next run instead of stopping every account that comes after it.
+var failures []SyncFailure
+
+// Record the failure of a single user or group and keep going
+func recordFailure(kind string, id string, err error) {
+	fmt.Printf("Failed to sync %s %s: %s\n", kind, id, err.Error())
+	failures = append(failures, SyncFailure{Kind: kind, ID: id, Err: err})
+}
+
+// Warnings recorded during the run. Unlike failures they don't stop the user or group from syncing.
+var warnings []SyncWarning
+
+// Record a problem with a user or group that was worked around
+func recordWarning(kind string, id string, err error) {
+	fmt.Printf("Warning for %s %s: %s\n", kind, id, err.Error())
+	warnings = append(warnings, SyncWarning{Kind: kind, ID: id, Message: err.Error()})
+}
+
 // Tested
-// Get the groupid by the group name
+// Build the summary of the warnings printed at the end of the run
+func warningSummary(warnings []SyncWarning) string {
+	summary := fmt.Sprintf("%d warning(s):\n", len(warnings))
+	for _, warning := range warnings {
+		summary += fmt.Sprintf("  %s %s: %s\n", warning.Kind, warning.ID, warning.Message)
+	}
+	return summary
+}
+
+// Tested
+// Build the summary of the failed users and groups printed at the end of the run
+func failureSummary(failures []SyncFailure) string {
+	summary := fmt.Sprintf("%d user(s)/group(s) failed to sync:\n", len(failures))
+	for _, failure := range failures {
+		summary += fmt.Sprintf("  %s %s: %s\n", failure.Kind, failure.ID, failure.Err.Error())
+	}
+	return summary
+}
+
+// Tested
+// Get the id a user or group file should define from its file name
+func idFromFileName(fileName string) string {
+	if !isDefinitionFile(fileName) {
+		return fileName
+	}
+	return strings.TrimSuffix(fileName, filepath.Ext(fileName))
+}
+
+// Tested
+// Get the groupid by the group name, from the group file of the alternate root when there is one
 func getGIDByGroupName(groupName string) (int, error) {
+	if rootDirectory != "" {
+		groupID, found, err := lookupIDInFile(rootPath("/etc/group"), groupName)
+		if err == nil && !found {
+			err = user.UnknownGroupError(groupName)
+		}
+		return groupID, err
+	}
+
 	group, err := user.LookupGroup(groupName)
 	if err != nil {
 		return -1, err
@@ -58,8 +114,16 @@ func getGIDByGroupName(groupName string) (int, error) {
 }
 
 // Tested
-// Get the userid by the user name
+// Get the userid by the user name, from the passwd file of the alternate root when there is one
 func getUIDByUserName(userName string) (int, error) {
+	if rootDirectory != "" {
+		userID, found, err := lookupIDInFile(rootPath("/etc/passwd"), userName)
+		if err == nil && !found {
+			err = user.UnknownUserError(userName)
+		}
+		return userID, err
+	}
+
 	user, err := user.Lookup(userName)
 	if err != nil {
 		return -1, err
@@ -73,32 +137,60 @@ func getUIDByUserName(userName string) (int, error) {
 	return userID, nil
 }
 
+// Tested
+// Check if the user exists on the machine
+func userExists(userName string) (bool, error) {
+	_, err := getUIDByUserName(userName)
+	if err != nil {
+		if _, ok := err.(user.UnknownUserError); ok {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
 // Not testable
-// Pipe the output of the curl into tar to create the 2 folders(users/groups)
+// Download the users/groups bundle into the work directory. Tarballs are uncompressed into the
+// users and groups folders, single json or yaml bundles are kept as bundle.json or bundle.yaml.
 func getUserGroupFile(workDir string, userURL string) {
-	fmt.Printf("Getting user group url and uncompressing it: %s\n", userURL)
+	fmt.Printf("Getting user group url: %s\n", userURL)
 
-	cmd1 := exec.Command("curl", "-s", userURL)
-	cmd2 := exec.Command("tar", "-zxC", workDir)
+	// a single file bundle left over from an earlier run would win over a tarball
+	for _, ext := range []string{".json", ".yaml"} {
+		err := os.Remove(workDir + "/" + bundleDocumentName + ext)
+		if err != nil && !os.IsNotExist(err) {
+			check(err)
+		}
+	}
 
-	pr, pw := io.Pipe()
-	cmd1.Stdout = pw
-	cmd2.Stdin = pr
-	cmd2.Stdout = os.Stdout
+	downloadFile := workDir + "/" + bundleDocumentName + ".download"
+	defer os.Remove(downloadFile)
 
-	err := cmd1.Start()
-	check(err)
+	cmd := exec.Command("curl", "-s", "-f", "-o", downloadFile, "-w", "%{content_type}", userURL)
 
-	err = cmd2.Start()
-	check(err)
+	var contentType bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &contentType
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		errString := fmt.Sprint(err) + ": " + stderr.String()
+		check(errors.New(errString))
+	}
 
-	go func() {
-		defer pw.Close()
-		err = cmd1.Wait()
+	ext := bundleDocumentFormat(userURL, contentType.String())
+	if ext != "" {
+		fmt.Printf("Keeping single file bundle: %s%s\n", bundleDocumentName, ext)
+		err = os.Rename(downloadFile, workDir+"/"+bundleDocumentName+ext)
 		check(err)
-	}()
+		return
+	}
 
-	err = cmd2.Wait()
+	fmt.Printf("Uncompressing user group file: %s\n", downloadFile)
+	cmd = exec.Command("tar", "-zxf", downloadFile, "-C", workDir)
+	cmd.Stdout = os.Stdout
+	err = cmd.Run()
 	check(err)
 }
 
@@ -127,7 +219,7 @@ func deleteWorkingDirectory(workDir string) error {
 }
 
 // Tested
-// Pull the group information from the json file into the ArgoGroup struct
+// Pull the group information from the json, yaml or toml file into the ArgoGroup struct
 func getGroupFromFile(file os.FileInfo, groupsDir string) (*ArgoGroup, error) {
 	// Read the json file and marshall it into a struct
 	var group ArgoGroup
@@ -138,7 +230,7 @@ func getGroupFromFile(file os.FileInfo, groupsDir string) (*ArgoGroup, error) {
 		return nil, err
 	}
 
-	err = json.Unmarshal(result, &group)
+	err = unmarshalDefinition(file.Name(), result, &group)
 	if err != nil {
 		return nil, err
 	}
@@ -147,7 +239,7 @@ func getGroupFromFile(file os.FileInfo, groupsDir string) (*ArgoGroup, error) {
 }
 
 //Tested
-// Pull the user information from the json file into a ArgoUser struct
+// Pull the user information from the json, yaml or toml file into a ArgoUser struct
 func getUserFromFile(file os.FileInfo, usersDir string) (*ArgoUser, error) {
 	// Read the json file and marshall it into a struct
 	var user ArgoUser
@@ -158,7 +250,7 @@ func getUserFromFile(file os.FileInfo, usersDir string) (*ArgoUser, error) {
 		return nil, err
 	}
 
-	err = json.Unmarshal(result, &user)
+	err = unmarshalDefinition(file.Name(), result, &user)
 	if err != nil {
 		return nil, err
 	}
@@ -166,43 +258,187 @@ func getUserFromFile(file os.FileInfo, usersDir string) (*ArgoUser, error) {
 	return &user, nil
 }
 
-//Tested
-// Creates the authorized_keys file in the users ssh directory based on their stored sshkeys
-func createAuthorizedKeyFile(user ArgoUser, sshDir string) error {
-	fileText := "# Generated by argo-lyte\n"
-	fileText += "# Local modifications will be overwritten.\n\n"
+// Tested
+// Load the group files of the groups directory. Files that fail to load and ids defined by more than
+// one file (e.g. devs.json and devs.yaml) are returned as failures so those groups are left untouched.
+func loadGroups(groupsDir string) ([]ArgoGroup, []SyncFailure, error) {
+	fmt.Printf("Reading directory: %s\n", groupsDir)
+	files, err := ioutil.ReadDir(groupsDir)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	for _, sshKey := range user.SSHkeys {
-		fileText += sshKey + "\n"
+	groups := make([]ArgoGroup, 0)
+	sources := make([]string, 0)
+	failures := make([]SyncFailure, 0)
+	for _, file := range files {
+		if !isDefinitionFile(file.Name()) {
+			continue
+		}
+
+		group, err := getGroupFromFile(file, groupsDir)
+		if err != nil {
+			failures = append(failures, SyncFailure{Kind: "group", ID: idFromFileName(file.Name()), Err: err})
+			continue
+		}
+		groups = append(groups, *group)
+		sources = append(sources, file.Name())
 	}
 
-	sshFile := sshDir + "/authorized_keys"
+	groups, duplicateFailures := uniqueGroups(groups, sources)
+	groups, invalidFailures := checkGroups(groups)
+	failures = append(failures, duplicateFailures...)
+	return groups, append(failures, invalidFailures...), nil
+}
 
-	fmt.Printf("Creating ssh file: %s\n", sshFile)
+// Tested
+// Drop the groups whose id is defined more than once and return them as failures. sources says where each group came from.
+func uniqueGroups(groups []ArgoGroup, sources []string) ([]ArgoGroup, []SyncFailure) {
+	mGroupSources := make(map[string][]string)
+	for i, group := range groups {
+		mGroupSources[group.ID] = append(mGroupSources[group.ID], sources[i])
+	}
 
-	d1 := []byte(fileText)
-	err := ioutil.WriteFile(sshFile, d1, 0600)
+	unique := make([]ArgoGroup, 0)
+	failures := make([]SyncFailure, 0)
+	mReported := make(map[string]bool)
+	for _, group := range groups {
+		if len(mGroupSources[group.ID]) > 1 {
+			if !mReported[group.ID] {
+				err := fmt.Errorf("Group %s is defined more than once: %s", group.ID, strings.Join(mGroupSources[group.ID], ", "))
+				failures = append(failures, SyncFailure{Kind: "group", ID: group.ID, Err: err})
+				mReported[group.ID] = true
+			}
+			continue
+		}
+		unique = append(unique, group)
+	}
+	return unique, failures
+}
+
+// Tested
+// Load the user files of the users directory. Files that fail to load and ids defined by more than
+// one file (e.g. bob.json and bob.toml) are returned as failures so those users are left untouched.
+func loadUsers(usersDir string) ([]ArgoUser, []SyncFailure, error) {
+	fmt.Printf("Reading directory: %s\n", usersDir)
+	files, err := ioutil.ReadDir(usersDir)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	fmt.Printf("Changing owner for: %s to %s\n", sshFile, user.ID)
+	users := make([]ArgoUser, 0)
+	sources := make([]string, 0)
+	failures := make([]SyncFailure, 0)
+	for _, file := range files {
+		if !isDefinitionFile(file.Name()) {
+			continue
+		}
 
-	groupID, err := getGIDByGroupName(user.ID)
-	if err != nil {
-		return err
+		user, err := getUserFromFile(file, usersDir)
+		if err != nil {
+			failures = append(failures, SyncFailure{Kind: "user", ID: idFromFileName(file.Name()), Err: err})
+			continue
+		}
+		users = append(users, *user)
+		sources = append(sources, file.Name())
+	}
+
+	users, duplicateFailures := uniqueUsers(users, sources)
+	users, invalidFailures := checkUsers(users)
+	failures = append(failures, duplicateFailures...)
+	return users, append(failures, invalidFailures...), nil
+}
+
+// Tested
+// Drop the users whose id is defined more than once and return them as failures. sources says where each user came from.
+func uniqueUsers(users []ArgoUser, sources []string) ([]ArgoUser, []SyncFailure) {
+	mUserSources := make(map[string][]string)
+	for i, user := range users {
+		mUserSources[user.ID] = append(mUserSources[user.ID], sources[i])
+	}
+
+	unique := make([]ArgoUser, 0)
+	failures := make([]SyncFailure, 0)
+	mReported := make(map[string]bool)
+	for _, user := range users {
+		if len(mUserSources[user.ID]) > 1 {
+			if !mReported[user.ID] {
+				err := fmt.Errorf("User %s is defined more than once: %s", user.ID, strings.Join(mUserSources[user.ID], ", "))
+				failures = append(failures, SyncFailure{Kind: "user", ID: user.ID, Err: err})
+				mReported[user.ID] = true
+			}
+			continue
+		}
+		unique = append(unique, user)
 	}
+	return unique, failures
+}
+
+// Tested
+// Drop the users whose id or shell can't be used for an account and return them as failures. The id goes into
+// paths like the home directory and the shell into the passwd file, so neither is used without these checks.
+func checkUsers(users []ArgoUser) ([]ArgoUser, []SyncFailure) {
+	valid := make([]ArgoUser, 0)
+	failures := make([]SyncFailure, 0)
+	for _, user := range users {
+		err := validatePosixName(user.ID)
+		if err == nil {
+			err = validateShellLine(user.Shell)
+		}
+		if err != nil {
+			failures = append(failures, SyncFailure{Kind: "user", ID: user.ID, Err: err})
+			continue
+		}
+		valid = append(valid, user)
+	}
+	return valid, failures
+}
 
-	userID, err := getUIDByUserName(user.ID)
+// Tested
+// Drop the groups whose id can't be used for a group and return them as failures
+func checkGroups(groups []ArgoGroup) ([]ArgoGroup, []SyncFailure) {
+	valid := make([]ArgoGroup, 0)
+	failures := make([]SyncFailure, 0)
+	for _, group := range groups {
+		err := validatePosixName(group.ID)
+		if err != nil {
+			failures = append(failures, SyncFailure{Kind: "group", ID: group.ID, Err: err})
+			continue
+		}
+		valid = append(valid, group)
+	}
+	return valid, failures
+}
+
+//Tested
+// Creates the authorized_keys file in the users ssh directory based on their stored sshkeys.
+// The file is replaced atomically with its owner already set, so the user is never left without keys.
+func createAuthorizedKeyFile(accounts AccountManager, user ArgoUser, sshDir string) error {
+	sshFile := sshDir + "/authorized_keys"
+
+	userID, groupID, err := accounts.UserIDs(user.ID)
 	if err != nil {
 		return err
 	}
 
-	err = os.Chown(sshFile, userID, groupID)
+	// in block mode the lines outside of the managed block are kept
+	existing := ""
+	if keyFileMode == keyFileBlock {
+		data, err := readRegularFile(sshFile, userID)
+		if err != nil {
+			return err
+		}
+		existing = string(data)
+	}
+
+	fileText, err := renderAuthorizedKeys(existing, renderSSHKeys(user.SSHkeys), keyFileMode)
 	if err != nil {
-		return err
+		return fmt.Errorf("%s: %s", sshFile, err.Error())
 	}
-	return nil
+
+	fmt.Printf("Creating ssh file: %s owned by %s\n", sshFile, user.ID)
+
+	return writeFileAtomic(sshFile, []byte(fileText), 0600, userID, groupID)
 }
 
 //Tested
@@ -220,13 +456,54 @@ func deleteAuthorizedKeyFile(user ArgoUser, sshDir string) error {
 	return nil
 }
 
-func updateAuthorizedKeyFile(user string, sshkeys []string) {
-	argoUser := ArgoUser{sshkeys, user, ""}
-	sshDir := "/home/" + user + "/.ssh"
-	err := deleteAuthorizedKeyFile(argoUser, sshDir)
-	check(err)
-	err = createAuthorizedKeyFile(argoUser, sshDir)
-	check(err)
+// Not testable
+// Replace the authorized_keys file, or its managed block, with the updated keys.
+// A missing .ssh directory or authorized_keys file is recreated.
+func updateAuthorizedKeyFile(accounts AccountManager, user string, sshkeys []string) error {
+	argoUser := ArgoUser{SSHkeys: plainSSHKeys(sshkeys), ID: user}
+	sshDir, err := ensureSSHDirectory(accounts, user)
+	if err != nil {
+		return err
+	}
+	return createAuthorizedKeyFile(accounts, argoUser, sshDir)
+}
+
+// Not testable
+// Make sure the .ssh directory of the user exists, is owned by the user and isn't a symlink.
+// useradd has created the home directory by the time it returns, so a missing home is an error.
+func ensureSSHDirectory(accounts AccountManager, userName string) (string, error) {
+	homeDir := homeDirectory(userName)
+	sshDir := homeDir + "/.ssh"
+
+	userID, groupID, err := accounts.UserIDs(userName)
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Printf("Changing owner for: %s to %s\n", sshDir, userName)
+	created, err := ensureOwnedDirectory(homeDir, ".ssh", 0700, userID, groupID)
+	if err != nil {
+		return "", err
+	}
+	if created {
+		fmt.Printf("Created directory: %s\n", sshDir)
+	}
+	return sshDir, nil
+}
+
+// Not testable
+// Create the .ssh directory with only the users accessible permissions then
+// put the ssh key in the directory(which should allow the user to ssh in)
+func createSSHDirectory(accounts AccountManager, user ArgoUser) error {
+	sshDir, err := ensureSSHDirectory(accounts, user.ID)
+	if err != nil {
+		return err
+	}
+
+	if len(user.SSHkeys) > 0 {
+		return createAuthorizedKeyFile(accounts, user, sshDir)
+	}
+	return nil
 }
 
 //Tested
@@ -234,7 +511,7 @@ func updateAuthorizedKeyFile(user string, sshkeys []string) {
 func groupAdd(groupName string) error {
 	var cmd *exec.Cmd
 	fmt.Printf("Creating group: %v\n", groupName)
-	cmd = exec.Command("groupadd", groupName)
+	cmd = exec.Command("groupadd", append(rootArgs(), groupName)...)
 
 	var out bytes.Buffer
 	var stderr bytes.Buffer
@@ -254,7 +531,7 @@ func groupAdd(groupName string) error {
 func groupDelete(groupName string) error {
 	var cmd *exec.Cmd
 	fmt.Printf("Deleting group: %v\n", groupName)
-	cmd = exec.Command("groupdel", groupName)
+	cmd = exec.Command("groupdel", append(rootArgs(), groupName)...)
 
 	var out bytes.Buffer
 	var stderr bytes.Buffer
@@ -275,7 +552,7 @@ func addGroupToUser(user string, group string) error {
 	var cmd *exec.Cmd
 	fmt.Printf("Adding group: %s to user: %s\n", user, group)
 
-	cmd = exec.Command("usermod", "-a", "-G", group, user)
+	cmd = exec.Command("usermod", append(rootArgs(), "-a", "-G", group, user)...)
 
 	var out bytes.Buffer
 	var stderr bytes.Buffer
@@ -296,7 +573,7 @@ func removeGroupFromUser(user string, group string) error {
 	var cmd *exec.Cmd
 	fmt.Printf("Deleting group: %s from user: %s\n", user, group)
 
-	cmd = exec.Command("gpasswd", "-d", user, group)
+	cmd = exec.Command("gpasswd", append(rootArgs(), "-d", user, group)...)
 
 	var out bytes.Buffer
 	var stderr bytes.Buffer
@@ -317,12 +594,13 @@ func userAdd(user ArgoUser, groups []string) error {
 	var cmd *exec.Cmd
 	fmt.Printf("Creating user: %v and adding to these groups: %v\n", user.ID, groups)
 
+	// with --root useradd works inside the alternate root, so the home directory is its path there
 	homeDir := "/home/" + user.ID
 	if len(groups) == 0 {
-		cmd = exec.Command("useradd", "--shell", user.Shell, "--home", homeDir, "--create-home", user.ID)
+		cmd = exec.Command("useradd", append(rootArgs(), "--shell", user.Shell, "--home", homeDir, "--create-home", user.ID)...)
 	} else {
 		commaUsers := strings.Join(groups, ",")
-		cmd = exec.Command("useradd", "--shell", user.Shell, "--home", homeDir, "--groups", commaUsers, "--create-home", user.ID)
+		cmd = exec.Command("useradd", append(rootArgs(), "--shell", user.Shell, "--home", homeDir, "--groups", commaUsers, "--create-home", user.ID)...)
 	}
 
 	var out bytes.Buffer
@@ -340,10 +618,54 @@ func userAdd(user ArgoUser, groups []string) error {
 
 //Tested
 // Delete the user via the exec command
-func userDelete(userName string) error {
+func userDelete(userName string, removeHome bool) error {
 	var cmd *exec.Cmd
 	fmt.Printf("Deleting user: %v\n", userName)
-	cmd = exec.Command("userdel", "--remove", userName)
+	if removeHome {
+		cmd = exec.Command("userdel", append(rootArgs(), "--remove", userName)...)
+	} else {
+		cmd = exec.Command("userdel", append(rootArgs(), userName)...)
+	}
+
+	var out bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		errString := fmt.Sprint(err) + ": " + stderr.String()
+		return errors.New(errString)
+	}
+
+	return nil
+}
+
+//Tested
+// Lock a user: lock its password, expire the account and give it a shell that refuses logins
+func userLock(userName string) error {
+	var cmd *exec.Cmd
+	fmt.Printf("Locking user: %v\n", userName)
+	cmd = exec.Command("usermod", append(rootArgs(), "--lock", "--expiredate", "1", "--shell", nologinShell(), userName)...)
+
+	var out bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		errString := fmt.Sprint(err) + ": " + stderr.String()
+		return errors.New(errString)
+	}
+
+	return nil
+}
+
+//Tested
+// Unlock a user locked with userLock, giving it back its shell
+func userUnlock(user ArgoUser) error {
+	var cmd *exec.Cmd
+	fmt.Printf("Unlocking user: %v\n", user.ID)
+	cmd = exec.Command("usermod", append(rootArgs(), "--unlock", "--expiredate", "", "--shell", user.Shell, user.ID)...)
 
 	var out bytes.Buffer
 	var stderr bytes.Buffer
@@ -363,7 +685,7 @@ func userDelete(userName string) error {
 func addGroupToSudoers(group string) error {
 	fileText := "%" + group + " ALL=(ALL) ALL\n"
 
-	sudoersFile := "/etc/sudoers.d/argo-" + group
+	sudoersFile := rootPath("/etc/sudoers.d/argo-" + group)
 
 	fmt.Printf("Creating sudoers file: %s\n", sudoersFile)
 
@@ -378,7 +700,7 @@ func addGroupToSudoers(group string) error {
 //Tested
 // Delete the sudoers file for the test
 func deleteSudoersFiles() {
-	sudoersDir := "/etc/sudoers.d"
+	sudoersDir := rootPath("/etc/sudoers.d")
 	fmt.Printf("Reading directory: %s\n", sudoersDir)
 	files, _ := ioutil.ReadDir(sudoersDir)
 	for _, file := range files {
@@ -411,6 +733,33 @@ func byteArrayToUserGroup(bArray []byte) *UserGroup {
 	return userGroup
 }
 
+// leveldb key of the serial of the last bundle applied
+const bundleSerialKey = "bundle@serial"
+
+// Tested
+// Get the serial of the last bundle applied. The bool is false when no bundle with a manifest was applied yet.
+func getAppliedSerial(db *leveldb.DB) (uint64, bool, error) {
+	data, err := db.Get([]byte(bundleSerialKey), nil)
+	if err == leveldb.ErrNotFound {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	serial, err := strconv.ParseUint(string(data), 10, 64)
+	if err != nil {
+		return 0, false, err
+	}
+	return serial, true, nil
+}
+
+// Tested
+// Store the serial of the bundle applied so older bundles are refused from now on
+func putAppliedSerial(db *leveldb.DB, serial uint64) error {
+	return db.Put([]byte(bundleSerialKey), []byte(strconv.FormatUint(serial, 10)), nil)
+}
+
 // Tested
 // helper function to pull user out of leveldb key
 func parseUserKey(fullKey string) (string, error) {
@@ -481,21 +830,103 @@ func adjustSlice(arrayAdd []string, arrayRemove []string, existingArray []string
 ////////////////////////////  Main Functionality //////////////////////////////
 
 var dbLocation string
+var keyStoreDirectory string
 var workDirectory string
 var userURL string
 var sudoGroups string
 var delete bool
 var retrievefile bool
 var removefiles bool
+var allowRollback bool
+var signingKeyFile string
+var keyTypes string
+var minRSABits int
+var securityKeys string
+var writeKeyFiles bool
+var expiryWarning time.Duration
+var keyFileMode string
+var caKeysFile string
+var principalsDir string
+var enforceKeys bool
+var rootDirectory string
+var accountsBackend string
+var removalPolicy string
+var archiveDirectory string
+var archiveRetention time.Duration
+var lockGrace time.Duration
+var terminateSessions bool
+var killSignal string
+var killTimeout time.Duration
+var orphanPaths string
+var orphanAction string
+var quarantineUser string
 
 func init() {
 	flag.StringVar(&dbLocation, "dblocation", "/tmp/db", "leveldb location")
+	flag.StringVar(&keyStoreDirectory, "keystore", "/var/lib/argo-lyte/keys", "key store the authorized-keys command serves the ssh keys from. Must be owned by root and not group or world writable")
 	flag.StringVar(&workDirectory, "workdirectory", "/tmp/eau-work", "temporary working location")
 	flag.StringVar(&userURL, "userurl", "", "argo url to tarred and gzipd user / groups files.")
 	flag.StringVar(&sudoGroups, "sudogroups", "", "groups to add as sudo. ex. group1, group2")
 	flag.BoolVar(&delete, "delete", false, "deletes groups and users")
 	flag.BoolVar(&retrievefile, "retrievefile", true, "retrieves file from remote location")
 	flag.BoolVar(&removefiles, "removefiles", true, "removes files from retrieval")
+	flag.BoolVar(&allowRollback, "allowrollback", false, "applies a bundle with a lower serial than the last one applied")
+	flag.StringVar(&signingKeyFile, "pubkey", "", "ssh public key the bundle manifest must be signed with. Unsigned and single file bundles are refused")
+	flag.StringVar(&keyTypes, "keytypes", "", "ssh key types allowed in authorized_keys. ex. ssh-ed25519, sk-ssh-ed25519. Empty allows every type")
+	flag.IntVar(&minRSABits, "minrsabits", 0, "minimum size of rsa keys allowed in authorized_keys")
+	flag.StringVar(&securityKeys, "securitykeys", securityKeysAllow, "allow, require or forbid security keys (sk-*) in authorized_keys")
+	flag.DurationVar(&expiryWarning, "expirywarning", 7*24*time.Hour, "warns about ssh keys expiring within this long")
+	flag.StringVar(&keyFileMode, "keyfilemode", keyFileOverwrite, "overwrite the whole authorized_keys file or only the block between the argo-lyte markers (block)")
+	flag.StringVar(&caKeysFile, "cakeysfile", "/etc/ssh/argo-lyte_user_ca_keys", "file the ca keys of the bundle are written to, for sshd's TrustedUserCAKeys")
+	flag.StringVar(&principalsDir, "principalsdir", "/etc/ssh/auth_principals", "directory the principals of each user are written to, for sshd's AuthorizedPrincipalsFile")
+	flag.BoolVar(&writeKeyFiles, "writekeyfiles", true, "writes the ssh keys to /home/<user>/.ssh/authorized_keys. Turn off when sshd uses the authorized-keys command")
+	flag.StringVar(&accountsBackend, "accounts", accountsAuto, "manages the accounts with the shadow-utils commands (shadow), the BusyBox applets (busybox) by editing /etc/passwd, /etc/group and their shadow files directly (files) or by writing them to /var/lib/extrausers for libnss-extrausers (extrausers). auto picks the one the machine has")
+	flag.StringVar(&rootDirectory, "root", "", "manages the accounts of the image or filesystem mounted here instead of the machine. ex. /mnt/image")
+	flag.StringVar(&removalPolicy, "removal", removalRemove, "what happens to the home directory of a user removed from the bundle: remove it, keep it, or archive it to -archivedir then remove it")
+	flag.StringVar(&archiveDirectory, "archivedir", "/var/lib/argo-lyte/archive", "directory the home directories of removed users are archived to with -removal archive")
+	flag.DurationVar(&archiveRetention, "archiveretention", 90*24*time.Hour, "removes home directory archives older than this. 0 keeps them forever")
+	flag.DurationVar(&lockGrace, "lockgrace", 0, "locks a user removed from the bundle for this long before deleting it. 0 deletes it right away")
+	flag.BoolVar(&terminateSessions, "terminatesessions", false, "ends the sessions and kills the processes of a user before it is locked or deleted")
+	flag.StringVar(&killSignal, "killsignal", "TERM", "signal sent to the processes of a user with -terminatesessions: TERM, HUP, INT, QUIT or KILL")
+	flag.DurationVar(&killTimeout, "killtimeout", 10*time.Second, "how long the processes of a user get to exit after -killsignal before they are killed")
+	flag.StringVar(&orphanPaths, "orphanpaths", "", "paths searched for the files a deleted user still owns. ex. /tmp,/var/tmp,/srv")
+	flag.StringVar(&orphanAction, "orphanaction", orphanReport, "reports the files under -orphanpaths a deleted user still owns, or chowns them to -quarantineuser (chown)")
+	flag.StringVar(&quarantineUser, "quarantineuser", "nobody", "account the files of deleted users are chowned to with -orphanaction chown")
+	flag.BoolVar(&enforceKeys, "enforcekeys", false, "checks every authorized_keys file each run and restores its contents, mode and owner when they were changed on the host")
+}
+
+// Print the commands and flags
+func usage() {
+	fmt.Println("Usage: argo-lyte -userurl <url> [flags]")
+	fmt.Println("       argo-lyte validate [-pubkey <file>] <bundle|dir>")
+	fmt.Println("       argo-lyte pack [-o <bundle.tgz>] [-signkey <file>] <dir>")
+	fmt.Println("       argo-lyte [-keystore <dir>] authorized-keys <username>")
+	flag.PrintDefaults()
+}
+
+// Tested
+// Parse the flags of a command and return its one argument. Flags can come before or after the argument.
+// The command's usage is printed on errors.
+func parseCommandArgs(flags *flag.FlagSet, args []string) (string, error) {
+	err := flags.Parse(args)
+	if err != nil {
+		return "", err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return "", errors.New("Missing argument")
+	}
+
+	arg := flags.Arg(0)
+	err = flags.Parse(flags.Args()[1:])
+	if err != nil {
+		return "", err
+	}
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return "", errors.New("Too many arguments")
+	}
+	return arg, nil
 }
 
 // Main
@@ -503,21 +934,93 @@ func main() {
 	flag.Parse()
 	// no args
 	if len(os.Args) == 1 {
-		flag.PrintDefaults()
+		usage()
 		os.Exit(1)
 	}
 
 	// arg of help
 	if os.Args[1] == "help" {
-		flag.PrintDefaults()
+		usage()
 		os.Exit(1)
 	}
 
+	// commands that don't sync the machine
+	switch flag.Arg(0) {
+	case "validate":
+		os.Exit(validateCommand(flag.Args()[1:]))
+	case "pack":
+		os.Exit(packCommand(flag.Args()[1:]))
+	case "authorized-keys":
+		os.Exit(authorizedKeysCommand(flag.Args()[1:]))
+	}
+
 	// required item
 	if userURL == "" {
-		flag.PrintDefaults()
+		usage()
+		os.Exit(1)
+	}
+
+	// refuse to run with a key policy that doesn't make sense rather than install keys it was meant to ban
+	keyPolicy, err := parseKeyPolicy(keyTypes, minRSABits, securityKeys)
+	if err != nil {
+		fmt.Println(err.Error())
+		usage()
+		os.Exit(1)
+	}
+	err = checkKeyFileMode(keyFileMode)
+	if err != nil {
+		fmt.Println(err.Error())
+		usage()
+		os.Exit(1)
+	}
+	err = checkRemovalPolicy(removalPolicy)
+	if err != nil {
+		fmt.Println(err.Error())
+		usage()
+		os.Exit(1)
+	}
+	_, err = parseKillSignal(killSignal)
+	if err != nil {
+		fmt.Println(err.Error())
+		usage()
 		os.Exit(1)
 	}
+	err = checkOrphanAction(orphanAction)
+	if err != nil {
+		fmt.Println(err.Error())
+		usage()
+		os.Exit(1)
+	}
+	var signingKey ssh.PublicKey
+	if signingKeyFile != "" {
+		signingKey, err = readSigningKey(signingKeyFile)
+		if err != nil {
+			fmt.Println(err.Error())
+			usage()
+			os.Exit(1)
+		}
+	}
+	accounts, err := newAccountManager(accountsBackend)
+	if err != nil {
+		fmt.Println(err.Error())
+		usage()
+		os.Exit(1)
+	}
+	fmt.Printf("Managing accounts with %T\n", accounts)
+
+	// with an alternate root the accounts, their files and leveldb all live inside it. The work directory stays on the host.
+	if rootDirectory != "" {
+		err = checkRootDirectory(rootDirectory)
+		if err != nil {
+			fmt.Println(err.Error())
+			usage()
+			os.Exit(1)
+		}
+		dbLocation = rootPath(dbLocation)
+		keyStoreDirectory = rootPath(keyStoreDirectory)
+		caKeysFile = rootPath(caKeysFile)
+		principalsDir = rootPath(principalsDir)
+	}
 
 	createWorkingDirectory(workDirectory)
 
@@ -532,340 +1035,101 @@ func main() {
 		getUserGroupFile(workDirectory, userURL)
 	}
 
-	// maps for users to groups and leveldb comparisons
-	mUserGroups := make(map[string][]string)
-	mUserSSHKeys := make(map[string][]string)
-	mGroup := make(map[string]string)
-	mUser := make(map[string]string)
-
-	// Loop through the groups directory creating groups
-	// and building the above map to eventually add the users to the appropriate groups
-	groupsDir := workDirectory + "/groups"
-	fmt.Printf("Reading directory: %s\n", groupsDir)
-	files, err := ioutil.ReadDir(groupsDir)
+	// refuse bundles that don't match their manifest, aren't signed by -pubkey or are older than the last one applied
+	lastSerial, hasLastSerial, err := getAppliedSerial(db)
 	check(err)
-	keyPrefix := "group@"
-	for _, file := range files {
-		// very the file has the json extension
-		if !strings.Contains(file.Name(), ".json") {
-			continue
-		}
-
-		// Marshall the json into the ArgoGroup struct
-		group, err := getGroupFromFile(file, groupsDir)
-		check(err)
-
-		// build the key for the map and leveldb
-		key := keyPrefix + group.ID
-
-		// add group to map
-		mGroup[key] = group.ID
-
-		// get group from leveldb
-		data, err := db.Get([]byte(key), nil)
-		checkWithoutPanic(err)
-
-		// the delete here makes testing this much easier
-		if delete == true {
-			if data != nil {
-				fmt.Printf("Deleting group in leveldb with key: %s\n", key)
-				err = db.Delete([]byte(key), nil)
-				check(err)
-			}
-
-			//delete the group from the machine
-			err = groupDelete(group.ID)
-			checkWithoutPanic(err)
-		} else {
-			// Group is not in leveldb, create it as a new group.
-			if data == nil {
-				fmt.Printf("Creating new group in leveldb with key: %s\n", key)
-				err = db.Put([]byte(key), []byte(group.ID), nil)
-				check(err)
-
-				// add the group to the machine
-				err = groupAdd(group.ID)
-				check(err)
-			} else {
-				fmt.Printf("Group %s in leveldb with key: %s already exists.\n", group.ID, key)
-			}
-		}
-
-		// Build a map of the users to groups
-		for _, u := range group.Users {
-			if mUserGroups[u] == nil {
-				mUserGroups[u] = []string{group.ID}
-			} else {
-				mUserGroups[u] = append(mUserGroups[u], group.ID)
-			}
+	manifest, err := checkManifest(workDirectory, lastSerial, hasLastSerial, allowRollback, signingKey)
+	if err != nil {
+		fmt.Printf("Refusing bundle: %s\n", err.Error())
+		if removefiles == true {
+			os.RemoveAll(workDirectory)
 		}
+		db.Close()
+		os.Exit(1)
 	}
 
-	// Loop through the users directory creating users,
-	// adding the users to the appropriate groups,
-	// create the .ssh directory and authorized_key file
-	usersDir := workDirectory + "/users"
-	fmt.Printf("Reading directory: %s\n", usersDir)
-	files, err = ioutil.ReadDir(usersDir)
+	// Load the groups and users from the users and groups folders or the single file bundle
+	groups, users, loadFailures, err := loadBundle(workDirectory)
 	check(err)
-	keyPrefix = "user@"
-
-	for _, file := range files {
-		if !strings.Contains(file.Name(), ".json") {
-			continue
-		}
-
-		// Marshall the json into the ArgoUser struct
-		user, err := getUserFromFile(file, usersDir)
-		check(err)
-
-		// build the key for the map and leveldb
-		key := keyPrefix + user.ID
 
-		// add user to map
-		mUser[key] = user.ID
-		mUserSSHKeys[key] = user.SSHkeys
+	reconcile(db, accounts, groups, users, loadFailures, keyPolicy)
 
-		// get the user from leveldb
-		data, err := db.Get([]byte(key), nil)
-		checkWithoutPanic(err)
-
-		// the delete here makes testing this much easier
-		if delete == true {
-			if data == nil {
-				fmt.Printf("Deleting user in leveldb with key: %s\n", key)
-				err = db.Delete([]byte(key), nil)
-				check(err)
-			}
-
-			//delete the user from the machine
-			err = userDelete(user.ID)
-			checkWithoutPanic(err)
-		} else {
-			// User is not in leveldb, create it as a new user.
-			if data == nil {
-				fmt.Printf("Creating new user in leveldb with key: %s\n", key)
-				userGroup := UserGroup{Groups: mUserGroups[user.ID], SSHKeys: user.SSHkeys, ID: user.ID, Shell: user.Shell}
-				bArray := userGroupToByteArray(userGroup)
-				err = db.Put([]byte(key), bArray, nil)
-				check(err)
-
-				groups := mUserGroups[user.ID]
-
-				// add the user to the machine
-				err = userAdd(*user, groups)
-				check(err)
-
-				// !!!!!!!!! May need to add a slight delay here to avoid race condition of creating user and
-				// then creating directory for ssh keys using the home directory since I am using an exec in the above code !!!!!!!!!!
-
-				// Create the .ssh directory with only the users accessible permissions then
-				// put the ssh key in the directory(which should allow the user to ssh in)
-				sshDir := "/home/" + user.ID + "/.ssh"
-
-				fmt.Printf("Creating directory: %s\n", sshDir)
-
-				err = os.Mkdir(sshDir, 0700)
-				check(err)
-
-				fmt.Printf("Changing owner for: %s to %s\n", sshDir, user.ID)
-
-				groupID, err := getGIDByGroupName(user.ID)
-				check(err)
-
-				userID, err := getUIDByUserName(user.ID)
-				check(err)
-
-				err = os.Chown(sshDir, userID, groupID)
-				check(err)
-
-				if len(user.SSHkeys) > 0 {
-					err = createAuthorizedKeyFile(*user, sshDir)
-					check(err)
-				}
-
-			} else {
-				fmt.Printf("User %s with groups: %v in leveldb with key: %s already exists.\n", user.ID, byteArrayToUserGroup(data).Groups, key)
-			}
+	// the extrausers files only hold what leveldb tracks, so anything else in them is dropped
+	if fileAccounts, ok := accounts.(FileAccounts); ok && fileAccounts.extraUsers() {
+		err = fileAccounts.regenerate(db)
+		if err != nil {
+			recordFailure("accounts", rootPath(fileAccounts.Dir), err)
 		}
 	}
 
-	// Loop thru all the records in leveldb with the user prefix and see if they exist in the mUser map.
-	// Any that exist in leveldb but not in the map should be removed.
-	// If the user exists in both the map and leveldb,
-	// - check the groups to make sure we didn't add or remove the user from a group
-	// - check the ssh keys to see if they have chnaged
-	iter := db.NewIterator(util.BytesPrefix([]byte("user@")), nil)
-	for iter.Next() {
-		// if the user is not in our map we created above
-		if mUser[string(iter.Key())] == "" {
-			fmt.Printf("User %s is missing. Deleting user in leveldb.\n", string(iter.Key()))
-			err = db.Delete([]byte(iter.Key()), nil)
-			check(err)
-
-			// parse out the user
-			user, err := parseUserKey(string(iter.Key()))
-			check(err)
-
-			userDelete(user)
-		} else {
-			// User Group functionality
-
-			// Convert groups in leveldb to the existing groups
-			existingDBGroups := byteArrayToUserGroup(iter.Value()).Groups
-
-			// parse out the user
-			user, err := parseUserKey(string(iter.Key()))
-			check(err)
-
-			// Pull groups from map created above
-			newMapGroups := mUserGroups[user]
-
-			// check for groups to remove
-			groupsToRemove := make([]string, 0)
-			for _, existingDBGroup := range existingDBGroups {
-				groupExists := contains(newMapGroups, existingDBGroup)
-				if !groupExists {
-					fmt.Printf("Group %s is being removed from %s.\n", existingDBGroup, user)
-
-					// add group to the remove group slice
-					groupsToRemove = append(groupsToRemove, existingDBGroup)
-
-					// remove the group from the users profile on the machine
-					err = removeGroupFromUser(user, existingDBGroup)
-					check(err)
-				}
-			}
-			// check for groups to add
-			groupsToAdd := make([]string, 0)
-			for _, newMapGroup := range newMapGroups {
-				groupExists := contains(existingDBGroups, newMapGroup)
-				if !groupExists {
-					fmt.Printf("Group %s is being added to %s.\n", newMapGroup, user)
-
-					// add group to the add group slice
-					groupsToAdd = append(groupsToAdd, newMapGroup)
-
-					// add the group to the users profile on the machine
-					err = addGroupToUser(user, newMapGroup)
-					check(err)
-				}
-			}
-
-			// User SSH functionality
-
-			// Convert existing ssh keys in leveldb to the existing SSHKeys
-			existingSSHKeys := byteArrayToUserGroup(iter.Value()).SSHKeys
-
-			// Pull ssh keys from map created above
-			newMapSSHKeys := mUserSSHKeys[string(iter.Key())]
-
-			// check for groups to remove
-			sshKeysToRemove := make([]string, 0)
-			for _, existingSSHKey := range existingSSHKeys {
-				keyExists := contains(newMapSSHKeys, existingSSHKey)
-				if !keyExists {
-					fmt.Printf("Key %s is being removed from %s.\n", existingSSHKey, user)
-
-					// add group to the remove group slice
-					sshKeysToRemove = append(sshKeysToRemove, existingSSHKey)
-				}
-			}
-
-			sshKeysToAdd := make([]string, 0)
-			for _, newMapSSHKey := range newMapSSHKeys {
-				keyExists := contains(existingSSHKeys, newMapSSHKey)
-				if !keyExists {
-					fmt.Printf("Group %s is being added to %s.\n", newMapSSHKey, user)
-
-					// add group to the add group slice
-					sshKeysToAdd = append(sshKeysToAdd, newMapSSHKey)
-				}
-			}
-
-			// fmt.Printf("groupsToAdd: %d\n", len(groupsToAdd))
-			// fmt.Printf("groupsToRemove: %d\n", len(groupsToRemove))
-			// fmt.Printf("sshKeysToAdd: %d\n", len(sshKeysToAdd))
-			// fmt.Printf("sshKeysToRemove: %d\n", len(sshKeysToRemove))
-
-			// Update LevelDB
-
-			if len(sshKeysToAdd) > 0 || len(sshKeysToRemove) > 0 || len(groupsToAdd) > 0 || len(groupsToRemove) > 0 {
-				// convert the current groups from a byte array to a UserGroup Struct
-				userGroup := byteArrayToUserGroup(iter.Value())
-
-				if len(groupsToAdd) > 0 || len(groupsToRemove) > 0 {
-					// Adjust the groups
-
-					updatedGroups := adjustSlice(groupsToAdd, groupsToRemove, existingDBGroups)
-
-					fmt.Println("****************BEFORE*******************")
-					fmt.Printf("Level(groups): %v\n", existingDBGroups)
-					fmt.Printf("Map(groups): %v\n", newMapGroups)
-					fmt.Println("****************AFTER*******************")
-					fmt.Printf("Current Groups: %v\n", userGroup.Groups)
-					fmt.Printf("Updated Groups: %v\n", updatedGroups)
-
-					userGroup.Groups = updatedGroups
-				}
-
-				if len(sshKeysToAdd) > 0 || len(sshKeysToRemove) > 0 {
-					// Adjust the keys
-					updatedSSHKeys := adjustSlice(sshKeysToAdd, sshKeysToRemove, existingSSHKeys)
-
-					fmt.Println("****************BEFORE*******************")
-					fmt.Printf("Level(keys): %v\n", existingSSHKeys)
-					fmt.Printf("Map(keys): %v\n", newMapSSHKeys)
-					fmt.Println("****************AFTER*******************")
-					fmt.Printf("Current Keys: %v\n", userGroup.SSHKeys)
-					fmt.Printf("Updated Keys: %v\n", updatedSSHKeys)
-
-					// Update the authorized Keys
-					updateAuthorizedKeyFile(user, updatedSSHKeys)
-
-					userGroup.SSHKeys = updatedSSHKeys
-				}
-
-				// convert it back to a byte array
-				bArray := userGroupToByteArray(*userGroup)
-
-				// update leveldb with the new groups
-				err = db.Put(iter.Key(), bArray, nil)
-				check(err)
-			}
+	// archives of home directories are only kept for the retention period
+	if removalPolicy == removalArchive && archiveRetention > 0 {
+		pruned, err := pruneArchives(rootPath(archiveDirectory), archiveRetention, time.Now())
+		for _, archive := range pruned {
+			fmt.Printf("Removed archive %s, older than %s\n", archive, archiveRetention)
 		}
-	}
-	iter.Release()
-	err = iter.Error()
-
-	// Loop thru all the records in leveldb with the group prefix and see if they exist in the mGroup map.
-	// Any that exist in leveldb but not in the map should be removed.
-	iter = db.NewIterator(util.BytesPrefix([]byte("group@")), nil)
-	for iter.Next() {
-		//fmt.Printf("%s\n", mGroup[string(iter.Key())])
-		if mGroup[string(iter.Key())] == "" {
-			fmt.Printf("Group %s is missing. Deleting group in leveldb.\n", string(iter.Key()))
-			err = db.Delete([]byte(iter.Key()), nil)
-			check(err)
-			err = groupDelete(string(iter.Value()))
-			check(err)
+		if err != nil {
+			recordFailure("archive", rootPath(archiveDirectory), err)
 		}
 	}
-	iter.Release()
-	err = iter.Error()
 
 	if len(sudoGroups) > 0 {
 		deleteSudoersFiles()
 		if delete == false {
 			splitSudoGrps := strings.Split(sudoGroups, ",")
 			for _, sudoGrp := range splitSudoGrps {
-				addGroupToSudoers(sudoGrp)
+				err = addGroupToSudoers(sudoGrp)
+				if err != nil {
+					recordFailure("group", sudoGrp, err)
+				}
 			}
 		}
 	}
+	// write the ca keys of the bundle for sshd's TrustedUserCAKeys, removing them in delete mode
+	caKeys, err := loadCAKeys(workDirectory)
+	if err != nil {
+		recordFailure("ca", caKeysFile, err)
+	} else {
+		if delete == true {
+			caKeys = nil
+		}
+		caKeys, keyProblems := normalizeCAKeys(caKeys, keyPolicy)
+		for _, problem := range keyProblems {
+			recordWarning("ca", caKeysFile, problem)
+		}
+		err = syncCAKeys(db, caKeysFile, caKeys)
+		if err != nil {
+			recordFailure("ca", caKeysFile, err)
+		}
+	}
+
 	if removefiles == true {
 		// Remove working directory from possible prying eyes
 		err = os.RemoveAll(workDirectory)
 		check(err)
 	}
+
+	// serve the keys to sshd's AuthorizedKeysCommand
+	err = publishAuthorizedKeys(db, keyStoreDirectory)
+	if err != nil {
+		recordFailure("key store", keyStoreDirectory, err)
+	}
+
+	if manifest != nil {
+		fmt.Printf("Applied bundle serial %d created %s\n", manifest.Serial, manifest.Created.Format(time.RFC3339))
+		err = putAppliedSerial(db, manifest.Serial)
+		check(err)
+	}
+
+	if len(warnings) > 0 {
+		fmt.Print(warningSummary(warnings))
+	}
+
+	// List everything that failed and exit non zero so cron or the provisioner notices.
+	// os.Exit skips the deferred close, so close leveldb first.
+	if len(failures) > 0 {
+		fmt.Print(failureSummary(failures))
+		db.Close()
+		os.Exit(2)
+	}
 }
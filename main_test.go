@@ -7,8 +7,10 @@ import (
 	"os"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
 )
 
 var isSudo bool
@@ -53,7 +55,7 @@ func TestGetUIDByUserNameFail(t *testing.T) {
 
 // userGroupToByteArray
 func TestUserGroupByteArrayPass(t *testing.T) {
-	userGroupIn := UserGroup{[]string{"a", "b", "c"}, []string{"M", "N", "O"}, "user1", "shell1"}
+	userGroupIn := UserGroup{[]string{"a", "b", "c"}, []string{"M", "N", "O"}, "user1", "shell1", []string{"bob"}, time.Time{}, false, ""}
 
 	byteArray := userGroupToByteArray(userGroupIn)
 
@@ -63,6 +65,76 @@ func TestUserGroupByteArrayPass(t *testing.T) {
 	assert.Equal(t, userGroupOut.SSHKeys, []string{"M", "N", "O"})
 	assert.Equal(t, userGroupOut.ID, "user1")
 	assert.Equal(t, userGroupOut.Shell, "shell1")
+	assert.Equal(t, userGroupOut.Principals, []string{"bob"})
+}
+
+// userExists
+func TestUserExistsPass(t *testing.T) {
+	result, err := userExists("root")
+	assert.Nil(t, err)
+	assert.Equal(t, result, true)
+}
+
+func TestUserExistsFail(t *testing.T) {
+	result, err := userExists("thiswillfail")
+	assert.Nil(t, err)
+	assert.Equal(t, result, false)
+}
+
+// failureSummary
+func TestFailureSummary(t *testing.T) {
+	failures := []SyncFailure{
+		{"group", "admins", errors.New("exit status 9: groupadd: group 'admins' already exists\n")},
+		{"user", "bob", errors.New("invalid character '}' looking for beginning of object key string")},
+	}
+	result := failureSummary(failures)
+	expected := "2 user(s)/group(s) failed to sync:\n" +
+		"  group admins: exit status 9: groupadd: group 'admins' already exists\n\n" +
+		"  user bob: invalid character '}' looking for beginning of object key string\n"
+	assert.Equal(t, result, expected)
+}
+
+// warningSummary
+func TestWarningSummary(t *testing.T) {
+	warnings := []SyncWarning{
+		{"user", "bob", `Invalid ssh key "ssh_key1": ssh: no key found`},
+	}
+	result := warningSummary(warnings)
+	expected := "1 warning(s):\n" +
+		"  user bob: Invalid ssh key \"ssh_key1\": ssh: no key found\n"
+	assert.Equal(t, result, expected)
+}
+
+// idFromFileName
+func TestIDFromFileName(t *testing.T) {
+	assert.Equal(t, idFromFileName("bob.json"), "bob")
+	assert.Equal(t, idFromFileName("bob.yml"), "bob")
+	assert.Equal(t, idFromFileName("bob.toml"), "bob")
+	assert.Equal(t, idFromFileName("bob"), "bob")
+}
+
+// parseCommandArgs
+func TestParseCommandArgsPass(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	output := flags.String("o", "", "")
+	signKey := flags.String("signkey", "", "")
+
+	arg, err := parseCommandArgs(flags, []string{"-signkey", "key", "bundledir", "-o", "out.tgz"})
+	assert.Nil(t, err)
+	assert.Equal(t, arg, "bundledir")
+	assert.Equal(t, *output, "out.tgz")
+	assert.Equal(t, *signKey, "key")
+}
+
+func TestParseCommandArgsFail(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+
+	_, err := parseCommandArgs(flags, []string{})
+	assert.Equal(t, err, errors.New("Missing argument"))
+
+	_, err = parseCommandArgs(flags, []string{"one", "two"})
+	assert.Equal(t, err, errors.New("Too many arguments"))
 }
 
 // createWorkingDirectory
@@ -144,6 +216,72 @@ func TestGetUserFail(t *testing.T) {
 	assert.Nil(t, result)
 }
 
+// loadUsers
+func TestLoadUsers(t *testing.T) {
+	dir := testBundleDir(t, map[string]string{
+		"users/alice.yaml": "id: alice\nshell: /bin/sh\nssh_keys: []\n",
+		"users/bob.json":   `{"id":"bob","shell":"/bin/sh","ssh_keys":[]}`,
+		"users/bob.toml":   "id = \"bob\"\nshell = \"/bin/zsh\"\nssh_keys = []\n",
+		"users/carl.json":  `{"id":"carl",`,
+		"users/notes.txt":  `skipped`,
+	})
+	defer os.RemoveAll(dir)
+
+	users, failures, err := loadUsers(dir + "/users")
+	assert.Nil(t, err)
+	assert.Equal(t, []ArgoUser{{SSHkeys: []SSHKey{}, ID: "alice", Shell: "/bin/sh"}}, users)
+	assert.Equal(t, len(failures), 2)
+	assert.Equal(t, failures[0].ID, "carl")
+	assert.Equal(t, failures[0].Err.Error(), "unexpected EOF")
+	assert.Equal(t, failures[1].ID, "bob")
+	assert.Equal(t, failures[1].Err.Error(), "User bob is defined more than once: bob.json, bob.toml")
+}
+
+// loadGroups
+func TestLoadGroups(t *testing.T) {
+	dir := testBundleDir(t, map[string]string{
+		"groups/devs.yml":  "id: devs\nusers: [bob]\nadmins: []\n",
+		"groups/ops.json":  `{"id":"ops","users":[],"admins":[]}`,
+		"groups/ops2.toml": "id = \"ops\"\nusers = []\nadmins = []\n",
+	})
+	defer os.RemoveAll(dir)
+
+	groups, failures, err := loadGroups(dir + "/groups")
+	assert.Nil(t, err)
+	assert.Equal(t, []ArgoGroup{{"devs", []string{"bob"}, []string{}}}, groups)
+	assert.Equal(t, len(failures), 1)
+	assert.Equal(t, failures[0].Err.Error(), "Group ops is defined more than once: ops.json, ops2.toml")
+}
+
+func TestLoadGroupsMissingDir(t *testing.T) {
+	_, _, err := loadGroups("/tmp/thiswillfail/groups")
+	assert.NotNil(t, err)
+}
+
+// checkUsers
+func TestCheckUsers(t *testing.T) {
+	users, failures := checkUsers([]ArgoUser{
+		{ID: "bob", Shell: "/bin/sh"},
+		{ID: "../root", Shell: "/bin/sh"},
+		{ID: "eve", Shell: "/bin/sh:x"},
+	})
+	assert.Equal(t, []ArgoUser{{ID: "bob", Shell: "/bin/sh"}}, users)
+	assert.Equal(t, len(failures), 2)
+	assert.Equal(t, failures[0].ID, "../root")
+	assert.Equal(t, failures[0].Err.Error(), "Id \"../root\" is not a valid user or group name")
+	assert.Equal(t, failures[1].ID, "eve")
+	assert.Equal(t, failures[1].Err.Error(), "Shell \"/bin/sh:x\" contains ':' or a newline")
+}
+
+// checkGroups
+func TestCheckGroups(t *testing.T) {
+	groups, failures := checkGroups([]ArgoGroup{{ID: "devs"}, {ID: "dev ops"}})
+	assert.Equal(t, []ArgoGroup{{ID: "devs"}}, groups)
+	assert.Equal(t, len(failures), 1)
+	assert.Equal(t, failures[0].Kind, "group")
+	assert.Equal(t, failures[0].Err.Error(), "Id \"dev ops\" is not a valid user or group name")
+}
+
 // contains
 func TestDoesContain(t *testing.T) {
 	test := []string{"hello", "world"}
@@ -163,6 +301,29 @@ func TestDoesNotContainFail(t *testing.T) {
 	assert.Equal(t, result, false)
 }
 
+// getAppliedSerial / putAppliedSerial
+func TestAppliedSerial(t *testing.T) {
+	dir, err := ioutil.TempDir("", "argo-lyte-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := leveldb.OpenFile(dir, nil)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	serial, ok, err := getAppliedSerial(db)
+	assert.Nil(t, err)
+	assert.Equal(t, ok, false)
+	assert.Equal(t, serial, uint64(0))
+
+	assert.Nil(t, putAppliedSerial(db, 1760000000))
+
+	serial, ok, err = getAppliedSerial(db)
+	assert.Nil(t, err)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, serial, uint64(1760000000))
+}
+
 // parseUserKey
 func TestParseUserKeyPass(t *testing.T) {
 	userKey := "user@12345"
@@ -221,7 +382,7 @@ func TestAddGroup2(t *testing.T) {
 
 // userAdd
 func TestAddUser(t *testing.T) {
-	user := ArgoUser{[]string{"testkey"}, "justauserid", "/bin/bash"}
+	user := ArgoUser{SSHkeys: []SSHKey{{Key: "testkey"}}, ID: "justauserid", Shell: "/bin/bash"}
 	if isSudo {
 		err := userAdd(user, []string{"justatestgroup"})
 		assert.Nil(t, err)
@@ -249,13 +410,13 @@ func TestAddUserToGroup(t *testing.T) {
 // createAuthorizedKeyFile
 func TestAddAuthorizedKey(t *testing.T) {
 	dir := "/home/justauserid"
-	user := ArgoUser{[]string{"testkey"}, "justauserid", "/bin/bash"}
+	user := ArgoUser{SSHkeys: []SSHKey{{Key: "testkey"}}, ID: "justauserid", Shell: "/bin/bash"}
 	if isSudo {
-		err := createAuthorizedKeyFile(user, dir)
+		err := createAuthorizedKeyFile(ShadowAccounts{}, user, dir)
 		assert.Nil(t, err)
 	} else {
-		err := createAuthorizedKeyFile(user, dir)
-		errString := "open /home/justauserid/authorized_keys: no such file or directory"
+		err := createAuthorizedKeyFile(ShadowAccounts{}, user, dir)
+		errString := "user: unknown user justauserid"
 		assert.Equal(t, err.Error(), errString)
 	}
 }
@@ -281,7 +442,7 @@ func TestDeleteSudoersFile(t *testing.T) {
 // deleteAuthorizedKeyFile
 func TestDeleteAuthorizedKey(t *testing.T) {
 	dir := "/home/justauserid"
-	user := ArgoUser{[]string{"testkey"}, "justauserid", "/bin/bash"}
+	user := ArgoUser{SSHkeys: []SSHKey{{Key: "testkey"}}, ID: "justauserid", Shell: "/bin/bash"}
 	if isSudo {
 		err := deleteAuthorizedKeyFile(user, dir)
 		assert.Nil(t, err)
@@ -310,10 +471,10 @@ func TestRemoveUserToGroup(t *testing.T) {
 func TestDeleteUser(t *testing.T) {
 	user := "justauserid"
 	if isSudo {
-		err := userDelete(user)
+		err := userDelete(user, true)
 		assert.Nil(t, err)
 	} else {
-		err := userDelete(user)
+		err := userDelete(user, true)
 		errString := "exit status 6: userdel: user 'justauserid' does not exist\n"
 		assert.Equal(t, err.Error(), errString)
 	}
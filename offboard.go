@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Tested
+// Lock a user that left the bundle and take away its access: its groups, and with them sudo, its ssh keys and its principals.
+// The record follows what is left on the machine, so whatever fails is retried on the next run of the grace period,
+// and a user back in the bundle gets its groups, keys and principals back from the bundle like any other change.
+func offboardUser(accounts AccountManager, userName string, userGroup *UserGroup) {
+	if userGroup.LockedAt.IsZero() {
+		// the sessions are ended first, so a logged in user loses access now rather than when it logs out
+		err := terminateUserSessions(accounts, userName)
+		if err != nil {
+			recordFailure("user", userName, err)
+		}
+		err = accounts.UserLock(userName)
+		if err != nil {
+			recordFailure("user", userName, err)
+			return
+		}
+		userGroup.LockedAt = time.Now()
+		fmt.Printf("User %s is missing. Locked it until %s.\n", userName, userGroup.LockedAt.Add(lockGrace).Format(time.RFC3339))
+	}
+
+	groups := make([]string, 0)
+	for _, group := range userGroup.Groups {
+		err := accounts.RemoveGroupFromUser(userName, group)
+		if err != nil {
+			recordFailure("user", userName, err)
+			groups = append(groups, group)
+		}
+	}
+	userGroup.Groups = groups
+
+	if len(userGroup.SSHKeys) > 0 {
+		// the key store is published from the records, so only the files need emptying
+		var err error
+		if writeKeyFiles {
+			err = updateAuthorizedKeyFile(accounts, userName, nil)
+		}
+		if err != nil {
+			recordFailure("user", userName, err)
+		} else {
+			fmt.Printf("Removed the ssh keys of %s.\n", userName)
+			userGroup.SSHKeys = nil
+		}
+	}
+
+	if len(userGroup.Principals) > 0 {
+		err := deletePrincipalsFile(principalsDir, userName)
+		if err != nil {
+			recordFailure("user", userName, err)
+		} else {
+			userGroup.Principals = nil
+		}
+	}
+}
+
+// Tested
+// Check a locked user's grace period is over, so it can be deleted
+func offboardingDone(userGroup *UserGroup, now time.Time) bool {
+	return !userGroup.LockedAt.IsZero() && now.Sub(userGroup.LockedAt) >= lockGrace
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// offboardUser
+func TestOffboardUser(t *testing.T) {
+	_, cleanup := testReconcileSetup(t)
+	defer cleanup()
+	lockGrace = time.Hour
+
+	accounts := newFakeAccounts()
+	accounts.groups["admins"] = true
+	accounts.users["bob"] = []string{"admins"}
+
+	// nothing changes when the lock fails
+	accounts.fail["usermod --lock bob"] = errors.New("usermod: cannot lock /etc/passwd")
+	userGroup := &UserGroup{ID: "bob", Groups: []string{"admins"}, SSHKeys: []string{"ssh-ed25519 AAAA"}}
+	offboardUser(accounts, "bob", userGroup)
+	assert.Equal(t, len(failures), 1)
+	assert.True(t, userGroup.LockedAt.IsZero())
+	assert.Equal(t, userGroup.Groups, []string{"admins"})
+
+	failures = nil
+	accounts.calls = nil
+	accounts.fail = map[string]error{}
+	offboardUser(accounts, "bob", userGroup)
+	assert.Equal(t, len(failures), 0)
+	assert.Equal(t, accounts.calls, []string{"usermod --lock bob", "gpasswd bob admins"})
+	assert.False(t, userGroup.LockedAt.IsZero())
+	assert.Equal(t, len(userGroup.Groups), 0)
+	assert.Nil(t, userGroup.SSHKeys)
+
+	// a locked user isn't locked again
+	accounts.calls = nil
+	offboardUser(accounts, "bob", userGroup)
+	assert.Equal(t, len(accounts.calls), 0)
+}
+
+// offboardingDone
+func TestOffboardingDone(t *testing.T) {
+	lockGrace = time.Hour
+	defer func() { lockGrace = 0 }()
+
+	now := time.Now()
+	assert.False(t, offboardingDone(&UserGroup{}, now))
+	assert.False(t, offboardingDone(&UserGroup{LockedAt: now.Add(-time.Minute)}, now))
+	assert.True(t, offboardingDone(&UserGroup{LockedAt: now.Add(-time.Hour)}, now))
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Tested
+// Write a directory or file entry with zeroed times and owners so packing the same files gives the same tarball
+func writeTarEntry(tw *tar.Writer, name string, data []byte, isDir bool) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		ModTime: time.Unix(0, 0),
+		Format:  tar.FormatUSTAR,
+	}
+	if isDir {
+		header.Typeflag = tar.TypeDir
+		header.Mode = 0755
+	} else {
+		header.Typeflag = tar.TypeReg
+		header.Size = int64(len(data))
+	}
+
+	err := tw.WriteHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+// Tested
+// Write the users and groups of a bundle directory into a gzipped tarball with a manifest of their digests.
+// The manifest is signed when a signer is passed in.
+func packBundle(dir string, output string, signer ssh.Signer, serial uint64, created time.Time) error {
+	manifest, err := buildManifest(dir, serial, created)
+	if err != nil {
+		return err
+	}
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	manifestData = append(manifestData, '\n')
+
+	files, err := bundleFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Creating bundle: %s\n", output)
+
+	f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	err = writeTarEntry(tw, manifestFile, manifestData, false)
+	if err != nil {
+		return err
+	}
+
+	if signer != nil {
+		signatureData, err := signManifest(manifestData, signer)
+		if err != nil {
+			return err
+		}
+		err = writeTarEntry(tw, manifestSignatureFile, signatureData, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	subDirs := []string{"groups/", "users/"}
+	for _, file := range files {
+		if strings.HasPrefix(file, caKeysDir+"/") {
+			subDirs = append([]string{caKeysDir + "/"}, subDirs...)
+			break
+		}
+	}
+	for _, subDir := range subDirs {
+		err = writeTarEntry(tw, subDir, nil, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, file := range files {
+		fmt.Printf("Adding file: %s\n", file)
+		data, err := ioutil.ReadFile(dir + "/" + file)
+		if err != nil {
+			return err
+		}
+		err = writeTarEntry(tw, file, data, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	err = gz.Close()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Not testable
+// pack command: validate a bundle directory and write the tarball the sync downloads from -userurl
+func packCommand(args []string) int {
+	flags := flag.NewFlagSet("pack", flag.ContinueOnError)
+	output := flags.String("o", "bundle.tgz", "bundle file to write")
+	signKey := flags.String("signkey", "", "unencrypted ssh private key to sign the manifest with")
+	serial := flags.Uint64("serial", 0, "bundle serial, must increase with every bundle (default the creation time in unix seconds)")
+
+	dir, err := parseCommandArgs(flags, args)
+	if err != nil {
+		return 1
+	}
+
+	problems := validateBundleDir(dir)
+	if len(problems) > 0 {
+		fmt.Printf("%d problem(s) found in %s:\n", len(problems), dir)
+		for _, problem := range problems {
+			fmt.Printf("  %s\n", problem.Error())
+		}
+		return 1
+	}
+
+	var signer ssh.Signer
+	if *signKey != "" {
+		keyData, err := ioutil.ReadFile(*signKey)
+		if err != nil {
+			fmt.Println(err.Error())
+			return 1
+		}
+		signer, err = ssh.ParsePrivateKey(keyData)
+		if err != nil {
+			fmt.Println(err.Error())
+			return 1
+		}
+	}
+
+	// SOURCE_DATE_EPOCH pins the creation time for reproducible bundles
+	created := time.Now()
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		seconds, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			fmt.Printf("Invalid SOURCE_DATE_EPOCH: %s\n", epoch)
+			return 1
+		}
+		created = time.Unix(seconds, 0)
+	}
+	if *serial == 0 {
+		*serial = uint64(created.Unix())
+	}
+
+	err = packBundle(dir, *output, signer, *serial, created)
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Remove(*output)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// writeTarEntry
+func TestWriteTarEntry(t *testing.T) {
+	var buffer bytes.Buffer
+	tw := tar.NewWriter(&buffer)
+	assert.Nil(t, writeTarEntry(tw, "users/bob.json", []byte(`{"id":"bob"}`), false))
+	assert.Nil(t, tw.Close())
+
+	header, err := tar.NewReader(&buffer).Next()
+	assert.Nil(t, err)
+	assert.Equal(t, header.Name, "users/bob.json")
+	assert.Equal(t, header.Size, int64(12))
+	assert.Equal(t, header.ModTime.Unix(), int64(0))
+	assert.Equal(t, header.Uid, 0)
+	assert.Equal(t, header.Uname, "")
+}
+
+// packBundle
+func TestPackBundlePass(t *testing.T) {
+	dir := testBundleDir(t, map[string]string{
+		"users/bob.json":   `{"id":"bob","shell":"/bin/sh","ssh_keys":[]}`,
+		"groups/devs.json": `{"id":"devs","users":["bob"],"admins":[]}`,
+	})
+	defer os.RemoveAll(dir)
+
+	output := dir + "/bundle.tgz"
+	err := packBundle(dir, output, nil, 7, testTime(2026))
+	assert.Nil(t, err)
+
+	extractDir, err := ioutil.TempDir("", "argo-lyte-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(extractDir)
+
+	err = extractBundle(output, extractDir)
+	assert.Nil(t, err)
+
+	manifest, err := readManifest(extractDir)
+	assert.Nil(t, err)
+	assert.Equal(t, manifest.Serial, uint64(7))
+	assert.Equal(t, manifest.Created, testTime(2026))
+	assert.Equal(t, len(manifest.Files), 2)
+	assert.Equal(t, len(verifyManifest(extractDir, manifest)), 0)
+	assert.Equal(t, len(validateBundleDir(extractDir)), 0)
+
+	_, err = os.Stat(extractDir + "/" + manifestSignatureFile)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestPackBundleCA(t *testing.T) {
+	dir := testBundleDir(t, map[string]string{
+		"users/bob.json": `{"id":"bob","shell":"/bin/sh","ssh_keys":[],"principals":["bob"]}`,
+	})
+	defer os.RemoveAll(dir)
+
+	caKey := testSSHKey(t, "prod-ca")
+	assert.Nil(t, os.Mkdir(dir+"/ca", 0700))
+	assert.Nil(t, ioutil.WriteFile(dir+"/ca/prod.pub", []byte(caKey+"\n"), 0600))
+
+	output := dir + "/bundle.tgz"
+	assert.Nil(t, packBundle(dir, output, nil, 7, testTime(2026)))
+
+	extractDir, err := ioutil.TempDir("", "argo-lyte-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(extractDir)
+	assert.Nil(t, extractBundle(output, extractDir))
+
+	manifest, err := readManifest(extractDir)
+	assert.Nil(t, err)
+	assert.Equal(t, len(manifest.Files), 2)
+	assert.Equal(t, len(validateBundleDir(extractDir)), 0)
+
+	caKeys, err := loadCAKeys(extractDir)
+	assert.Nil(t, err)
+	assert.Equal(t, caKeys, []string{caKey})
+}
+
+func TestPackBundleDeterministic(t *testing.T) {
+	dir := testBundleDir(t, map[string]string{
+		"users/bob.json":   `{"id":"bob","shell":"/bin/sh","ssh_keys":[]}`,
+		"users/alice.json": `{"id":"alice","shell":"/bin/sh","ssh_keys":[]}`,
+		"groups/devs.json": `{"id":"devs","users":["bob","alice"],"admins":[]}`,
+	})
+	defer os.RemoveAll(dir)
+
+	assert.Nil(t, packBundle(dir, dir+"/first.tgz", nil, 7, testTime(2026)))
+	// touching a file doesn't change the bundle
+	assert.Nil(t, os.Chtimes(dir+"/users/bob.json", testTime(2020), testTime(2020)))
+	assert.Nil(t, packBundle(dir, dir+"/second.tgz", nil, 7, testTime(2026)))
+
+	first, err := ioutil.ReadFile(dir + "/first.tgz")
+	assert.Nil(t, err)
+	second, err := ioutil.ReadFile(dir + "/second.tgz")
+	assert.Nil(t, err)
+	assert.Equal(t, first, second)
+}
+
+func TestPackBundleSigned(t *testing.T) {
+	dir := testBundleDir(t, map[string]string{
+		"users/bob.json": `{"id":"bob","shell":"/bin/sh","ssh_keys":[]}`,
+	})
+	defer os.RemoveAll(dir)
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	assert.Nil(t, err)
+
+	output := dir + "/bundle.tgz"
+	assert.Nil(t, packBundle(dir, output, signer, 7, testTime(2026)))
+
+	extractDir, err := ioutil.TempDir("", "argo-lyte-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(extractDir)
+	assert.Nil(t, extractBundle(output, extractDir))
+
+	pubKeyFile := dir + "/signing.pub"
+	assert.Nil(t, ioutil.WriteFile(pubKeyFile, ssh.MarshalAuthorizedKey(signer.PublicKey()), 0600))
+	assert.Nil(t, validateBundleSignature(extractDir, pubKeyFile))
+
+	// a different key doesn't verify
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	otherSigner, err := ssh.NewSignerFromKey(otherKey)
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(pubKeyFile, ssh.MarshalAuthorizedKey(otherSigner.PublicKey()), 0600))
+	assert.Equal(t, validateBundleSignature(extractDir, pubKeyFile).Error(), "manifest.sig: ssh: signature did not verify")
+}
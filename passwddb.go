@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long to wait for the passwd database while another process, useradd or an admin's vipw, has it locked
+var passwdLockWait = 15 * time.Second
+
+// The files of the passwd database, in the order they are written. The shadow files are optional.
+var passwdFiles = []string{"group", "gshadow", "passwd", "shadow"}
+
+// The mode of the files created for a passwd database that starts out empty. libnss-extrausers has no gshadow.
+var passwdFileModes = map[string]os.FileMode{"group": 0644, "passwd": 0644, "shadow": 0640}
+
+// The lock lckpwdf(3) takes for the whole passwd database
+const passwdDatabaseLock = "/etc/.pwd.lock"
+
+// accountFile - a passwd, group, shadow or gshadow file as its lines, so lines argo-lyte
+// doesn't touch (comments, NIS + entries, ...) are written back as they were
+type accountFile struct {
+	path    string
+	lines   []string
+	missing bool
+	changed bool
+	// the mode a missing file is created with, 0 to leave it missing
+	create os.FileMode
+}
+
+// Tested
+// Read a passwd database file. A missing file is empty.
+func readAccountFile(path string) (*accountFile, error) {
+	file := &accountFile{path: path, lines: make([]string, 0)}
+	data, err := readRegularFile(path, -1)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		file.missing = true
+		return file, nil
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		file.lines = append(file.lines, scanner.Text())
+	}
+	return file, scanner.Err()
+}
+
+// Tested
+// Get the index of the line of an entry, -1 when it isn't in the file
+func (f *accountFile) find(name string) int {
+	for i, line := range f.lines {
+		if strings.SplitN(line, ":", 2)[0] == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Tested
+// Get the fields of an entry, nil when it isn't in the file
+func (f *accountFile) entry(name string) []string {
+	i := f.find(name)
+	if i < 0 {
+		return nil
+	}
+	return strings.Split(f.lines[i], ":")
+}
+
+// Tested
+// Get the fields of every entry of the file
+func (f *accountFile) entries() [][]string {
+	entries := make([][]string, 0)
+	for _, line := range f.lines {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, strings.Split(line, ":"))
+	}
+	return entries
+}
+
+// Tested
+// Replace an entry, or add it at the end of the file
+func (f *accountFile) set(fields []string) {
+	line := strings.Join(fields, ":")
+	f.changed = true
+	if i := f.find(fields[0]); i >= 0 {
+		f.lines[i] = line
+		return
+	}
+	f.lines = append(f.lines, line)
+}
+
+// Tested
+// Remove an entry. Removing an entry that isn't in the file does nothing.
+func (f *accountFile) remove(name string) {
+	i := f.find(name)
+	if i < 0 {
+		return
+	}
+	f.lines = append(f.lines[:i], f.lines[i+1:]...)
+	f.changed = true
+}
+
+// Tested
+// Write the file back if it changed. The previous file is kept as <file>- like shadow-utils does,
+// and the new one keeps its mode and owner. A missing file is only created when it has a mode to be created with.
+func (f *accountFile) save() error {
+	if !f.changed || (f.missing && f.create == 0) {
+		return nil
+	}
+
+	data := strings.Join(f.lines, "\n")
+	if len(f.lines) > 0 {
+		data += "\n"
+	}
+	if f.missing {
+		return writeFileAtomic(f.path, []byte(data), f.create, -1, -1)
+	}
+
+	fi, err := os.Lstat(f.path)
+	if err != nil {
+		return err
+	}
+	uid, gid, ok := fileOwner(fi)
+	if !ok {
+		uid, gid = -1, -1
+	}
+
+	previous, err := readRegularFile(f.path, -1)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(f.path+"-", previous, fi.Mode().Perm(), uid, gid)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(f.path, []byte(data), fi.Mode().Perm(), uid, gid)
+}
+
+// Tested
+// Lock a passwd database file the way shadow-utils does: a file holding our pid is hard linked to <file>.lock,
+// which fails while another process has the file locked. A lock left behind by a process that is gone is removed.
+func lockAccountFile(path string) error {
+	lockFile := path + ".lock"
+	pidFile := fmt.Sprintf("%s.%d", path, os.Getpid())
+	err := ioutil.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())), 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(pidFile)
+
+	deadline := time.Now().Add(passwdLockWait)
+	for {
+		err = os.Link(pidFile, lockFile)
+		if err == nil {
+			return nil
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+
+		data, err := ioutil.ReadFile(lockFile)
+		if err == nil {
+			pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+			if err == nil && pid != os.Getpid() && !processExists(pid) {
+				fmt.Printf("Removing stale lock %s of process %d\n", lockFile, pid)
+				os.Remove(lockFile)
+				continue
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Cannot lock %s; try again later", path)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Tested
+// Unlock a passwd database file locked with lockAccountFile
+func unlockAccountFile(path string) error {
+	return os.Remove(path + ".lock")
+}
+
+// passwdDatabase - the passwd, group, shadow and gshadow files, read while they are locked
+type passwdDatabase struct {
+	group   *accountFile
+	gshadow *accountFile
+	passwd  *accountFile
+	shadow  *accountFile
+}
+
+// Tested
+// Lock the passwd database of dir, read it, let change make its edits and write back the files it changed.
+// The database stays locked until every file is written, so useradd and friends never see half a change.
+// With create the database can start out empty and its files are created, otherwise passwd and group must exist.
+func updatePasswdDatabase(dir string, create bool, change func(db *passwdDatabase) error) error {
+	databaseLock, err := lockPasswdDatabase(rootPath(passwdDatabaseLock))
+	if err != nil {
+		return err
+	}
+	defer databaseLock.Close()
+
+	if create {
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	files := make([]*accountFile, 0)
+	for _, name := range passwdFiles {
+		path := dir + "/" + name
+		mode := os.FileMode(0)
+		if create {
+			mode = passwdFileModes[name]
+		}
+
+		// the shadow files are only locked when they exist or are created
+		if _, err := os.Lstat(path); err == nil || mode != 0 {
+			err = lockAccountFile(path)
+			if err != nil {
+				return err
+			}
+			defer unlockAccountFile(path)
+		}
+
+		file, err := readAccountFile(path)
+		if err != nil {
+			return err
+		}
+		file.create = mode
+		files = append(files, file)
+	}
+	if !create && (files[0].missing || files[2].missing) {
+		return fmt.Errorf("Missing %s or %s", files[0].path, files[2].path)
+	}
+
+	db := &passwdDatabase{group: files[0], gshadow: files[1], passwd: files[2], shadow: files[3]}
+	err = change(db)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		err = file.save()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Tested
+// Read the passwd database of dir without locking it, for lookups
+func readPasswdDatabase(dir string) (*passwdDatabase, error) {
+	files := make([]*accountFile, 0)
+	for _, name := range passwdFiles {
+		file, err := readAccountFile(dir + "/" + name)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return &passwdDatabase{group: files[0], gshadow: files[1], passwd: files[2], shadow: files[3]}, nil
+}
+
+// Tested
+// Read the settings of login.defs, skipping comments. A missing file has no settings.
+func readLoginDefs(path string) (map[string]string, error) {
+	defs := make(map[string]string)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return defs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		defs[fields[0]] = fields[1]
+	}
+	return defs, nil
+}
+
+// Tested
+// Get the range of ids from login.defs, UID_MIN and UID_MAX or GID_MIN and GID_MAX, with the defaults of useradd
+func loginDefsRange(defs map[string]string, prefix string) (int, int, error) {
+	limits := []int{1000, 60000}
+	for i, name := range []string{prefix + "_MIN", prefix + "_MAX"} {
+		value, ok := defs[name]
+		if !ok {
+			continue
+		}
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			return -1, -1, fmt.Errorf("Invalid %s %q in login.defs", name, value)
+		}
+		limits[i] = id
+	}
+	if limits[0] > limits[1] {
+		return -1, -1, fmt.Errorf("Invalid %s range %d-%d in login.defs", prefix, limits[0], limits[1])
+	}
+	return limits[0], limits[1], nil
+}
+
+// Tested
+// Get the ids used by the entries of a passwd or group file
+func usedIDs(file *accountFile) map[int]bool {
+	used := make(map[int]bool)
+	for _, fields := range file.entries() {
+		if len(fields) < 3 {
+			continue
+		}
+		if id, err := strconv.Atoi(fields[2]); err == nil {
+			used[id] = true
+		}
+	}
+	return used
+}
+
+// Tested
+// Pick the next free id in a range the way useradd does: one above the highest id used in the range,
+// or the lowest free one once the top of the range is taken
+func allocateID(used map[int]bool, min int, max int) (int, error) {
+	highest := min - 1
+	for id := range used {
+		if id >= min && id <= max && id > highest {
+			highest = id
+		}
+	}
+	if highest < max {
+		return highest + 1, nil
+	}
+	for id := min; id <= max; id++ {
+		if !used[id] {
+			return id, nil
+		}
+	}
+	return -1, fmt.Errorf("No free id between %d and %d", min, max)
+}
+
+// Tested
+// Add a member to the comma separated member list of a group or gshadow entry
+func addMember(fields []string, index int, member string) []string {
+	for len(fields) <= index {
+		fields = append(fields, "")
+	}
+	members := splitMembers(fields[index])
+	if !contains(members, member) {
+		members = append(members, member)
+	}
+	fields[index] = strings.Join(members, ",")
+	return fields
+}
+
+// Tested
+// Remove a member from the comma separated member list of a group or gshadow entry
+func removeMember(fields []string, index int, member string) []string {
+	if len(fields) <= index {
+		return fields
+	}
+	members := make([]string, 0)
+	for _, m := range splitMembers(fields[index]) {
+		if m != member {
+			members = append(members, m)
+		}
+	}
+	fields[index] = strings.Join(members, ",")
+	return fields
+}
+
+// Tested
+// Split a comma separated member list, an empty list has no members
+func splitMembers(list string) []string {
+	if list == "" {
+		return []string{}
+	}
+	return strings.Split(list, ",")
+}
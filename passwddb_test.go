@@ -0,0 +1,234 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readAccountFile, find, entry, entries, set, remove, save
+func TestAccountFile(t *testing.T) {
+	root, cleanup := testRootDirectory(t)
+	defer cleanup()
+
+	path := root + "/etc/group"
+	assert.Nil(t, ioutil.WriteFile(path, []byte("# local groups\nroot:x:0:\nadmins:x:1002:bob\n"), 0644))
+
+	file, err := readAccountFile(path)
+	assert.Nil(t, err)
+	assert.False(t, file.missing)
+	assert.Equal(t, file.find("admins"), 2)
+	assert.Equal(t, file.find("devs"), -1)
+	assert.Equal(t, file.entry("admins"), []string{"admins", "x", "1002", "bob"})
+	assert.Nil(t, file.entry("devs"))
+	assert.Equal(t, len(file.entries()), 2)
+
+	// nothing changed, nothing written
+	assert.Nil(t, file.save())
+	_, err = os.Stat(path + "-")
+	assert.True(t, os.IsNotExist(err))
+
+	file.set([]string{"admins", "x", "1002", "bob,alice"})
+	file.set([]string{"devs", "x", "1003", ""})
+	file.remove("root")
+	file.remove("missing")
+	assert.Nil(t, file.save())
+
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, string(data), "# local groups\nadmins:x:1002:bob,alice\ndevs:x:1003:\n")
+
+	// the previous file is kept as a backup with the same mode
+	data, err = ioutil.ReadFile(path + "-")
+	assert.Nil(t, err)
+	assert.Equal(t, string(data), "# local groups\nroot:x:0:\nadmins:x:1002:bob\n")
+	fi, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, fi.Mode().Perm(), os.FileMode(0644))
+
+	// a missing shadow file reads as empty and isn't created
+	file, err = readAccountFile(root + "/etc/gshadow")
+	assert.Nil(t, err)
+	assert.True(t, file.missing)
+	file.set([]string{"devs", "!", "", ""})
+	assert.Nil(t, file.save())
+	_, err = os.Stat(root + "/etc/gshadow")
+	assert.True(t, os.IsNotExist(err))
+}
+
+// lockAccountFile, unlockAccountFile
+func TestLockAccountFile(t *testing.T) {
+	root, cleanup := testRootDirectory(t)
+	defer cleanup()
+
+	wait := passwdLockWait
+	passwdLockWait = 200 * time.Millisecond
+	defer func() { passwdLockWait = wait }()
+
+	path := root + "/etc/passwd"
+	assert.Nil(t, lockAccountFile(path))
+	data, err := ioutil.ReadFile(path + ".lock")
+	assert.Nil(t, err)
+	assert.Equal(t, string(data), strconv.Itoa(os.Getpid()))
+
+	// a lock held by a running process waits and then fails
+	assert.Nil(t, ioutil.WriteFile(path+".lock", []byte("1"), 0600))
+	if processExists(1) {
+		assert.Equal(t, lockAccountFile(path).Error(), "Cannot lock "+path+"; try again later")
+	}
+
+	// the lock of a process that is gone is taken over
+	assert.Nil(t, ioutil.WriteFile(path+".lock", []byte("999999999"), 0600))
+	assert.Nil(t, lockAccountFile(path))
+
+	assert.Nil(t, unlockAccountFile(path))
+	_, err = os.Stat(path + ".lock")
+	assert.True(t, os.IsNotExist(err))
+
+	// the pid file is always cleaned up
+	files, err := ioutil.ReadDir(root + "/etc")
+	assert.Nil(t, err)
+	assert.Equal(t, len(files), 2)
+}
+
+// lockPasswdDatabase
+func TestLockPasswdDatabase(t *testing.T) {
+	root, cleanup := testRootDirectory(t)
+	defer cleanup()
+
+	lock, err := lockPasswdDatabase(root + "/etc/.pwd.lock")
+	assert.Nil(t, err)
+	assert.Nil(t, lock.Close())
+}
+
+// updatePasswdDatabase, readPasswdDatabase
+func TestUpdatePasswdDatabase(t *testing.T) {
+	root, cleanup := testRootDirectory(t)
+	defer cleanup()
+
+	err := updatePasswdDatabase(root+"/etc", false, func(db *passwdDatabase) error {
+		assert.True(t, db.shadow.missing)
+		db.group.set([]string{"devs", "x", "1003", ""})
+		return nil
+	})
+	assert.Nil(t, err)
+
+	db, err := readPasswdDatabase(root + "/etc")
+	assert.Nil(t, err)
+	assert.Equal(t, db.group.entry("devs"), []string{"devs", "x", "1003", ""})
+
+	// the locks are released
+	_, err = os.Stat(root + "/etc/group.lock")
+	assert.True(t, os.IsNotExist(err))
+
+	// an error leaves the files as they were
+	err = updatePasswdDatabase(root+"/etc", false, func(db *passwdDatabase) error {
+		db.group.remove("devs")
+		return os.ErrInvalid
+	})
+	assert.Equal(t, err, os.ErrInvalid)
+	db, err = readPasswdDatabase(root + "/etc")
+	assert.Nil(t, err)
+	assert.NotNil(t, db.group.entry("devs"))
+
+	assert.Nil(t, os.Remove(root+"/etc/passwd"))
+	err = updatePasswdDatabase(root+"/etc", false, func(db *passwdDatabase) error { return nil })
+	assert.Equal(t, err.Error(), "Missing "+root+"/etc/group or "+root+"/etc/passwd")
+}
+
+func TestUpdatePasswdDatabaseCreate(t *testing.T) {
+	root, cleanup := testRootDirectory(t)
+	defer cleanup()
+
+	// a database that starts out empty gets the files libnss-extrausers reads, without gshadow
+	dir := root + "/var/lib/extrausers"
+	err := updatePasswdDatabase(dir, true, func(db *passwdDatabase) error {
+		assert.True(t, db.passwd.missing)
+		db.group.set([]string{"devs", "x", "1003", ""})
+		db.gshadow.set([]string{"devs", "!", "", ""})
+		db.passwd.set([]string{"alice", "x", "1002", "1003", "", "/home/alice", "/bin/sh"})
+		db.shadow.set([]string{"alice", "!", "17000", "0", "99999", "7", "", "", ""})
+		return nil
+	})
+	assert.Nil(t, err)
+
+	for name, mode := range passwdFileModes {
+		fi, err := os.Stat(dir + "/" + name)
+		assert.Nil(t, err)
+		assert.Equal(t, fi.Mode().Perm(), mode)
+	}
+	_, err = os.Stat(dir + "/gshadow")
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, testReadRootFile(t, root, "/var/lib/extrausers/passwd"), "alice:x:1002:1003::/home/alice:/bin/sh\n")
+
+	// the database of the system is left alone
+	assert.Equal(t, testReadRootFile(t, root, "/etc/group"), "root:x:0:\nbob:x:1001:\nadmins:x:1002:bob\n")
+}
+
+// readLoginDefs, loginDefsRange
+func TestLoginDefs(t *testing.T) {
+	root, cleanup := testRootDirectory(t)
+	defer cleanup()
+
+	defs, err := readLoginDefs(root + "/etc/login.defs")
+	assert.Nil(t, err)
+	min, max, err := loginDefsRange(defs, "UID")
+	assert.Nil(t, err)
+	assert.Equal(t, min, 1000)
+	assert.Equal(t, max, 60000)
+
+	assert.Nil(t, ioutil.WriteFile(root+"/etc/login.defs", []byte("# uids\nUID_MIN\t\t 2000\n#UID_MAX 3000\nGID_MIN 10\nGID_MAX 5\nSYS_UID_MIN x\n"), 0644))
+	defs, err = readLoginDefs(root + "/etc/login.defs")
+	assert.Nil(t, err)
+	min, max, err = loginDefsRange(defs, "UID")
+	assert.Nil(t, err)
+	assert.Equal(t, min, 2000)
+	assert.Equal(t, max, 60000)
+
+	_, _, err = loginDefsRange(defs, "GID")
+	assert.Equal(t, err.Error(), "Invalid GID range 10-5 in login.defs")
+	_, _, err = loginDefsRange(defs, "SYS_UID")
+	assert.Equal(t, err.Error(), `Invalid SYS_UID_MIN "x" in login.defs`)
+}
+
+// usedIDs, allocateID
+func TestAllocateID(t *testing.T) {
+	file := &accountFile{lines: []string{"root:x:0:0::/root:/bin/bash", "bob:x:1001:1001::/home/bob:/bin/bash", "nobody:x:65534:65534::/:/bin/false"}}
+	used := usedIDs(file)
+	assert.Equal(t, used, map[int]bool{0: true, 1001: true, 65534: true})
+
+	id, err := allocateID(used, 1000, 60000)
+	assert.Nil(t, err)
+	assert.Equal(t, id, 1002)
+
+	id, err = allocateID(map[int]bool{}, 1000, 60000)
+	assert.Nil(t, err)
+	assert.Equal(t, id, 1000)
+
+	// the top of the range is taken, so the lowest free id is used
+	id, err = allocateID(map[int]bool{1000: true, 1002: true}, 1000, 1002)
+	assert.Nil(t, err)
+	assert.Equal(t, id, 1001)
+
+	_, err = allocateID(map[int]bool{1000: true, 1001: true}, 1000, 1001)
+	assert.Equal(t, err.Error(), "No free id between 1000 and 1001")
+}
+
+// addMember, removeMember, splitMembers
+func TestMembers(t *testing.T) {
+	assert.Equal(t, addMember([]string{"admins", "x", "1002", ""}, 3, "bob"), []string{"admins", "x", "1002", "bob"})
+	assert.Equal(t, addMember([]string{"admins", "x", "1002", "bob"}, 3, "alice"), []string{"admins", "x", "1002", "bob,alice"})
+	assert.Equal(t, addMember([]string{"admins", "x", "1002", "bob"}, 3, "bob"), []string{"admins", "x", "1002", "bob"})
+	assert.Equal(t, addMember([]string{"admins", "x", "1002"}, 3, "bob"), []string{"admins", "x", "1002", "bob"})
+
+	assert.Equal(t, removeMember([]string{"admins", "x", "1002", "bob,alice"}, 3, "bob"), []string{"admins", "x", "1002", "alice"})
+	assert.Equal(t, removeMember([]string{"admins", "x", "1002", "bob"}, 3, "bob"), []string{"admins", "x", "1002", ""})
+	assert.Equal(t, removeMember([]string{"admins", "x", "1002"}, 3, "bob"), []string{"admins", "x", "1002"})
+
+	assert.Equal(t, splitMembers(""), []string{})
+	assert.Equal(t, splitMembers("bob,alice"), []string{"bob", "alice"})
+}
@@ -0,0 +1,49 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Tested
+// Take the lock lckpwdf(3) takes on the whole passwd database, a write lock on /etc/.pwd.lock,
+// waiting while another process holds it. The lock is held until the returned file is closed.
+func lockPasswdDatabase(lockFile string) (*os.File, error) {
+	f, err := os.OpenFile(lockFile, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	lock := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: 0}
+	deadline := time.Now().Add(passwdLockWait)
+	for {
+		err = syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &lock)
+		if err == nil {
+			return f, nil
+		}
+		if err != syscall.EAGAIN && err != syscall.EACCES {
+			f.Close()
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("Cannot lock %s; try again later", lockFile)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Tested
+// Check a process is still running. A zombie, dead but not reaped by its parent yet, isn't.
+func processExists(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	if err != nil && err != syscall.EPERM {
+		return false
+	}
+	return !processIsZombie(procDirectory, pid)
+}
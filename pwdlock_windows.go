@@ -0,0 +1,15 @@
+package main
+
+import "os"
+
+// Not testable
+// Windows has no lckpwdf, the lock file is only opened
+func lockPasswdDatabase(lockFile string) (*os.File, error) {
+	return os.OpenFile(lockFile, os.O_WRONLY|os.O_CREATE, 0600)
+}
+
+// Not testable
+// Windows can't check a process without opening it, so a lock is never taken as stale
+func processExists(pid int) bool {
+	return true
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Tested
+// Create, update and delete the groups and users of the machine so they match the bundle, tracking them in leveldb.
+// A user or group that fails is recorded and its leveldb record left untouched, so it is retried on the next run.
+func reconcile(db *leveldb.DB, accounts AccountManager, groups []ArgoGroup, users []ArgoUser, loadFailures []SyncFailure, keyPolicy KeyPolicy) {
+	// maps for users to groups and leveldb comparisons
+	mUserGroups := make(map[string][]string)
+	mUserSSHKeys := make(map[string][]string)
+	mUserPrincipals := make(map[string][]string)
+	mGroup := make(map[string]string)
+	mUser := make(map[string]string)
+
+	// maps of the users and groups that failed this run. Their leveldb records are left untouched
+	// so they are neither removed nor updated and get retried on the next run.
+	mFailedGroup := make(map[string]bool)
+	mFailedUser := make(map[string]bool)
+
+	for _, failure := range loadFailures {
+		// the user or group can't be read, so keep it and its members as they are
+		recordFailure(failure.Kind, failure.ID, failure.Err)
+		if failure.Kind == "group" {
+			mFailedGroup["group@"+failure.ID] = true
+		} else {
+			mFailedUser["user@"+failure.ID] = true
+		}
+	}
+
+	// Loop through the groups creating groups
+	// and building the above map to eventually add the users to the appropriate groups
+	keyPrefix := "group@"
+	for _, group := range groups {
+		// build the key for the map and leveldb
+		key := keyPrefix + group.ID
+
+		// add group to map
+		mGroup[key] = group.ID
+
+		// get group from leveldb
+		data, err := db.Get([]byte(key), nil)
+		checkWithoutPanic(err)
+
+		// the delete here makes testing this much easier
+		if delete == true {
+			if data != nil {
+				fmt.Printf("Deleting group in leveldb with key: %s\n", key)
+				err = db.Delete([]byte(key), nil)
+				check(err)
+			}
+
+			//delete the group from the machine
+			err = accounts.GroupDelete(group.ID)
+			checkWithoutPanic(err)
+		} else {
+			// Group is not in leveldb, create it as a new group.
+			if data == nil {
+				// add the group to the machine
+				err = accounts.GroupAdd(group.ID)
+				if err != nil {
+					// skip the members so new users are created without the missing group
+					recordFailure("group", group.ID, err)
+					mFailedGroup[key] = true
+					continue
+				}
+
+				fmt.Printf("Creating new group in leveldb with key: %s\n", key)
+				err = db.Put([]byte(key), []byte(group.ID), nil)
+				check(err)
+			} else {
+				fmt.Printf("Group %s in leveldb with key: %s already exists.\n", group.ID, key)
+			}
+		}
+
+		// Build a map of the users to groups
+		for _, u := range group.Users {
+			if mUserGroups[u] == nil {
+				mUserGroups[u] = []string{group.ID}
+			} else {
+				mUserGroups[u] = append(mUserGroups[u], group.ID)
+			}
+		}
+	}
+
+	// Loop through the users creating users,
+	// adding the users to the appropriate groups,
+	// create the .ssh directory and authorized_key file
+	keyPrefix = "user@"
+	for _, user := range users {
+		// build the key for the map and leveldb
+		key := keyPrefix + user.ID
+
+		// expired keys are left out, so they are removed by the first run after they expire even if the bundle is the same
+		activeKeys, keyProblems := expireSSHKeys(user.SSHkeys, time.Now(), expiryWarning)
+		for _, problem := range keyProblems {
+			recordWarning("user", user.ID, problem)
+		}
+
+		// only keys that parse reach authorized_keys, normalized so a reformatted key isn't seen as a new one
+		sshKeys, keyProblems := normalizeSSHKeys(renderSSHKeys(activeKeys))
+		for _, problem := range keyProblems {
+			recordWarning("user", user.ID, problem)
+		}
+		// keys that break the key policy are left out too, which removes them from existing users
+		sshKeys, keyProblems = applyKeyPolicy(keyPolicy, sshKeys)
+		for _, problem := range keyProblems {
+			recordWarning("user", user.ID, problem)
+		}
+		user.SSHkeys = plainSSHKeys(sshKeys)
+
+		principals, principalProblems := normalizePrincipals(user.Principals)
+		for _, problem := range principalProblems {
+			recordWarning("user", user.ID, problem)
+		}
+
+		// a disabled user keeps its account but loses its keys, principals and sudo groups, which its record gets back when it is enabled
+		if user.Disabled {
+			sshKeys, principals, user.SSHkeys = nil, nil, nil
+			mUserGroups[user.ID] = withoutSudoGroups(mUserGroups[user.ID])
+		}
+
+		// add user to map
+		mUser[key] = user.ID
+		mUserSSHKeys[key] = sshKeys
+		mUserPrincipals[key] = principals
+
+		// get the user from leveldb
+		data, err := db.Get([]byte(key), nil)
+		checkWithoutPanic(err)
+
+		// the delete here makes testing this much easier
+		if delete == true {
+			if data == nil {
+				fmt.Printf("Deleting user in leveldb with key: %s\n", key)
+				err = db.Delete([]byte(key), nil)
+				check(err)
+			}
+
+			//delete the user from the machine
+			err = removeUser(accounts, user.ID)
+			checkWithoutPanic(err)
+			err = deletePrincipalsFile(principalsDir, user.ID)
+			checkWithoutPanic(err)
+		} else {
+			// User is not in leveldb, create it as a new user.
+			if data == nil {
+				groups := mUserGroups[user.ID]
+
+				// add the user to the machine
+				err = accounts.UserAdd(user, groups)
+				if err != nil {
+					recordFailure("user", user.ID, err)
+					mFailedUser[key] = true
+					continue
+				}
+
+				userGroup := UserGroup{Groups: groups, SSHKeys: sshKeys, ID: user.ID, Shell: user.Shell}
+
+				// a user created disabled is locked straight away
+				if user.Disabled && !disableUser(accounts, user, &userGroup) {
+					mFailedUser[key] = true
+				}
+
+				// sshd reads the keys from the key store instead when the files are turned off
+				err = nil
+				if writeKeyFiles {
+					err = createSSHDirectory(accounts, user)
+				}
+				if err != nil {
+					// The user exists on the machine now, so store it without keys.
+					// The next run sees the keys as added and retries the authorized_keys file.
+					recordFailure("user", user.ID, err)
+					mFailedUser[key] = true
+					userGroup.SSHKeys = nil
+				}
+
+				if len(principals) > 0 {
+					err = writePrincipalsFile(principalsDir, user.ID, principals)
+					if err != nil {
+						// stored without principals so the next run retries the file
+						recordFailure("user", user.ID, err)
+						mFailedUser[key] = true
+					} else {
+						userGroup.Principals = principals
+					}
+				}
+
+				fmt.Printf("Creating new user in leveldb with key: %s\n", key)
+				bArray := userGroupToByteArray(userGroup)
+				err = db.Put([]byte(key), bArray, nil)
+				check(err)
+			} else {
+				fmt.Printf("User %s with groups: %v in leveldb with key: %s already exists.\n", user.ID, byteArrayToUserGroup(data).Groups, key)
+
+				// a user disabled in the bundle is locked, and a user enabled again or back in the bundle within the grace period
+				// is unlocked. The groups, keys and principals taken away from it are in the bundle but not in its record,
+				// so they are put back below like any change.
+				userGroup := byteArrayToUserGroup(data)
+				locked := !userGroup.LockedAt.IsZero() || userGroup.Disabled
+				changed := false
+				if user.Disabled && (!userGroup.Disabled || userGroup.DisabledReason != user.DisabledReason) {
+					if !disableUser(accounts, user, userGroup) {
+						mFailedUser[key] = true
+						continue
+					}
+					changed = true
+				} else if !user.Disabled && locked {
+					if !enableUser(accounts, user, userGroup) {
+						mFailedUser[key] = true
+						continue
+					}
+					changed = true
+				}
+				if changed {
+					err = db.Put([]byte(key), userGroupToByteArray(*userGroup), nil)
+					check(err)
+				}
+			}
+		}
+	}
+
+	// Loop thru all the records in leveldb with the user prefix and see if they exist in the mUser map.
+	// Any that exist in leveldb but not in the map should be removed.
+	// If the user exists in both the map and leveldb,
+	// - check the groups to make sure we didn't add or remove the user from a group
+	// - check the ssh keys to see if they have chnaged
+	iter := db.NewIterator(util.BytesPrefix([]byte("user@")), nil)
+	for iter.Next() {
+		// leave users that failed this run alone
+		if mFailedUser[string(iter.Key())] {
+			fmt.Printf("User %s failed this run. Leaving leveldb untouched.\n", string(iter.Key()))
+			continue
+		}
+
+		// if the user is not in our map we created above
+		if mUser[string(iter.Key())] == "" {
+			// parse out the user
+			user, err := parseUserKey(string(iter.Key()))
+			check(err)
+
+			// a user that is already gone from the machine only needs its leveldb record removed
+			exists, err := accounts.UserExists(user)
+			if err == nil && exists && lockGrace > 0 {
+				// the user is locked and stripped of its access first, and only deleted once the grace period is over
+				userGroup := byteArrayToUserGroup(iter.Value())
+				if !offboardingDone(userGroup, time.Now()) {
+					offboardUser(accounts, user, userGroup)
+					err = db.Put([]byte(iter.Key()), userGroupToByteArray(*userGroup), nil)
+					check(err)
+					continue
+				}
+			}
+			if err == nil && exists {
+				err = removeUser(accounts, user)
+			}
+			if err == nil {
+				err = deletePrincipalsFile(principalsDir, user)
+			}
+			if err != nil {
+				recordFailure("user", user, err)
+				continue
+			}
+
+			fmt.Printf("User %s is missing. Deleting user in leveldb.\n", string(iter.Key()))
+			err = db.Delete([]byte(iter.Key()), nil)
+			check(err)
+		} else {
+			// User Group functionality
+
+			// Convert groups in leveldb to the existing groups
+			existingDBGroups := byteArrayToUserGroup(iter.Value()).Groups
+
+			// parse out the user
+			user, err := parseUserKey(string(iter.Key()))
+			check(err)
+
+			// Pull groups from map created above
+			newMapGroups := mUserGroups[user]
+
+			// check for groups to remove.
+			// Only the changes that succeed are saved to leveldb, the failed ones are retried next run.
+			groupsToRemove := make([]string, 0)
+			for _, existingDBGroup := range existingDBGroups {
+				groupExists := contains(newMapGroups, existingDBGroup)
+				if !groupExists && !mFailedGroup["group@"+existingDBGroup] {
+					fmt.Printf("Group %s is being removed from %s.\n", existingDBGroup, user)
+
+					// remove the group from the users profile on the machine
+					err = accounts.RemoveGroupFromUser(user, existingDBGroup)
+					if err != nil {
+						recordFailure("user", user, err)
+						continue
+					}
+
+					// add group to the remove group slice
+					groupsToRemove = append(groupsToRemove, existingDBGroup)
+				}
+			}
+			// check for groups to add
+			groupsToAdd := make([]string, 0)
+			for _, newMapGroup := range newMapGroups {
+				groupExists := contains(existingDBGroups, newMapGroup)
+				if !groupExists {
+					fmt.Printf("Group %s is being added to %s.\n", newMapGroup, user)
+
+					// add the group to the users profile on the machine
+					err = accounts.AddGroupToUser(user, newMapGroup)
+					if err != nil {
+						recordFailure("user", user, err)
+						continue
+					}
+
+					// add group to the add group slice
+					groupsToAdd = append(groupsToAdd, newMapGroup)
+				}
+			}
+
+			// User SSH functionality
+
+			// Convert existing ssh keys in leveldb to the existing SSHKeys
+			existingSSHKeys := normalizeStoredSSHKeys(byteArrayToUserGroup(iter.Value()).SSHKeys)
+
+			// Pull ssh keys from map created above
+			newMapSSHKeys := mUserSSHKeys[string(iter.Key())]
+
+			// check for groups to remove
+			sshKeysToRemove := make([]string, 0)
+			for _, existingSSHKey := range existingSSHKeys {
+				keyExists := contains(newMapSSHKeys, existingSSHKey)
+				if !keyExists {
+					fmt.Printf("Key %s is being removed from %s.\n", existingSSHKey, user)
+
+					// add group to the remove group slice
+					sshKeysToRemove = append(sshKeysToRemove, existingSSHKey)
+				}
+			}
+
+			sshKeysToAdd := make([]string, 0)
+			for _, newMapSSHKey := range newMapSSHKeys {
+				keyExists := contains(existingSSHKeys, newMapSSHKey)
+				if !keyExists {
+					fmt.Printf("Group %s is being added to %s.\n", newMapSSHKey, user)
+
+					// add group to the add group slice
+					sshKeysToAdd = append(sshKeysToAdd, newMapSSHKey)
+				}
+			}
+
+			// User principals functionality
+			existingPrincipals := byteArrayToUserGroup(iter.Value()).Principals
+			newMapPrincipals := mUserPrincipals[string(iter.Key())]
+			principalsChanged := !equalStrings(existingPrincipals, newMapPrincipals)
+
+			// fmt.Printf("groupsToAdd: %d\n", len(groupsToAdd))
+			// fmt.Printf("groupsToRemove: %d\n", len(groupsToRemove))
+			// fmt.Printf("sshKeysToAdd: %d\n", len(sshKeysToAdd))
+			// fmt.Printf("sshKeysToRemove: %d\n", len(sshKeysToRemove))
+
+			// Update LevelDB
+
+			if len(sshKeysToAdd) > 0 || len(sshKeysToRemove) > 0 || len(groupsToAdd) > 0 || len(groupsToRemove) > 0 || principalsChanged {
+				// convert the current groups from a byte array to a UserGroup Struct
+				userGroup := byteArrayToUserGroup(iter.Value())
+
+				if len(groupsToAdd) > 0 || len(groupsToRemove) > 0 {
+					// Adjust the groups
+
+					updatedGroups := adjustSlice(groupsToAdd, groupsToRemove, existingDBGroups)
+
+					fmt.Println("****************BEFORE*******************")
+					fmt.Printf("Level(groups): %v\n", existingDBGroups)
+					fmt.Printf("Map(groups): %v\n", newMapGroups)
+					fmt.Println("****************AFTER*******************")
+					fmt.Printf("Current Groups: %v\n", userGroup.Groups)
+					fmt.Printf("Updated Groups: %v\n", updatedGroups)
+
+					userGroup.Groups = updatedGroups
+				}
+
+				if len(sshKeysToAdd) > 0 || len(sshKeysToRemove) > 0 {
+					// Adjust the keys
+					updatedSSHKeys := adjustSlice(sshKeysToAdd, sshKeysToRemove, existingSSHKeys)
+
+					fmt.Println("****************BEFORE*******************")
+					fmt.Printf("Level(keys): %v\n", existingSSHKeys)
+					fmt.Printf("Map(keys): %v\n", newMapSSHKeys)
+					fmt.Println("****************AFTER*******************")
+					fmt.Printf("Current Keys: %v\n", userGroup.SSHKeys)
+					fmt.Printf("Updated Keys: %v\n", updatedSSHKeys)
+
+					// Update the authorized Keys, keeping the stored keys on failure so they are retried
+					err = nil
+					if writeKeyFiles {
+						err = updateAuthorizedKeyFile(accounts, user, updatedSSHKeys)
+					}
+					if err != nil {
+						recordFailure("user", user, err)
+					} else {
+						userGroup.SSHKeys = updatedSSHKeys
+					}
+				}
+
+				if principalsChanged {
+					fmt.Printf("Principals of %s change from %v to %v\n", user, existingPrincipals, newMapPrincipals)
+
+					// a user without principals has no principals file
+					if len(newMapPrincipals) == 0 {
+						err = deletePrincipalsFile(principalsDir, user)
+					} else {
+						err = writePrincipalsFile(principalsDir, user, newMapPrincipals)
+					}
+					if err != nil {
+						recordFailure("user", user, err)
+					} else {
+						userGroup.Principals = newMapPrincipals
+					}
+				}
+
+				// convert it back to a byte array
+				bArray := userGroupToByteArray(*userGroup)
+
+				// update leveldb with the new groups
+				err = db.Put(iter.Key(), bArray, nil)
+				check(err)
+			}
+		}
+	}
+	iter.Release()
+	check(iter.Error())
+
+	// Put back the authorized_keys files changed on the host since argo-lyte wrote them, even when the bundle didn't change
+	if enforceKeys && writeKeyFiles && delete == false {
+		iter = db.NewIterator(util.BytesPrefix([]byte("user@")), nil)
+		for iter.Next() {
+			if mFailedUser[string(iter.Key())] || mUser[string(iter.Key())] == "" {
+				continue
+			}
+			user, err := parseUserKey(string(iter.Key()))
+			check(err)
+
+			userGroup := byteArrayToUserGroup(iter.Value())
+			drift, err := enforceAuthorizedKeyFile(accounts, user, userGroup.SSHKeys)
+			if err != nil {
+				recordFailure("user", user, err)
+				continue
+			}
+			if len(drift) > 0 {
+				recordWarning("user", user, fmt.Errorf("authorized_keys was changed on the host (%s), restoring it", strings.Join(drift, ", ")))
+			}
+		}
+		iter.Release()
+		check(iter.Error())
+	}
+
+	// Loop thru all the records in leveldb with the group prefix and see if they exist in the mGroup map.
+	// Any that exist in leveldb but not in the map should be removed.
+	iter = db.NewIterator(util.BytesPrefix([]byte("group@")), nil)
+	for iter.Next() {
+		//fmt.Printf("%s\n", mGroup[string(iter.Key())])
+		if mGroup[string(iter.Key())] == "" && !mFailedGroup[string(iter.Key())] {
+			err := accounts.GroupDelete(string(iter.Value()))
+			if err != nil {
+				recordFailure("group", string(iter.Value()), err)
+				continue
+			}
+
+			fmt.Printf("Group %s is missing. Deleting group in leveldb.\n", string(iter.Key()))
+			err = db.Delete([]byte(iter.Key()), nil)
+			check(err)
+		}
+	}
+	iter.Release()
+	check(iter.Error())
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// open a leveldb in a temp directory and point the sync at it with the key files turned off,
+// so reconcile runs against a fakeAccounts without root. The temp directory is the alternate root too,
+// so the cleanup of deleted users never looks at the spools of the machine.
+func testReconcileSetup(t *testing.T) (*leveldb.DB, func()) {
+	dir, err := ioutil.TempDir("", "argo-lyte-test")
+	assert.Nil(t, err)
+
+	db, err := leveldb.OpenFile(dir+"/db", nil)
+	assert.Nil(t, err)
+
+	failures = nil
+	warnings = nil
+	delete = false
+	writeKeyFiles = false
+	enforceKeys = false
+	rootDirectory = dir
+	principalsDir = dir + "/auth_principals"
+	removalPolicy = removalRemove
+	lockGrace = 0
+	terminateSessions = false
+	orphanPaths = ""
+	sudoGroups = ""
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+		failures = nil
+		warnings = nil
+		writeKeyFiles = true
+		rootDirectory = ""
+	}
+}
+
+// get the record of a user from leveldb
+func testStoredUser(t *testing.T, db *leveldb.DB, userName string) *UserGroup {
+	data, err := db.Get([]byte("user@"+userName), nil)
+	if err == leveldb.ErrNotFound {
+		return nil
+	}
+	assert.Nil(t, err)
+	return byteArrayToUserGroup(data)
+}
+
+// reconcile
+func TestReconcileCreate(t *testing.T) {
+	db, cleanup := testReconcileSetup(t)
+	defer cleanup()
+
+	bobKey := testSSHKey(t, "bob@laptop")
+	accounts := newFakeAccounts()
+	groups := []ArgoGroup{{ID: "admins", Users: []string{"bob"}}, {ID: "devs", Users: []string{"bob", "alice"}}}
+	users := []ArgoUser{
+		{SSHkeys: []SSHKey{{Key: bobKey}}, ID: "bob", Shell: "/bin/bash", Principals: []string{"bob"}},
+		{ID: "alice", Shell: "/bin/bash"},
+	}
+	reconcile(db, accounts, groups, users, nil, KeyPolicy{})
+
+	assert.Equal(t, len(failures), 0)
+	assert.Equal(t, accounts.calls, []string{"groupadd admins", "groupadd devs", "useradd bob", "useradd alice"})
+	assert.Equal(t, accounts.userGroups("bob"), []string{"admins", "devs"})
+	assert.Equal(t, accounts.userGroups("alice"), []string{"devs"})
+
+	bob := testStoredUser(t, db, "bob")
+	assert.Equal(t, bob.Groups, []string{"admins", "devs"})
+	assert.Equal(t, bob.SSHKeys, []string{bobKey})
+	assert.Equal(t, bob.Principals, []string{"bob"})
+
+	data, err := ioutil.ReadFile(principalsDir + "/bob")
+	assert.Nil(t, err)
+	assert.Equal(t, string(data), renderLines([]string{"bob"}))
+
+	// a second run with the same bundle changes nothing
+	accounts.calls = nil
+	reconcile(db, accounts, groups, users, nil, KeyPolicy{})
+	assert.Equal(t, len(failures), 0)
+	assert.Equal(t, len(accounts.calls), 0)
+}
+
+func TestReconcileUpdate(t *testing.T) {
+	db, cleanup := testReconcileSetup(t)
+	defer cleanup()
+
+	accounts := newFakeAccounts()
+	groups := []ArgoGroup{{ID: "admins", Users: []string{"bob"}}, {ID: "devs", Users: []string{"alice"}}}
+	users := []ArgoUser{{ID: "bob", Shell: "/bin/bash"}, {ID: "alice", Shell: "/bin/bash"}}
+	reconcile(db, accounts, groups, users, nil, KeyPolicy{})
+	assert.Equal(t, len(failures), 0)
+
+	// bob moves from admins to devs, alice leaves and admins goes away
+	bobKey := testSSHKey(t, "bob@laptop")
+	accounts.calls = nil
+	groups = []ArgoGroup{{ID: "devs", Users: []string{"bob"}}}
+	users = []ArgoUser{{SSHkeys: []SSHKey{{Key: bobKey}}, ID: "bob", Shell: "/bin/bash"}}
+	reconcile(db, accounts, groups, users, nil, KeyPolicy{})
+
+	assert.Equal(t, len(failures), 0)
+	assert.Equal(t, accounts.calls, []string{"userdel alice", "gpasswd bob admins", "usermod bob devs", "groupdel admins"})
+	assert.Equal(t, accounts.userGroups("bob"), []string{"devs"})
+	assert.Nil(t, accounts.users["alice"])
+
+	bob := testStoredUser(t, db, "bob")
+	assert.Equal(t, bob.Groups, []string{"devs"})
+	assert.Equal(t, bob.SSHKeys, []string{bobKey})
+	assert.Nil(t, testStoredUser(t, db, "alice"))
+}
+
+func TestReconcileFailures(t *testing.T) {
+	db, cleanup := testReconcileSetup(t)
+	defer cleanup()
+
+	accounts := newFakeAccounts()
+	accounts.fail["groupadd admins"] = errors.New("groupadd: cannot lock /etc/group; try again later.")
+	accounts.fail["useradd alice"] = errors.New("useradd: UID 1000 is not unique")
+	groups := []ArgoGroup{{ID: "admins", Users: []string{"bob"}}}
+	users := []ArgoUser{{ID: "bob", Shell: "/bin/bash"}, {ID: "alice", Shell: "/bin/bash"}}
+	reconcile(db, accounts, groups, users, nil, KeyPolicy{})
+
+	// bob is created without the group that failed, alice isn't stored so she is retried
+	assert.Equal(t, len(failures), 2)
+	assert.Equal(t, failures[0].Kind, "group")
+	assert.Equal(t, failures[1].ID, "alice")
+	assert.Equal(t, accounts.userGroups("bob"), []string{})
+	assert.Equal(t, len(testStoredUser(t, db, "bob").Groups), 0)
+	assert.Nil(t, testStoredUser(t, db, "alice"))
+
+	// the next run retries both
+	failures = nil
+	accounts.fail = map[string]error{}
+	reconcile(db, accounts, groups, users, nil, KeyPolicy{})
+	assert.Equal(t, len(failures), 0)
+	assert.Equal(t, accounts.userGroups("bob"), []string{"admins"})
+	assert.NotNil(t, testStoredUser(t, db, "alice"))
+}
+
+func TestReconcileLoadFailures(t *testing.T) {
+	db, cleanup := testReconcileSetup(t)
+	defer cleanup()
+
+	accounts := newFakeAccounts()
+	users := []ArgoUser{{ID: "bob", Shell: "/bin/bash"}}
+	reconcile(db, accounts, nil, users, nil, KeyPolicy{})
+	assert.Equal(t, len(failures), 0)
+
+	// a user file that can't be read leaves the user on the machine
+	accounts.calls = nil
+	loadFailures := []SyncFailure{{"user", "bob", errors.New("invalid character '}' looking for beginning of object key string")}}
+	reconcile(db, accounts, nil, nil, loadFailures, KeyPolicy{})
+	assert.Equal(t, len(failures), 1)
+	assert.Equal(t, len(accounts.calls), 0)
+	assert.NotNil(t, testStoredUser(t, db, "bob"))
+}
+
+func TestReconcileDelete(t *testing.T) {
+	db, cleanup := testReconcileSetup(t)
+	defer cleanup()
+
+	accounts := newFakeAccounts()
+	groups := []ArgoGroup{{ID: "admins", Users: []string{"bob"}}}
+	users := []ArgoUser{{ID: "bob", Shell: "/bin/bash"}}
+	reconcile(db, accounts, groups, users, nil, KeyPolicy{})
+
+	delete = true
+	defer func() { delete = false }()
+	accounts.calls = nil
+	reconcile(db, accounts, groups, users, nil, KeyPolicy{})
+	assert.Equal(t, accounts.calls, []string{"groupdel admins", "userdel bob"})
+	assert.Nil(t, accounts.users["bob"])
+	assert.False(t, accounts.groups["admins"])
+}
+
+func TestReconcileLockGrace(t *testing.T) {
+	db, cleanup := testReconcileSetup(t)
+	defer cleanup()
+
+	accounts := newFakeAccounts()
+	users := []ArgoUser{{ID: "bob", Shell: "/bin/bash"}}
+	reconcile(db, accounts, nil, users, nil, KeyPolicy{})
+
+	// a user leaving the bundle is locked first and stays locked during the grace period
+	lockGrace = time.Hour
+	accounts.calls = nil
+	reconcile(db, accounts, nil, nil, nil, KeyPolicy{})
+	assert.Equal(t, accounts.calls, []string{"usermod --lock bob"})
+	assert.True(t, accounts.locked["bob"])
+	lockedAt := testStoredUser(t, db, "bob").LockedAt
+	assert.False(t, lockedAt.IsZero())
+
+	accounts.calls = nil
+	reconcile(db, accounts, nil, nil, nil, KeyPolicy{})
+	assert.Equal(t, len(accounts.calls), 0)
+	assert.Equal(t, testStoredUser(t, db, "bob").LockedAt, lockedAt)
+
+	// back in the bundle it is unlocked
+	reconcile(db, accounts, nil, users, nil, KeyPolicy{})
+	assert.Equal(t, accounts.calls, []string{"usermod --unlock bob"})
+	assert.False(t, accounts.locked["bob"])
+	assert.True(t, testStoredUser(t, db, "bob").LockedAt.IsZero())
+
+	// once the grace period is over it is deleted
+	bob := testStoredUser(t, db, "bob")
+	bob.LockedAt = time.Now().Add(-2 * time.Hour)
+	assert.Nil(t, db.Put([]byte("user@bob"), userGroupToByteArray(*bob), nil))
+	accounts.calls = nil
+	reconcile(db, accounts, nil, nil, nil, KeyPolicy{})
+	assert.Equal(t, accounts.calls, []string{"userdel bob"})
+	assert.Nil(t, testStoredUser(t, db, "bob"))
+	assert.Equal(t, len(failures), 0)
+}
+
+func TestReconcileOffboarding(t *testing.T) {
+	db, cleanup := testReconcileSetup(t)
+	defer cleanup()
+
+	bobKey := testSSHKey(t, "bob@laptop")
+	accounts := newFakeAccounts()
+	groups := []ArgoGroup{{ID: "admins", Users: []string{"bob"}}}
+	users := []ArgoUser{{SSHkeys: []SSHKey{{Key: bobKey}}, ID: "bob", Shell: "/bin/bash", Principals: []string{"bob"}}}
+	reconcile(db, accounts, groups, users, nil, KeyPolicy{})
+
+	// a user leaving the bundle loses its groups, and sudo with them, its keys and its principals.
+	// A change that fails stays in its record and is retried on the next run.
+	lockGrace = time.Hour
+	accounts.calls = nil
+	accounts.fail["gpasswd bob admins"] = errors.New("gpasswd: cannot lock /etc/group")
+	reconcile(db, accounts, []ArgoGroup{{ID: "admins"}}, nil, nil, KeyPolicy{})
+	assert.Equal(t, accounts.calls, []string{"usermod --lock bob", "gpasswd bob admins"})
+	assert.Equal(t, len(failures), 1)
+	bob := testStoredUser(t, db, "bob")
+	assert.Equal(t, bob.Groups, []string{"admins"})
+	assert.Nil(t, bob.SSHKeys)
+	assert.Nil(t, bob.Principals)
+	_, err := os.Stat(principalsDir + "/bob")
+	assert.True(t, os.IsNotExist(err))
+
+	failures = nil
+	accounts.calls = nil
+	accounts.fail = map[string]error{}
+	reconcile(db, accounts, []ArgoGroup{{ID: "admins"}}, nil, nil, KeyPolicy{})
+	assert.Equal(t, accounts.calls, []string{"gpasswd bob admins"})
+	assert.Equal(t, len(testStoredUser(t, db, "bob").Groups), 0)
+	assert.Equal(t, accounts.userGroups("bob"), []string{})
+
+	// back in the bundle it gets everything back
+	accounts.calls = nil
+	reconcile(db, accounts, groups, users, nil, KeyPolicy{})
+	assert.Equal(t, len(failures), 0)
+	assert.Equal(t, accounts.calls, []string{"usermod --unlock bob", "usermod bob admins"})
+	assert.False(t, accounts.locked["bob"])
+	bob = testStoredUser(t, db, "bob")
+	assert.True(t, bob.LockedAt.IsZero())
+	assert.Equal(t, bob.Groups, []string{"admins"})
+	assert.Equal(t, bob.SSHKeys, []string{bobKey})
+	assert.Equal(t, bob.Principals, []string{"bob"})
+	_, err = os.Stat(principalsDir + "/bob")
+	assert.Nil(t, err)
+}
+
+func TestReconcileDisabled(t *testing.T) {
+	db, cleanup := testReconcileSetup(t)
+	defer cleanup()
+
+	bobKey := testSSHKey(t, "bob@laptop")
+	sudoGroups = "admins, wheel"
+	accounts := newFakeAccounts()
+	groups := []ArgoGroup{{ID: "admins", Users: []string{"bob"}}, {ID: "devs", Users: []string{"bob"}}}
+	users := []ArgoUser{{SSHkeys: []SSHKey{{Key: bobKey}}, ID: "bob", Shell: "/bin/bash", Principals: []string{"bob"}}}
+	reconcile(db, accounts, groups, users, nil, KeyPolicy{})
+
+	// a disabled user is locked and loses its keys, principals and sudo groups but keeps its other groups
+	disabled := []ArgoUser{{SSHkeys: []SSHKey{{Key: bobKey}}, ID: "bob", Shell: "/bin/bash", Principals: []string{"bob"}, Disabled: true, DisabledReason: "on leave"}}
+	accounts.calls = nil
+	reconcile(db, accounts, groups, disabled, nil, KeyPolicy{})
+	assert.Equal(t, accounts.calls, []string{"usermod --lock bob", "gpasswd bob admins"})
+	assert.True(t, accounts.locked["bob"])
+	bob := testStoredUser(t, db, "bob")
+	assert.True(t, bob.Disabled)
+	assert.Equal(t, bob.DisabledReason, "on leave")
+	assert.Equal(t, bob.Groups, []string{"devs"})
+	assert.Nil(t, bob.SSHKeys)
+	assert.Nil(t, bob.Principals)
+	_, err := os.Stat(principalsDir + "/bob")
+	assert.True(t, os.IsNotExist(err))
+
+	// it stays locked, and a new reason is only stored
+	accounts.calls = nil
+	disabled[0].DisabledReason = "suspended"
+	reconcile(db, accounts, groups, disabled, nil, KeyPolicy{})
+	assert.Equal(t, len(accounts.calls), 0)
+	assert.Equal(t, testStoredUser(t, db, "bob").DisabledReason, "suspended")
+
+	// enabled again it gets everything back
+	reconcile(db, accounts, groups, users, nil, KeyPolicy{})
+	assert.Equal(t, accounts.calls, []string{"usermod --unlock bob", "usermod bob admins"})
+	assert.False(t, accounts.locked["bob"])
+	bob = testStoredUser(t, db, "bob")
+	assert.False(t, bob.Disabled)
+	assert.Equal(t, bob.DisabledReason, "")
+	assert.Equal(t, bob.Groups, []string{"devs", "admins"})
+	assert.Equal(t, bob.SSHKeys, []string{bobKey})
+	assert.Equal(t, bob.Principals, []string{"bob"})
+	assert.Equal(t, len(failures), 0)
+}
+
+func TestReconcileCreateDisabled(t *testing.T) {
+	db, cleanup := testReconcileSetup(t)
+	defer cleanup()
+
+	sudoGroups = "admins"
+	accounts := newFakeAccounts()
+	groups := []ArgoGroup{{ID: "admins", Users: []string{"bob"}}}
+	users := []ArgoUser{{SSHkeys: []SSHKey{{Key: testSSHKey(t, "bob@laptop")}}, ID: "bob", Shell: "/bin/bash", Disabled: true}}
+	reconcile(db, accounts, groups, users, nil, KeyPolicy{})
+	assert.Equal(t, accounts.calls, []string{"groupadd admins", "useradd bob", "usermod --lock bob"})
+	assert.Equal(t, accounts.userGroups("bob"), []string{})
+	bob := testStoredUser(t, db, "bob")
+	assert.True(t, bob.Disabled)
+	assert.Equal(t, len(bob.Groups), 0)
+	assert.Nil(t, bob.SSHKeys)
+
+	// a lock that fails is retried on the next run
+	db2, cleanup2 := testReconcileSetup(t)
+	defer cleanup2()
+	sudoGroups = "admins"
+	accounts = newFakeAccounts()
+	accounts.fail["usermod --lock bob"] = errors.New("usermod: cannot lock /etc/shadow")
+	reconcile(db2, accounts, groups, users, nil, KeyPolicy{})
+	assert.Equal(t, len(failures), 1)
+	assert.False(t, testStoredUser(t, db2, "bob").Disabled)
+
+	failures = nil
+	accounts.calls = nil
+	accounts.fail = map[string]error{}
+	reconcile(db2, accounts, groups, users, nil, KeyPolicy{})
+	assert.Equal(t, accounts.calls, []string{"usermod --lock bob"})
+	assert.True(t, testStoredUser(t, db2, "bob").Disabled)
+	assert.Equal(t, len(failures), 0)
+}
+
+func TestReconcileRemovalKeep(t *testing.T) {
+	db, cleanup := testReconcileSetup(t)
+	defer cleanup()
+
+	accounts := newFakeAccounts()
+	reconcile(db, accounts, nil, []ArgoUser{{ID: "bob", Shell: "/bin/bash"}}, nil, KeyPolicy{})
+
+	removalPolicy = removalKeep
+	accounts.calls = nil
+	reconcile(db, accounts, nil, nil, nil, KeyPolicy{})
+	assert.Equal(t, accounts.calls, []string{"userdel --keep-home bob"})
+	assert.Nil(t, testStoredUser(t, db, "bob"))
+}
+
+func TestReconcileKeyFilesInRoot(t *testing.T) {
+	db, cleanup := testReconcileSetup(t)
+	defer cleanup()
+
+	// an alternate root holds the home directories, which the fake useradd doesn't create
+	root, cleanupRoot := testRootDirectory(t)
+	defer cleanupRoot()
+	assert.Nil(t, os.MkdirAll(root+"/home/bob", 0755))
+	writeKeyFiles = true
+
+	bobKey := testSSHKey(t, "bob@laptop")
+	accounts := newFakeAccounts()
+	users := []ArgoUser{{SSHkeys: []SSHKey{{Key: bobKey}}, ID: "bob", Shell: "/bin/bash"}}
+	reconcile(db, accounts, nil, users, nil, KeyPolicy{})
+	assert.Equal(t, len(failures), 0)
+
+	expected, err := renderAuthorizedKeys("", []string{bobKey}, keyFileOverwrite)
+	assert.Nil(t, err)
+	data, err := ioutil.ReadFile(root + "/home/bob/.ssh/authorized_keys")
+	assert.Nil(t, err)
+	assert.Equal(t, string(data), expected)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The removal policies of -removal: what happens to the home directory of a user removed from the bundle
+const (
+	removalRemove  = "remove"
+	removalKeep    = "keep"
+	removalArchive = "archive"
+)
+
+// Tested
+// Check the removal policy is one argo-lyte knows
+func checkRemovalPolicy(policy string) error {
+	switch policy {
+	case removalRemove, removalKeep, removalArchive:
+		return nil
+	}
+	return fmt.Errorf("Unknown removal policy %q, expected %s, %s or %s", policy, removalRemove, removalKeep, removalArchive)
+}
+
+// Tested
+// Get the shell that refuses logins: /usr/sbin/nologin on Debian, /sbin/nologin on Red Hat and Alpine, /bin/false otherwise
+func nologinShell() string {
+	for _, shell := range []string{"/usr/sbin/nologin", "/sbin/nologin"} {
+		if _, err := os.Stat(rootPath(shell)); err == nil {
+			return shell
+		}
+	}
+	return "/bin/false"
+}
+
+// Tested
+// Delete a user following the removal policy: its home directory is removed, kept, or archived then removed.
+// Its sessions are ended first, as userdel refuses to delete a user that is logged in, and what it leaves behind is cleaned up after.
+func removeUser(accounts AccountManager, userName string) error {
+	err := terminateUserSessions(accounts, userName)
+	if err != nil {
+		recordFailure("user", userName, err)
+	}
+
+	// the ids are gone with the user, so they are looked up first for the cleanup
+	uid, gid, err := accounts.UserIDs(userName)
+	if err != nil {
+		fmt.Printf("Cannot look up the ids of %s, its files won't be cleaned up: %s\n", userName, err.Error())
+		uid, gid = -1, -1
+	}
+
+	if removalPolicy == removalArchive {
+		archive, err := archiveHomeDirectory(homeDirectory(userName), rootPath(archiveDirectory), userName, time.Now())
+		if err != nil {
+			return err
+		}
+		if archive != "" {
+			fmt.Printf("Archived the home directory of %s to %s\n", userName, archive)
+		}
+	}
+	err = accounts.UserDelete(userName, removalPolicy != removalKeep)
+	if err != nil {
+		return err
+	}
+
+	// the user is deleted by now, so a failed cleanup is reported without keeping its record
+	err = cleanupUser(userName, uid, gid)
+	if err != nil {
+		recordFailure("user", userName, err)
+	}
+	return nil
+}
+
+// Tested
+// Archive a home directory to <archiveDir>/<user>-<time>.tar.gz, readable by root only. Owners, modes and symlinks
+// are kept, other special files are left out. A home directory that is missing, or is a symlink, has nothing to archive.
+func archiveHomeDirectory(homeDir string, archiveDir string, userName string, now time.Time) (string, error) {
+	if _, err := checkDirectory(homeDir); err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	err := os.MkdirAll(archiveDir, 0700)
+	if err != nil {
+		return "", err
+	}
+	archive := filepath.Join(archiveDir, userName+"-"+now.UTC().Format("20060102T150405Z")+".tar.gz")
+
+	// written to a temp file first, so a failed archive never looks like a complete one
+	tmp, err := ioutil.TempFile(archiveDir, "."+userName+"-")
+	if err != nil {
+		return "", err
+	}
+	tmpName := tmp.Name()
+	fail := func(err error) (string, error) {
+		tmp.Close()
+		os.Remove(tmpName)
+		return "", err
+	}
+
+	err = tmp.Chmod(0600)
+	if err != nil {
+		return fail(err)
+	}
+	gz := gzip.NewWriter(tmp)
+	tw := tar.NewWriter(gz)
+	err = filepath.Walk(homeDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return archiveFile(tw, path, filepath.Join(userName, strings.TrimPrefix(path, homeDir)), fi)
+	})
+	if err != nil {
+		return fail(err)
+	}
+	err = tw.Close()
+	if err != nil {
+		return fail(err)
+	}
+	err = gz.Close()
+	if err != nil {
+		return fail(err)
+	}
+	err = tmp.Close()
+	if err != nil {
+		return fail(err)
+	}
+
+	err = os.Rename(tmpName, archive)
+	if err != nil {
+		os.Remove(tmpName)
+		return "", err
+	}
+	return archive, nil
+}
+
+// Tested
+// Add a directory, regular file or symlink to a tar archive under name. A regular file is opened without following
+// a symlink and must be the file walked, so a symlink or hard link swapped in meanwhile can't get another file archived.
+func archiveFile(tw *tar.Writer, path string, name string, fi os.FileInfo) error {
+	link := ""
+	var file *os.File
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		link = target
+	case fi.Mode().IsRegular():
+		var err error
+		file, err = openNoFollow(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		opened, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		if !os.SameFile(fi, opened) {
+			return fmt.Errorf("%s changed while archiving it", path)
+		}
+		fi = opened
+	case fi.IsDir():
+	default:
+		fmt.Printf("Not archiving %s: not a regular file, directory or symlink\n", path)
+		return nil
+	}
+
+	header, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.ToSlash(name)
+	if fi.IsDir() {
+		header.Name += "/"
+	}
+	err = tw.WriteHeader(header)
+	if err != nil || file == nil {
+		return err
+	}
+	_, err = io.Copy(tw, file)
+	return err
+}
+
+// Tested
+// Remove the home directory archives older than the retention period and return them. A missing directory has none.
+func pruneArchives(archiveDir string, retention time.Duration, now time.Time) ([]string, error) {
+	pruned := make([]string, 0)
+	files, err := ioutil.ReadDir(archiveDir)
+	if os.IsNotExist(err) {
+		return pruned, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fi := range files {
+		if !fi.Mode().IsRegular() || !strings.HasSuffix(fi.Name(), ".tar.gz") || now.Sub(fi.ModTime()) < retention {
+			continue
+		}
+		path := filepath.Join(archiveDir, fi.Name())
+		err = os.Remove(path)
+		if err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, path)
+	}
+	return pruned, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// the names and contents of the entries of a tar.gz archive
+func testReadArchive(t *testing.T, path string) map[string]string {
+	file, err := os.Open(path)
+	assert.Nil(t, err)
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	assert.Nil(t, err)
+
+	entries := make(map[string]string)
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			break
+		}
+		data, err := ioutil.ReadAll(tr)
+		assert.Nil(t, err)
+		entries[header.Name] = string(data) + header.Linkname
+	}
+	return entries
+}
+
+// checkRemovalPolicy
+func TestCheckRemovalPolicy(t *testing.T) {
+	assert.Nil(t, checkRemovalPolicy("remove"))
+	assert.Nil(t, checkRemovalPolicy("keep"))
+	assert.Nil(t, checkRemovalPolicy("archive"))
+	assert.Equal(t, checkRemovalPolicy("shred").Error(), `Unknown removal policy "shred", expected remove, keep or archive`)
+}
+
+// nologinShell
+func TestNologinShell(t *testing.T) {
+	root, cleanup := testRootDirectory(t)
+	defer cleanup()
+
+	assert.Equal(t, nologinShell(), "/bin/false")
+	assert.Nil(t, os.MkdirAll(root+"/sbin", 0755))
+	assert.Nil(t, ioutil.WriteFile(root+"/sbin/nologin", []byte{}, 0755))
+	assert.Equal(t, nologinShell(), "/sbin/nologin")
+	assert.Nil(t, os.MkdirAll(root+"/usr/sbin", 0755))
+	assert.Nil(t, ioutil.WriteFile(root+"/usr/sbin/nologin", []byte{}, 0755))
+	assert.Equal(t, nologinShell(), "/usr/sbin/nologin")
+}
+
+// archiveHomeDirectory, archiveFile
+func TestArchiveHomeDirectory(t *testing.T) {
+	root, cleanup := testRootDirectory(t)
+	defer cleanup()
+
+	homeDir := root + "/home/bob"
+	assert.Nil(t, os.MkdirAll(homeDir+"/work", 0755))
+	assert.Nil(t, ioutil.WriteFile(homeDir+"/work/notes.txt", []byte("notes\n"), 0600))
+	assert.Nil(t, os.Symlink("work/notes.txt", homeDir+"/notes"))
+
+	now := time.Date(2026, 10, 19, 12, 30, 0, 0, time.UTC)
+	archive, err := archiveHomeDirectory(homeDir, root+"/archive", "bob", now)
+	assert.Nil(t, err)
+	assert.Equal(t, archive, root+"/archive/bob-20261019T123000Z.tar.gz")
+	fi, err := os.Stat(archive)
+	assert.Nil(t, err)
+	assert.Equal(t, fi.Mode().Perm(), os.FileMode(0600))
+	assert.Equal(t, testReadArchive(t, archive), map[string]string{"bob/": "", "bob/notes": "work/notes.txt", "bob/work/": "", "bob/work/notes.txt": "notes\n"})
+
+	// only the archive is left in the directory
+	files, err := ioutil.ReadDir(root + "/archive")
+	assert.Nil(t, err)
+	assert.Equal(t, len(files), 1)
+
+	// a missing home directory has nothing to archive
+	archive, err = archiveHomeDirectory(root+"/home/alice", root+"/archive", "alice", now)
+	assert.Nil(t, err)
+	assert.Equal(t, archive, "")
+}
+
+func TestArchiveFileSwapped(t *testing.T) {
+	dir, err := ioutil.TempDir("", "argo-lyte-archive")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, ioutil.WriteFile(dir+"/notes.txt", []byte("notes\n"), 0600))
+	assert.Nil(t, ioutil.WriteFile(dir+"/shadow", []byte("root:$6$secret:::\n"), 0600))
+	fi, err := os.Lstat(dir + "/notes.txt")
+	assert.Nil(t, err)
+
+	// another file swapped in after the walk isn't archived, nor is a header written for it
+	var buffer bytes.Buffer
+	tw := tar.NewWriter(&buffer)
+	assert.Nil(t, os.Rename(dir+"/notes.txt", dir+"/old.txt"))
+	assert.Nil(t, os.Link(dir+"/shadow", dir+"/notes.txt"))
+	err = archiveFile(tw, dir+"/notes.txt", "bob/notes.txt", fi)
+	assert.Equal(t, err.Error(), dir+"/notes.txt changed while archiving it")
+
+	// and neither is a symlink
+	assert.Nil(t, os.Remove(dir+"/notes.txt"))
+	assert.Nil(t, os.Symlink(dir+"/shadow", dir+"/notes.txt"))
+	assert.NotNil(t, archiveFile(tw, dir+"/notes.txt", "bob/notes.txt", fi))
+	assert.Equal(t, buffer.Len(), 0)
+}
+
+// pruneArchives
+func TestPruneArchives(t *testing.T) {
+	dir, err := ioutil.TempDir("", "argo-lyte-archive")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	for name, age := range map[string]time.Duration{"old.tar.gz": 100 * 24 * time.Hour, "new.tar.gz": time.Hour, "notes.txt": 100 * 24 * time.Hour} {
+		assert.Nil(t, ioutil.WriteFile(dir+"/"+name, []byte{}, 0600))
+		assert.Nil(t, os.Chtimes(dir+"/"+name, now.Add(-age), now.Add(-age)))
+	}
+
+	pruned, err := pruneArchives(dir, 90*24*time.Hour, now)
+	assert.Nil(t, err)
+	assert.Equal(t, pruned, []string{dir + "/old.tar.gz"})
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	names := make([]string, 0)
+	for _, fi := range files {
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+	assert.Equal(t, names, []string{"new.tar.gz", "notes.txt"})
+
+	pruned, err = pruneArchives(dir+"/missing", time.Hour, now)
+	assert.Nil(t, err)
+	assert.Equal(t, len(pruned), 0)
+}
+
+// removeUser
+func TestRemoveUser(t *testing.T) {
+	root, cleanup := testRootDirectory(t)
+	defer cleanup()
+	assert.Nil(t, os.MkdirAll(root+"/home/bob", 0755))
+	assert.Nil(t, ioutil.WriteFile(root+"/home/bob/.bashrc", []byte("# bashrc\n"), 0644))
+	defer func() { removalPolicy = removalRemove }()
+
+	accounts := newFakeAccounts()
+	accounts.users["bob"] = []string{}
+	removalPolicy = removalKeep
+	assert.Nil(t, removeUser(accounts, "bob"))
+	assert.Equal(t, accounts.calls, []string{"userdel --keep-home bob"})
+
+	// the archive is made before the user and its home directory are removed
+	accounts.users["bob"] = []string{}
+	accounts.calls = nil
+	removalPolicy = removalArchive
+	assert.Nil(t, removeUser(accounts, "bob"))
+	assert.Equal(t, accounts.calls, []string{"userdel bob"})
+	files, err := ioutil.ReadDir(root + archiveDirectory)
+	assert.Nil(t, err)
+	assert.Equal(t, len(files), 1)
+	assert.Equal(t, testReadArchive(t, root+archiveDirectory+"/"+files[0].Name())["bob/.bashrc"], "# bashrc\n")
+}
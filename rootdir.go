@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Tested
+// Map a path of the managed machine into the alternate root. Without -root the path is used as it is.
+func rootPath(path string) string {
+	if rootDirectory == "" {
+		return path
+	}
+	return filepath.Join(rootDirectory, path)
+}
+
+// Tested
+// Check the alternate root is an absolute path to a directory
+func checkRootDirectory(root string) error {
+	if !filepath.IsAbs(root) {
+		return fmt.Errorf("Root %s must be an absolute path", root)
+	}
+	fi, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("Root %s is not a directory", root)
+	}
+	return nil
+}
+
+// Tested
+// The arguments pointing the shadow-utils commands at the alternate root
+func rootArgs() []string {
+	if rootDirectory == "" {
+		return []string{}
+	}
+	return []string{"--root", rootDirectory}
+}
+
+// Tested
+// Get the home directory of a user, inside the alternate root when there is one
+func homeDirectory(userName string) string {
+	return rootPath("/home/" + userName)
+}
+
+// Tested
+// Look up the id of a user or group in a passwd or group file (name:password:id:...).
+// The bool is false when the name isn't in the file.
+func lookupIDInFile(file string, name string) (int, bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return -1, false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 3 || fields[0] != name {
+			continue
+		}
+		id, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return -1, false, fmt.Errorf("Invalid id %q of %s in %s", fields[2], name, file)
+		}
+		return id, true, nil
+	}
+	return -1, false, scanner.Err()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// write the passwd and group files of an alternate root into a temp directory and point -root at it
+func testRootDirectory(t *testing.T) (string, func()) {
+	root, err := ioutil.TempDir("", "argo-lyte-root")
+	assert.Nil(t, err)
+	assert.Nil(t, os.MkdirAll(root+"/etc", 0755))
+	assert.Nil(t, ioutil.WriteFile(root+"/etc/passwd", []byte("root:x:0:0:root:/root:/bin/bash\nbob:x:1001:1001::/home/bob:/bin/bash\n"), 0644))
+	assert.Nil(t, ioutil.WriteFile(root+"/etc/group", []byte("root:x:0:\nbob:x:1001:\nadmins:x:1002:bob\n"), 0644))
+
+	rootDirectory = root
+	return root, func() {
+		rootDirectory = ""
+		os.RemoveAll(root)
+	}
+}
+
+// rootPath, homeDirectory, rootArgs
+func TestRootPath(t *testing.T) {
+	assert.Equal(t, rootPath("/etc/sudoers.d"), "/etc/sudoers.d")
+	assert.Equal(t, homeDirectory("bob"), "/home/bob")
+	assert.Equal(t, rootArgs(), []string{})
+
+	rootDirectory = "/mnt/image"
+	defer func() { rootDirectory = "" }()
+	assert.Equal(t, rootPath("/etc/sudoers.d"), "/mnt/image/etc/sudoers.d")
+	assert.Equal(t, homeDirectory("bob"), "/mnt/image/home/bob")
+	assert.Equal(t, rootArgs(), []string{"--root", "/mnt/image"})
+}
+
+// checkRootDirectory
+func TestCheckRootDirectory(t *testing.T) {
+	root, cleanup := testRootDirectory(t)
+	defer cleanup()
+
+	assert.Nil(t, checkRootDirectory(root))
+	assert.Equal(t, checkRootDirectory("mnt/image").Error(), "Root mnt/image must be an absolute path")
+	assert.Equal(t, checkRootDirectory(root+"/etc/passwd").Error(), "Root "+root+"/etc/passwd is not a directory")
+	assert.True(t, os.IsNotExist(checkRootDirectory(root+"/missing")))
+}
+
+// lookupIDInFile
+func TestLookupIDInFile(t *testing.T) {
+	root, cleanup := testRootDirectory(t)
+	defer cleanup()
+
+	id, found, err := lookupIDInFile(root+"/etc/passwd", "bob")
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, id, 1001)
+
+	_, found, err = lookupIDInFile(root+"/etc/passwd", "alice")
+	assert.Nil(t, err)
+	assert.False(t, found)
+
+	assert.Nil(t, ioutil.WriteFile(root+"/etc/passwd", []byte("bob:x:bob:1001::/home/bob:/bin/bash\n"), 0644))
+	_, _, err = lookupIDInFile(root+"/etc/passwd", "bob")
+	assert.Equal(t, err.Error(), `Invalid id "bob" of bob in `+root+"/etc/passwd")
+}
+
+// getUIDByUserName, getGIDByGroupName, userExists inside an alternate root
+func TestLookupInRootDirectory(t *testing.T) {
+	_, cleanup := testRootDirectory(t)
+	defer cleanup()
+
+	uid, err := getUIDByUserName("bob")
+	assert.Nil(t, err)
+	assert.Equal(t, uid, 1001)
+
+	gid, err := getGIDByGroupName("admins")
+	assert.Nil(t, err)
+	assert.Equal(t, gid, 1002)
+
+	_, err = getGIDByGroupName("devs")
+	assert.Equal(t, err, user.UnknownGroupError("devs"))
+
+	exists, err := userExists("bob")
+	assert.Nil(t, err)
+	assert.True(t, exists)
+
+	exists, err = userExists("alice")
+	assert.Nil(t, err)
+	assert.False(t, exists)
+}
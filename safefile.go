@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Tested
+// Check the path is a directory and not a symlink planted in its place
+func checkDirectory(path string) (os.FileInfo, error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("Refusing to use %s: not a directory", path)
+	}
+	return fi, nil
+}
+
+// Tested
+// Check a file opened by readRegularFile can be read for the uid. With a uid of 0 or more the file must be owned
+// by it and have no other hard links, so a user can't get a file it can't read, like /etc/shadow, copied into
+// a file of its own. A uid below 0 skips these checks.
+func checkReadableFile(path string, fi os.FileInfo, uid int) error {
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("Refusing to read %s: not a regular file", path)
+	}
+	if uid < 0 {
+		return nil
+	}
+	if owner, _, ok := fileOwner(fi); ok && owner != uid {
+		return fmt.Errorf("Refusing to read %s: owned by uid %d instead of %d", path, owner, uid)
+	}
+	if links, ok := fileLinks(fi); ok && links != 1 {
+		return fmt.Errorf("Refusing to read %s: %d hard links", path, links)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// checkDirectory
+func TestCheckDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "argo-lyte-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = checkDirectory(dir)
+	assert.Nil(t, err)
+
+	assert.Nil(t, os.Symlink(dir, dir+"/link"))
+	_, err = checkDirectory(dir + "/link")
+	assert.Equal(t, err.Error(), "Refusing to use "+dir+"/link: not a directory")
+
+	assert.Nil(t, ioutil.WriteFile(dir+"/file", []byte("file\n"), 0600))
+	_, err = checkDirectory(dir + "/file")
+	assert.Equal(t, err.Error(), "Refusing to use "+dir+"/file: not a directory")
+
+	_, err = checkDirectory(dir + "/missing")
+	assert.True(t, os.IsNotExist(err))
+}
+
+// readRegularFile
+func TestReadRegularFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "argo-lyte-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	data, err := readRegularFile(dir+"/authorized_keys", os.Getuid())
+	assert.Nil(t, err)
+	assert.Equal(t, len(data), 0)
+
+	assert.Nil(t, ioutil.WriteFile(dir+"/authorized_keys", []byte("ssh-ed25519 AAAA\n"), 0600))
+	data, err = readRegularFile(dir+"/authorized_keys", os.Getuid())
+	assert.Nil(t, err)
+	assert.Equal(t, string(data), "ssh-ed25519 AAAA\n")
+
+	assert.Nil(t, os.Symlink(dir+"/authorized_keys", dir+"/link"))
+	_, err = readRegularFile(dir+"/link", -1)
+	assert.Equal(t, err.Error(), "Refusing to read "+dir+"/link: not a regular file")
+}
+
+func TestReadRegularFileOwner(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Files have no uid and hard links aren't counted on windows")
+	}
+	dir, err := ioutil.TempDir("", "argo-lyte-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, ioutil.WriteFile(dir+"/shadow", []byte("root:$6$secret:::\n"), 0600))
+
+	// the file must be the user's
+	_, err = readRegularFile(dir+"/shadow", os.Getuid()+1)
+	assert.Equal(t, err.Error(), fmt.Sprintf("Refusing to read %s/shadow: owned by uid %d instead of %d", dir, os.Getuid(), os.Getuid()+1))
+
+	// and not a hard link to another file
+	assert.Nil(t, os.Link(dir+"/shadow", dir+"/authorized_keys"))
+	_, err = readRegularFile(dir+"/authorized_keys", os.Getuid())
+	assert.Equal(t, err.Error(), "Refusing to read "+dir+"/authorized_keys: 2 hard links")
+
+	// files only root can write aren't checked
+	data, err := readRegularFile(dir+"/authorized_keys", -1)
+	assert.Nil(t, err)
+	assert.Equal(t, string(data), "root:$6$secret:::\n")
+}
+
+// writeFileAtomic
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "argo-lyte-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := dir + "/authorized_keys"
+	assert.Nil(t, writeFileAtomic(path, []byte("first\n"), 0600, -1, -1))
+	assert.Nil(t, writeFileAtomic(path, []byte("second\n"), 0644, -1, -1))
+
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, string(data), "second\n")
+
+	fi, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, fi.Mode().Perm(), os.FileMode(0644))
+
+	// no temp files are left behind
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, len(files), 1)
+}
+
+func TestWriteFileAtomicSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "argo-lyte-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	target := dir + "/target"
+	assert.Nil(t, ioutil.WriteFile(target, []byte("target\n"), 0600))
+
+	// a symlink planted in place of the file isn't followed
+	assert.Nil(t, os.Symlink(target, dir+"/authorized_keys"))
+	err = writeFileAtomic(dir+"/authorized_keys", []byte("keys\n"), 0600, -1, -1)
+	assert.Equal(t, err.Error(), "Refusing to replace "+dir+"/authorized_keys: not a regular file")
+
+	// nor one in place of the directory
+	assert.Nil(t, os.Mkdir(dir+"/real", 0700))
+	assert.Nil(t, os.Symlink(dir+"/real", dir+"/.ssh"))
+	err = writeFileAtomic(dir+"/.ssh/authorized_keys", []byte("keys\n"), 0600, -1, -1)
+	assert.Equal(t, err.Error(), "Refusing to use "+dir+"/.ssh: not a directory")
+
+	data, err := ioutil.ReadFile(target)
+	assert.Nil(t, err)
+	assert.Equal(t, string(data), "target\n")
+	_, err = os.Stat(dir + "/real/authorized_keys")
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,187 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// Tested
+// Open a directory refusing a symlink in its place. Files opened, created and renamed relative to the
+// descriptor stay in the directory checked, even when its path is swapped for a symlink afterwards.
+func openDirectory(path string) (int, error) {
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err == unix.ENOTDIR || err == unix.ELOOP {
+		return -1, fmt.Errorf("Refusing to use %s: not a directory", path)
+	}
+	if err != nil {
+		return -1, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return fd, nil
+}
+
+// Tested
+// Open a file for reading without following a symlink in its place or blocking on a fifo
+func openNoFollow(path string) (*os.File, error) {
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+// Tested
+// Read a file that must be a regular file, refusing symlinks. A missing file reads as empty.
+// The file is opened without following a symlink or blocking on a fifo, and the checks of checkReadableFile
+// are made on the file opened, so no other file can be swapped in between.
+func readRegularFile(path string, uid int) ([]byte, error) {
+	f, err := openNoFollow(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if errors.Is(err, unix.ELOOP) {
+		return nil, fmt.Errorf("Refusing to read %s: not a regular file", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	err = checkReadableFile(path, fi, uid)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(f)
+}
+
+// Tested
+// Create a temp file in the directory opened as dirfd, exclusively so it can't be a symlink left there
+func createTempFileAt(dirfd int, prefix string) (string, int, error) {
+	for i := 0; i < 10000; i++ {
+		name := prefix + strconv.FormatUint(uint64(rand.Uint32()), 10)
+		fd, err := unix.Openat(dirfd, name, unix.O_RDWR|unix.O_CREAT|unix.O_EXCL|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0600)
+		if err == unix.EEXIST {
+			continue
+		}
+		return name, fd, err
+	}
+	return "", -1, unix.EEXIST
+}
+
+// Tested
+// Replace a file atomically: the data goes to a temp file in the same directory that gets its mode and owner,
+// is synced to disk and renamed over the file. Readers see the old or the new file and never a partial one.
+// A uid below 0 keeps the owner of the process. The directory is opened once without following a symlink and the
+// temp file is created, chowned and renamed relative to it, so a symlink swapped in can't redirect the write.
+func writeFileAtomic(path string, data []byte, perm os.FileMode, uid int, gid int) error {
+	dir := filepath.Dir(path)
+	name := filepath.Base(path)
+	dirfd, err := openDirectory(dir)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dirfd)
+
+	var stat unix.Stat_t
+	err = unix.Fstatat(dirfd, name, &stat, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil && err != unix.ENOENT {
+		return &os.PathError{Op: "lstat", Path: path, Err: err}
+	}
+	if err == nil && stat.Mode&unix.S_IFMT != unix.S_IFREG {
+		return fmt.Errorf("Refusing to replace %s: not a regular file", path)
+	}
+
+	tmpName, fd, err := createTempFileAt(dirfd, "."+name+".")
+	if err != nil {
+		return &os.PathError{Op: "open", Path: filepath.Join(dir, "."+name+"."), Err: err}
+	}
+	tmp := os.NewFile(uintptr(fd), filepath.Join(dir, tmpName))
+	fail := func(err error) error {
+		tmp.Close()
+		unix.Unlinkat(dirfd, tmpName, 0)
+		return err
+	}
+
+	err = tmp.Chmod(perm)
+	if err != nil {
+		return fail(err)
+	}
+	if uid >= 0 {
+		err = tmp.Chown(uid, gid)
+		if err != nil {
+			return fail(err)
+		}
+	}
+	_, err = tmp.Write(data)
+	if err != nil {
+		return fail(err)
+	}
+	err = tmp.Sync()
+	if err != nil {
+		return fail(err)
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		unix.Unlinkat(dirfd, tmpName, 0)
+		return err
+	}
+	err = unix.Renameat(dirfd, tmpName, dirfd, name)
+	if err != nil {
+		unix.Unlinkat(dirfd, tmpName, 0)
+		return &os.LinkError{Op: "rename", Old: filepath.Join(dir, tmpName), New: path, Err: err}
+	}
+
+	// sync the directory so the rename survives a crash
+	unix.Fsync(dirfd)
+	return nil
+}
+
+// Tested
+// Create the directory name in parent unless it exists and give it to uid and gid. The bool is true when it was created.
+// It is created, opened and chowned relative to parent opened once without following symlinks, so a symlink
+// swapped in for either of them can't get another directory chowned.
+func ensureOwnedDirectory(parent string, name string, perm os.FileMode, uid int, gid int) (bool, error) {
+	path := filepath.Join(parent, name)
+	dirfd, err := openDirectory(parent)
+	if err != nil {
+		return false, err
+	}
+	defer unix.Close(dirfd)
+
+	created := true
+	err = unix.Mkdirat(dirfd, name, uint32(perm.Perm()))
+	if err == unix.EEXIST {
+		created = false
+	} else if err != nil {
+		return false, &os.PathError{Op: "mkdir", Path: path, Err: err}
+	}
+
+	fd, err := unix.Openat(dirfd, name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err == unix.ENOTDIR || err == unix.ELOOP {
+		return false, fmt.Errorf("Refusing to use %s: not a directory", path)
+	}
+	if err != nil {
+		return false, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	defer unix.Close(fd)
+
+	err = unix.Fchown(fd, uid, gid)
+	if err != nil {
+		return false, &os.PathError{Op: "chown", Path: path, Err: err}
+	}
+	return created, nil
+}
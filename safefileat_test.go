@@ -0,0 +1,74 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+// openDirectory
+func TestOpenDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "argo-lyte-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	fd, err := openDirectory(dir)
+	assert.Nil(t, err)
+	unix.Close(fd)
+
+	assert.Nil(t, os.Mkdir(dir+"/real", 0700))
+	assert.Nil(t, os.Symlink(dir+"/real", dir+"/link"))
+	_, err = openDirectory(dir + "/link")
+	assert.Equal(t, err.Error(), "Refusing to use "+dir+"/link: not a directory")
+
+	_, err = openDirectory(dir + "/missing")
+	assert.True(t, os.IsNotExist(err))
+}
+
+// readRegularFile
+func TestReadRegularFileFifo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "argo-lyte-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// a fifo planted in place of the file is refused without waiting for a writer
+	assert.Nil(t, syscall.Mkfifo(dir+"/authorized_keys", 0600))
+	_, err = readRegularFile(dir+"/authorized_keys", -1)
+	assert.Equal(t, err.Error(), "Refusing to read "+dir+"/authorized_keys: not a regular file")
+}
+
+// ensureOwnedDirectory
+func TestEnsureOwnedDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "argo-lyte-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	created, err := ensureOwnedDirectory(dir, ".ssh", 0700, os.Getuid(), os.Getgid())
+	assert.Nil(t, err)
+	assert.True(t, created)
+	fi, err := os.Lstat(dir + "/.ssh")
+	assert.Nil(t, err)
+	assert.True(t, fi.IsDir())
+	assert.Equal(t, fi.Mode().Perm(), os.FileMode(0700))
+
+	created, err = ensureOwnedDirectory(dir, ".ssh", 0700, os.Getuid(), os.Getgid())
+	assert.Nil(t, err)
+	assert.False(t, created)
+
+	// a symlink in place of the directory or of its parent isn't followed
+	assert.Nil(t, os.Mkdir(dir+"/real", 0700))
+	assert.Nil(t, os.Symlink(dir+"/real", dir+"/link"))
+	_, err = ensureOwnedDirectory(dir, "link", 0700, os.Getuid(), os.Getgid())
+	assert.Equal(t, err.Error(), "Refusing to use "+dir+"/link: not a directory")
+	_, err = ensureOwnedDirectory(dir+"/link", ".ssh", 0700, os.Getuid(), os.Getgid())
+	assert.Equal(t, err.Error(), "Refusing to use "+dir+"/link: not a directory")
+	_, err = os.Lstat(dir + "/real/.ssh")
+	assert.True(t, os.IsNotExist(err))
+}
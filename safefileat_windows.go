@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Not testable
+// Windows has no openat: the file is checked with Lstat and must still be the same file once opened
+func readRegularFile(path string, uid int) ([]byte, error) {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = checkReadableFile(path, fi, uid)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	opened, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !os.SameFile(fi, opened) {
+		return nil, fmt.Errorf("%s changed while reading it", path)
+	}
+	return ioutil.ReadAll(f)
+}
+
+// Not testable
+// Windows has no O_NOFOLLOW, the file is opened as it is
+func openNoFollow(path string) (*os.File, error) {
+	return os.Open(path)
+}
+
+// Not testable
+// Windows has no renameat: the directory is checked with Lstat before and after the temp file is written
+func writeFileAtomic(path string, data []byte, perm os.FileMode, uid int, gid int) error {
+	dir := filepath.Dir(path)
+	dirInfo, err := checkDirectory(dir)
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Lstat(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil && !fi.Mode().IsRegular() {
+		return fmt.Errorf("Refusing to replace %s: not a regular file", path)
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	fail := func(err error) error {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+
+	err = tmp.Chmod(perm)
+	if err != nil {
+		return fail(err)
+	}
+	if uid >= 0 {
+		err = tmp.Chown(uid, gid)
+		if err != nil {
+			return fail(err)
+		}
+	}
+	_, err = tmp.Write(data)
+	if err != nil {
+		return fail(err)
+	}
+	err = tmp.Sync()
+	if err != nil {
+		return fail(err)
+	}
+
+	current, err := os.Lstat(dir)
+	if err != nil {
+		return fail(err)
+	}
+	if !os.SameFile(dirInfo, current) {
+		return fail(fmt.Errorf("%s changed while writing %s", dir, path))
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	err = os.Rename(tmpName, path)
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return nil
+}
+
+// Not testable
+// Windows has no mkdirat: the directory is created and checked by path
+func ensureOwnedDirectory(parent string, name string, perm os.FileMode, uid int, gid int) (bool, error) {
+	_, err := checkDirectory(parent)
+	if err != nil {
+		return false, err
+	}
+	path := filepath.Join(parent, name)
+	created := false
+	_, err = os.Lstat(path)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(path, perm)
+		created = err == nil
+	}
+	if err != nil {
+		return false, err
+	}
+	_, err = checkDirectory(path)
+	if err != nil {
+		return false, err
+	}
+	return created, os.Lchown(path, uid, gid)
+}
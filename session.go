@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Where the processes of the machine are listed
+var procDirectory = "/proc"
+
+// The signals -killsignal accepts
+var killSignals = map[string]syscall.Signal{
+	"TERM": syscall.SIGTERM,
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+}
+
+// userProcess - a process of a user, with its command name for the report
+type userProcess struct {
+	PID     int
+	Command string
+}
+
+// Tested
+// Get the signal named by -killsignal, with or without SIG
+func parseKillSignal(name string) (syscall.Signal, error) {
+	sig, ok := killSignals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	if !ok {
+		return 0, fmt.Errorf("Unknown signal %q, expected TERM, HUP, INT, QUIT or KILL", name)
+	}
+	return sig, nil
+}
+
+// Tested
+// List the processes whose real or effective uid is the user's from the status files of /proc.
+// Processes that exit while they are listed are skipped. A machine without /proc has none.
+func listUserProcesses(procDir string, uid int) ([]userProcess, error) {
+	procs := make([]userProcess, 0)
+	entries, err := ioutil.ReadDir(procDir)
+	if os.IsNotExist(err) {
+		return procs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		status, err := ioutil.ReadFile(procDir + "/" + entry.Name() + "/status")
+		if err != nil {
+			continue
+		}
+
+		command := ""
+		owned := false
+		for _, line := range strings.Split(string(status), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				continue
+			}
+			switch fields[0] {
+			case "Name:":
+				command = fields[1]
+			case "Uid:":
+				// a short line has no real and effective uid, the process is skipped
+				if len(fields) < 3 {
+					continue
+				}
+				for _, id := range fields[1:3] {
+					if id == strconv.Itoa(uid) {
+						owned = true
+					}
+				}
+			}
+		}
+		if owned {
+			procs = append(procs, userProcess{PID: pid, Command: command})
+		}
+	}
+	sort.Slice(procs, func(i, j int) bool { return procs[i].PID < procs[j].PID })
+	return procs, nil
+}
+
+// Tested
+// Check the state of a process in /proc is zombie (Z) or dead (X). Without its status it can't tell and says no.
+func processIsZombie(procDir string, pid int) bool {
+	status, err := ioutil.ReadFile(procDir + "/" + strconv.Itoa(pid) + "/status")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "State:" {
+			return fields[1] == "Z" || fields[1] == "X"
+		}
+	}
+	return false
+}
+
+// Tested
+// Send the processes the signal, give them the timeout to exit and kill the ones still running.
+// Return the processes that were still running after the timeout.
+func killProcesses(procs []userProcess, sig syscall.Signal, timeout time.Duration) []userProcess {
+	for _, proc := range procs {
+		if p, err := os.FindProcess(proc.PID); err == nil {
+			p.Signal(sig)
+		}
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		running := make([]userProcess, 0)
+		for _, proc := range procs {
+			if processExists(proc.PID) {
+				running = append(running, proc)
+			}
+		}
+		if len(running) == 0 || sig == syscall.SIGKILL {
+			return running
+		}
+		if time.Now().After(deadline) {
+			for _, proc := range running {
+				if p, err := os.FindProcess(proc.PID); err == nil {
+					p.Signal(syscall.SIGKILL)
+				}
+			}
+			return running
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Tested
+// Describe processes for the report, ex. bash(1201), sshd(1200)
+func describeProcesses(procs []userProcess) string {
+	described := make([]string, 0)
+	for _, proc := range procs {
+		described = append(described, fmt.Sprintf("%s(%d)", proc.Command, proc.PID))
+	}
+	return strings.Join(described, ", ")
+}
+
+// Tested
+// End the sessions and processes of a user before it is locked or deleted, when -terminatesessions is on:
+// logind's sessions with loginctl terminate-user, then whatever still runs as the user with -killsignal,
+// and with SIGKILL once -killtimeout is over. What was killed is reported as a warning for the user.
+// An image provisioned with -root has no sessions.
+func terminateUserSessions(accounts AccountManager, userName string) error {
+	if !terminateSessions || rootDirectory != "" {
+		return nil
+	}
+	sig, err := parseKillSignal(killSignal)
+	if err != nil {
+		return err
+	}
+	uid, _, err := accounts.UserIDs(userName)
+	if err != nil {
+		return err
+	}
+	if uid == 0 {
+		return fmt.Errorf("Refusing to kill the processes of %s: uid 0", userName)
+	}
+
+	// loginctl fails for a user without sessions, which is fine
+	if _, err := exec.LookPath("loginctl"); err == nil {
+		out, err := exec.Command("loginctl", "terminate-user", userName).CombinedOutput()
+		if err != nil {
+			fmt.Printf("loginctl terminate-user %s: %s: %s\n", userName, err, strings.TrimSpace(string(out)))
+		}
+	}
+
+	procs, err := listUserProcesses(procDirectory, uid)
+	if err != nil {
+		return err
+	}
+	if len(procs) == 0 {
+		return nil
+	}
+	fmt.Printf("Terminating the processes of %s: %s\n", userName, describeProcesses(procs))
+	killed := killProcesses(procs, sig, killTimeout)
+
+	report := fmt.Sprintf("terminated %d processes: %s", len(procs), describeProcesses(procs))
+	if len(killed) > 0 && sig != syscall.SIGKILL {
+		report += fmt.Sprintf("; killed %s after %s", describeProcesses(killed), killTimeout)
+	}
+	recordWarning("user", userName, errors.New(report))
+	return nil
+}
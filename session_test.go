@@ -0,0 +1,169 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// a fake /proc with the status files of processes, and the global pointed at it
+func testProcDirectory(t *testing.T, statuses map[int]string) (string, func()) {
+	dir, err := ioutil.TempDir("", "argo-lyte-proc")
+	assert.Nil(t, err)
+	for pid, status := range statuses {
+		assert.Nil(t, os.MkdirAll(dir+"/"+strconv.Itoa(pid), 0755))
+		assert.Nil(t, ioutil.WriteFile(dir+"/"+strconv.Itoa(pid)+"/status", []byte(status), 0644))
+	}
+	assert.Nil(t, os.MkdirAll(dir+"/sys", 0755))
+
+	procDirectory = dir
+	return dir, func() {
+		procDirectory = "/proc"
+		os.RemoveAll(dir)
+	}
+}
+
+// the status file of a process
+func testProcStatus(name string, uid int) string {
+	return "Name:\t" + name + "\nState:\tS (sleeping)\nUid:\t" + strconv.Itoa(uid) + "\t" + strconv.Itoa(uid) + "\t" + strconv.Itoa(uid) + "\t" + strconv.Itoa(uid) + "\n"
+}
+
+// start a process that runs until it is killed, reaped as soon as it exits
+func testStartProcess(t *testing.T) int {
+	if runtime.GOOS == "windows" {
+		t.Skip("Signals are unix only")
+	}
+	cmd := exec.Command("sleep", "60")
+	assert.Nil(t, cmd.Start())
+	go cmd.Wait()
+	return cmd.Process.Pid
+}
+
+// parseKillSignal
+func TestParseKillSignal(t *testing.T) {
+	sig, err := parseKillSignal("TERM")
+	assert.Nil(t, err)
+	assert.Equal(t, sig, syscall.SIGTERM)
+
+	sig, err = parseKillSignal("sighup")
+	assert.Nil(t, err)
+	assert.Equal(t, sig, syscall.SIGHUP)
+
+	_, err = parseKillSignal("USR1")
+	assert.Equal(t, err.Error(), `Unknown signal "USR1", expected TERM, HUP, INT, QUIT or KILL`)
+}
+
+// listUserProcesses, describeProcesses
+func TestListUserProcesses(t *testing.T) {
+	dir, cleanup := testProcDirectory(t, map[int]string{
+		1200: testProcStatus("sshd", 1001),
+		1201: testProcStatus("bash", 1001),
+		1300: testProcStatus("cron", 0),
+		1301: "Name:\tsu\nUid:\t0\t1001\t0\t0\n",
+		1302: "Name:\tbroken\nUid:\t1001\n",
+	})
+	defer cleanup()
+
+	// a status with a short Uid line is skipped
+	procs, err := listUserProcesses(dir, 1001)
+	assert.Nil(t, err)
+	assert.Equal(t, procs, []userProcess{{1200, "sshd"}, {1201, "bash"}, {1301, "su"}})
+	assert.Equal(t, describeProcesses(procs), "sshd(1200), bash(1201), su(1301)")
+
+	procs, err = listUserProcesses(dir+"/missing", 1001)
+	assert.Nil(t, err)
+	assert.Equal(t, len(procs), 0)
+}
+
+// killProcesses
+func TestKillProcesses(t *testing.T) {
+	pid := testStartProcess(t)
+	running := killProcesses([]userProcess{{pid, "sleep"}}, syscall.SIGTERM, 5*time.Second)
+	assert.Equal(t, len(running), 0)
+	assert.False(t, processExists(pid))
+
+	// a process that ignores the signal is killed after the timeout
+	pid = testStartProcess(t)
+	running = killProcesses([]userProcess{{pid, "sleep"}}, syscall.Signal(0), 200*time.Millisecond)
+	assert.Equal(t, running, []userProcess{{pid, "sleep"}})
+	time.Sleep(200 * time.Millisecond)
+	assert.False(t, processExists(pid))
+}
+
+// processIsZombie
+func TestProcessIsZombie(t *testing.T) {
+	dir, cleanup := testProcDirectory(t, map[int]string{
+		1200: testProcStatus("sshd", 1001),
+		1201: "Name:\tbash\nState:\tZ (zombie)\nUid:\t1001\t1001\t1001\t1001\n",
+		1202: "Name:\tbash\nState:\tX (dead)\n",
+	})
+	defer cleanup()
+
+	assert.False(t, processIsZombie(dir, 1200))
+	assert.True(t, processIsZombie(dir, 1201))
+	assert.True(t, processIsZombie(dir, 1202))
+	assert.False(t, processIsZombie(dir, 1300))
+}
+
+// killProcesses with a process that exits but isn't reaped
+func TestKillProcessesZombie(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Zombies are read from /proc")
+	}
+	cmd := exec.Command("sleep", "60")
+	assert.Nil(t, cmd.Start())
+	defer cmd.Wait()
+
+	// the zombie counts as gone, so there is no wait for the timeout and no SIGKILL
+	start := time.Now()
+	running := killProcesses([]userProcess{{cmd.Process.Pid, "sleep"}}, syscall.SIGTERM, 5*time.Second)
+	assert.Equal(t, len(running), 0)
+	assert.True(t, time.Since(start) < 2*time.Second)
+	assert.False(t, processExists(cmd.Process.Pid))
+}
+
+// terminateUserSessions
+func TestTerminateUserSessions(t *testing.T) {
+	pid := testStartProcess(t)
+	_, cleanup := testProcDirectory(t, map[int]string{pid: testProcStatus("sleep", 4242)})
+	defer cleanup()
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", procDirectory+"/sys")
+	defer os.Setenv("PATH", path)
+	warnings = nil
+	defer func() { warnings = nil }()
+
+	// nothing is killed unless it is turned on
+	accounts := &testUIDAccounts{newFakeAccounts(), 4242}
+	terminateSessions = false
+	assert.Nil(t, terminateUserSessions(accounts, "bob"))
+	assert.True(t, processExists(pid))
+
+	terminateSessions = true
+	killSignal = "TERM"
+	defer func() { terminateSessions = false }()
+	assert.Nil(t, terminateUserSessions(accounts, "bob"))
+	assert.False(t, processExists(pid))
+	assert.Equal(t, len(warnings), 1)
+	assert.Equal(t, warnings[0].Message, "terminated 1 processes: sleep("+strconv.Itoa(pid)+")")
+
+	accounts.uid = 0
+	assert.Equal(t, terminateUserSessions(accounts, "bob").Error(), "Refusing to kill the processes of bob: uid 0")
+}
+
+// testUIDAccounts - a fakeAccounts whose users have a given uid
+type testUIDAccounts struct {
+	*fakeAccounts
+	uid int
+}
+
+func (a *testUIDAccounts) UserIDs(userName string) (int, int, error) {
+	return a.uid, a.uid, nil
+}
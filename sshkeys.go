@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshd accepts expiry-time as YYYYMMDD[HHMM[SS]], in local time or UTC with a trailing Z
+var expiryTimePattern = regexp.MustCompile(`^[0-9]{8}([0-9]{4}([0-9]{2})?)?Z?$`)
+
+// environment variable names sshd accepts in environment=
+var environmentNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Tested
+// Read a ssh key of a user file, either the authorized_keys line or the object with the key, options and comment
+func (key *SSHKey) UnmarshalJSON(data []byte) error {
+	var line string
+	if err := json.Unmarshal(data, &line); err == nil {
+		*key = SSHKey{Key: line}
+		return nil
+	}
+
+	// the decoder of the user file doesn't pass on DisallowUnknownFields, so the object is decoded strictly here
+	type sshKeyObject SSHKey
+	var object sshKeyObject
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&object); err != nil {
+		return err
+	}
+	if err := checkSSHKeyObject(SSHKey(object)); err != nil {
+		return err
+	}
+	*key = SSHKey(object)
+	return nil
+}
+
+// Tested
+// Read a ssh key of a yaml user file, either the authorized_keys line or the object with the key, options and comment
+func (key *SSHKey) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var line string
+	if err := unmarshal(&line); err == nil {
+		*key = SSHKey{Key: line}
+		return nil
+	}
+
+	type sshKeyObject SSHKey
+	var object sshKeyObject
+	if err := unmarshal(&object); err != nil {
+		return err
+	}
+	if err := checkSSHKeyObject(SSHKey(object)); err != nil {
+		return err
+	}
+	*key = SSHKey(object)
+	return nil
+}
+
+// Tested
+// Read a ssh key of a toml user file. toml hands over the decoded value, which goes through
+// json so the object gets the same strict checks.
+func (key *SSHKey) UnmarshalTOML(data interface{}) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return key.UnmarshalJSON(encoded)
+}
+
+// Tested
+// Check the options of a ssh key object can be written to authorized_keys as they are
+func checkSSHKeyObject(key SSHKey) error {
+	if strings.TrimSpace(key.Key) == "" {
+		return errors.New("Missing key")
+	}
+
+	values := append([]string{key.Key, key.Comment, key.Options.Command}, key.Options.From...)
+	for name, value := range key.Options.Environment {
+		if !environmentNamePattern.MatchString(name) {
+			return fmt.Errorf("Invalid environment variable name %q", name)
+		}
+		values = append(values, value)
+	}
+	for _, value := range values {
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("Ssh key values can't span more than one line: %q", value)
+		}
+	}
+
+	for _, from := range key.Options.From {
+		if from == "" || strings.ContainsAny(from, "\", ") {
+			return fmt.Errorf("Invalid from pattern %q", from)
+		}
+	}
+	if key.Options.ExpiryTime != "" && !expiryTimePattern.MatchString(key.Options.ExpiryTime) {
+		return fmt.Errorf("Invalid expiry-time %q, use YYYYMMDD[HHMM[SS]]", key.Options.ExpiryTime)
+	}
+	return nil
+}
+
+// Tested
+// Quote an option value for authorized_keys. sshd only unescapes \" inside the quotes.
+func quoteOption(value string) string {
+	return "\"" + strings.Replace(value, "\"", "\\\"", -1) + "\""
+}
+
+// Tested
+// Render a ssh key as its authorized_keys line, options first and the comment last.
+// The options are always written in the same order so the same key always renders the same line.
+func renderSSHKey(key SSHKey) string {
+	options := make([]string, 0)
+	if len(key.Options.From) > 0 {
+		options = append(options, "from="+quoteOption(strings.Join(key.Options.From, ",")))
+	}
+	if key.Options.Command != "" {
+		options = append(options, "command="+quoteOption(key.Options.Command))
+	}
+	names := make([]string, 0)
+	for name := range key.Options.Environment {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		options = append(options, "environment="+quoteOption(name+"="+key.Options.Environment[name]))
+	}
+	if key.Options.ExpiryTime != "" {
+		options = append(options, "expiry-time="+quoteOption(key.Options.ExpiryTime))
+	}
+	if key.Options.NoAgentForwarding {
+		options = append(options, "no-agent-forwarding")
+	}
+	if key.Options.NoPortForwarding {
+		options = append(options, "no-port-forwarding")
+	}
+	if key.Options.NoPty {
+		options = append(options, "no-pty")
+	}
+	if key.Options.NoX11Forwarding {
+		options = append(options, "no-x11-forwarding")
+	}
+
+	line := strings.TrimSpace(key.Key)
+	// the comment of the object replaces the one of the key
+	if key.Comment != "" {
+		fields := strings.Fields(line)
+		if len(fields) > 2 {
+			fields = fields[:2]
+		}
+		line = strings.Join(fields, " ") + " " + key.Comment
+	}
+	if len(options) > 0 {
+		line = strings.Join(options, ",") + " " + line
+	}
+	return line
+}
+
+// Tested
+// Render the ssh keys of a user as authorized_keys lines
+func renderSSHKeys(keys []SSHKey) []string {
+	lines := make([]string, 0)
+	for _, key := range keys {
+		lines = append(lines, renderSSHKey(key))
+	}
+	return lines
+}
+
+// Tested
+// Wrap authorized_keys lines as ssh keys
+func plainSSHKeys(lines []string) []SSHKey {
+	keys := make([]SSHKey, 0)
+	for _, line := range lines {
+		keys = append(keys, SSHKey{Key: line})
+	}
+	return keys
+}
+
+// Tested
+// Name a ssh key in messages by its fingerprint, or by the key itself when it doesn't parse
+func sshKeyName(key SSHKey) string {
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key.Key))
+	if err != nil {
+		return fmt.Sprintf("%q", key.Key)
+	}
+	return ssh.FingerprintSHA256(publicKey)
+}
+
+// Tested
+// Drop the keys that expired by now. The expired keys and the keys expiring within the warning window are returned as problems.
+func expireSSHKeys(keys []SSHKey, now time.Time, warning time.Duration) ([]SSHKey, []error) {
+	activeKeys := make([]SSHKey, 0)
+	problems := make([]error, 0)
+	for _, key := range keys {
+		if !key.Expires.IsZero() {
+			if !now.Before(key.Expires) {
+				problems = append(problems, fmt.Errorf("Key %s expired at %s", sshKeyName(key), key.Expires.Format(time.RFC3339)))
+				continue
+			}
+			if now.Add(warning).After(key.Expires) {
+				problems = append(problems, fmt.Errorf("Key %s expires at %s", sshKeyName(key), key.Expires.Format(time.RFC3339)))
+			}
+		}
+		activeKeys = append(activeKeys, key)
+	}
+	return activeKeys, problems
+}
+
+// Tested
+// Parse an authorized_keys entry and return it normalized to "options type base64 comment" along with
+// its SHA256 fingerprint, so extra whitespace or a reformatted key doesn't look like a different key.
+func normalizeSSHKey(sshKey string) (string, string, error) {
+	// ParseAuthorizedKey skips lines it can't parse, so an entry hiding a second line is refused outright
+	if strings.ContainsAny(sshKey, "\r\n") {
+		return "", "", fmt.Errorf("Invalid ssh key %q: more than one line", sshKey)
+	}
+
+	publicKey, comment, options, _, err := ssh.ParseAuthorizedKey([]byte(sshKey))
+	if err != nil {
+		return "", "", fmt.Errorf("Invalid ssh key %q: %s", sshKey, err.Error())
+	}
+
+	normalized := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey)))
+	// options such as from= restrict the key, so they are kept rather than dropped
+	if len(options) > 0 {
+		normalized = strings.Join(options, ",") + " " + normalized
+	}
+	if comment != "" {
+		normalized += " " + comment
+	}
+	return normalized, ssh.FingerprintSHA256(publicKey), nil
+}
+
+// Tested
+// Normalize the ssh keys of a user. Keys that don't parse and keys whose fingerprint is already
+// in the list are dropped and returned as problems so the caller can warn about them.
+func normalizeSSHKeys(sshKeys []string) ([]string, []error) {
+	normalizedKeys := make([]string, 0)
+	problems := make([]error, 0)
+	mFingerprint := make(map[string]bool)
+	for _, sshKey := range sshKeys {
+		normalized, fingerprint, err := normalizeSSHKey(sshKey)
+		if err != nil {
+			problems = append(problems, err)
+			continue
+		}
+		if mFingerprint[fingerprint] {
+			problems = append(problems, fmt.Errorf("Duplicate ssh key %s", fingerprint))
+			continue
+		}
+		mFingerprint[fingerprint] = true
+		normalizedKeys = append(normalizedKeys, normalized)
+	}
+	return normalizedKeys, problems
+}
+
+// Tested
+// Normalize the ssh keys stored in leveldb before comparing them with the bundle. Keys stored by older
+// versions that don't parse are kept as they are so the comparison removes them from authorized_keys.
+func normalizeStoredSSHKeys(sshKeys []string) []string {
+	normalizedKeys := make([]string, 0)
+	for _, sshKey := range sshKeys {
+		normalized, _, err := normalizeSSHKey(sshKey)
+		if err != nil {
+			normalized = sshKey
+		}
+		normalizedKeys = append(normalizedKeys, normalized)
+	}
+	return normalizedKeys
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// normalizeSSHKey
+func TestNormalizeSSHKeyPass(t *testing.T) {
+	sshKey := testSSHKey(t, "bob@laptop")
+	fields := strings.Fields(sshKey)
+
+	normalized, fingerprint, err := normalizeSSHKey("  " + fields[0] + "   " + fields[1] + "\t" + fields[2] + "  ")
+	assert.Nil(t, err)
+	assert.Equal(t, normalized, sshKey)
+	assert.True(t, strings.HasPrefix(fingerprint, "SHA256:"))
+}
+
+func TestNormalizeSSHKeyNoComment(t *testing.T) {
+	sshKey := strings.Fields(testSSHKey(t, "bob@laptop"))
+	normalized, _, err := normalizeSSHKey(sshKey[0] + " " + sshKey[1])
+	assert.Nil(t, err)
+	assert.Equal(t, normalized, sshKey[0]+" "+sshKey[1])
+}
+
+func TestNormalizeSSHKeyOptions(t *testing.T) {
+	sshKey := testSSHKey(t, "bob@laptop")
+	normalized, _, err := normalizeSSHKey(`from="10.0.0.0/8",no-pty ` + sshKey)
+	assert.Nil(t, err)
+	assert.Equal(t, normalized, `from="10.0.0.0/8",no-pty `+sshKey)
+}
+
+func TestNormalizeSSHKeyFail(t *testing.T) {
+	_, _, err := normalizeSSHKey("ssh_key1")
+	assert.Equal(t, err.Error(), `Invalid ssh key "ssh_key1": ssh: no key found`)
+
+	_, _, err = normalizeSSHKey("ssh_key1\n" + testSSHKey(t, "bob@laptop"))
+	assert.True(t, strings.HasSuffix(err.Error(), ": more than one line"))
+}
+
+// normalizeSSHKeys
+func TestNormalizeSSHKeys(t *testing.T) {
+	bobKey := testSSHKey(t, "bob@laptop")
+	aliceKey := testSSHKey(t, "alice@laptop")
+	bobFields := strings.Fields(bobKey)
+
+	sshKeys, problems := normalizeSSHKeys([]string{bobKey, "ssh_key1", aliceKey, bobFields[0] + " " + bobFields[1] + " bob@desktop"})
+	assert.Equal(t, sshKeys, []string{bobKey, aliceKey})
+	assert.Equal(t, len(problems), 2)
+	assert.Equal(t, problems[0].Error(), `Invalid ssh key "ssh_key1": ssh: no key found`)
+	assert.True(t, strings.HasPrefix(problems[1].Error(), "Duplicate ssh key SHA256:"))
+}
+
+func TestNormalizeSSHKeysEmpty(t *testing.T) {
+	sshKeys, problems := normalizeSSHKeys(nil)
+	assert.Equal(t, len(sshKeys), 0)
+	assert.Equal(t, len(problems), 0)
+}
+
+// normalizeStoredSSHKeys
+func TestNormalizeStoredSSHKeys(t *testing.T) {
+	sshKey := testSSHKey(t, "bob@laptop")
+	sshKeys := normalizeStoredSSHKeys([]string{sshKey + "  ", "ssh_key1"})
+	assert.Equal(t, sshKeys, []string{sshKey, "ssh_key1"})
+}
+
+// SSHKey unmarshal
+func TestSSHKeyUnmarshalJSON(t *testing.T) {
+	var user ArgoUser
+	data := `{"id":"ci","shell":"/bin/sh","ssh_keys":["ssh-ed25519 AAAA ci@laptop",` +
+		`{"key":"ssh-ed25519 BBBB","comment":"deploy","options":{"from":["10.0.0.0/8"],"command":"/usr/bin/deploy","no-pty":true}}]}`
+	err := unmarshalStrict([]byte(data), &user)
+	assert.Nil(t, err)
+	assert.Equal(t, user.SSHkeys, []SSHKey{
+		{Key: "ssh-ed25519 AAAA ci@laptop"},
+		{Key: "ssh-ed25519 BBBB", Comment: "deploy", Options: SSHKeyOptions{From: []string{"10.0.0.0/8"}, Command: "/usr/bin/deploy", NoPty: true}},
+	})
+}
+
+func TestSSHKeyUnmarshalJSONFail(t *testing.T) {
+	var user ArgoUser
+	err := unmarshalStrict([]byte(`{"id":"ci","shell":"/bin/sh","ssh_keys":[{"key":"ssh-ed25519 BBBB","options":{"nopty":true}}]}`), &user)
+	assert.Equal(t, err.Error(), `json: unknown field "nopty"`)
+
+	err = unmarshalStrict([]byte(`{"id":"ci","shell":"/bin/sh","ssh_keys":[{"options":{"no-pty":true}}]}`), &user)
+	assert.Equal(t, err.Error(), "Missing key")
+}
+
+func TestSSHKeyUnmarshalYAML(t *testing.T) {
+	var user ArgoUser
+	data := "id: ci\nshell: /bin/sh\nssh_keys:\n" +
+		"  - ssh-ed25519 AAAA ci@laptop\n" +
+		"  - key: ssh-ed25519 BBBB\n" +
+		"    options:\n" +
+		"      environment: {DEPLOY_ENV: prod}\n" +
+		"      no-port-forwarding: true\n"
+	err := unmarshalDefinition("ci.yaml", []byte(data), &user)
+	assert.Nil(t, err)
+	assert.Equal(t, user.SSHkeys, []SSHKey{
+		{Key: "ssh-ed25519 AAAA ci@laptop"},
+		{Key: "ssh-ed25519 BBBB", Options: SSHKeyOptions{Environment: map[string]string{"DEPLOY_ENV": "prod"}, NoPortForwarding: true}},
+	})
+
+	err = unmarshalDefinition("ci.yaml", []byte("id: ci\nssh_keys:\n  - key: ssh-ed25519 BBBB\n    opts: {}\n"), &user)
+	assert.NotNil(t, err)
+}
+
+func TestSSHKeyUnmarshalTOML(t *testing.T) {
+	var user ArgoUser
+	data := "id = \"ci\"\nshell = \"/bin/sh\"\nssh_keys = [\n" +
+		"  \"ssh-ed25519 AAAA ci@laptop\",\n" +
+		"  { key = \"ssh-ed25519 BBBB\", options = { expiry-time = \"20270101\", no-agent-forwarding = true } },\n" +
+		"]\n"
+	err := unmarshalDefinition("ci.toml", []byte(data), &user)
+	assert.Nil(t, err)
+	assert.Equal(t, user.SSHkeys, []SSHKey{
+		{Key: "ssh-ed25519 AAAA ci@laptop"},
+		{Key: "ssh-ed25519 BBBB", Options: SSHKeyOptions{ExpiryTime: "20270101", NoAgentForwarding: true}},
+	})
+
+	err = unmarshalDefinition("ci.toml", []byte("id = \"ci\"\nssh_keys = [{ key = \"ssh-ed25519 BBBB\", opts = 1 }]\n"), &user)
+	assert.Equal(t, err.Error(), `json: unknown field "opts"`)
+}
+
+// checkSSHKeyObject
+func TestCheckSSHKeyObjectFail(t *testing.T) {
+	err := checkSSHKeyObject(SSHKey{Key: "ssh-ed25519 BBBB", Options: SSHKeyOptions{Command: "ls\nrm -rf /"}})
+	assert.Equal(t, err.Error(), `Ssh key values can't span more than one line: "ls\nrm -rf /"`)
+
+	err = checkSSHKeyObject(SSHKey{Key: "ssh-ed25519 BBBB", Options: SSHKeyOptions{From: []string{"10.0.0.1, 10.0.0.2"}}})
+	assert.Equal(t, err.Error(), `Invalid from pattern "10.0.0.1, 10.0.0.2"`)
+
+	err = checkSSHKeyObject(SSHKey{Key: "ssh-ed25519 BBBB", Options: SSHKeyOptions{Environment: map[string]string{"A B": "1"}}})
+	assert.Equal(t, err.Error(), `Invalid environment variable name "A B"`)
+
+	err = checkSSHKeyObject(SSHKey{Key: "ssh-ed25519 BBBB", Options: SSHKeyOptions{ExpiryTime: "2027-01-01"}})
+	assert.Equal(t, err.Error(), `Invalid expiry-time "2027-01-01", use YYYYMMDD[HHMM[SS]]`)
+}
+
+// quoteOption
+func TestQuoteOption(t *testing.T) {
+	assert.Equal(t, quoteOption(`echo "hi"`), `"echo \"hi\""`)
+}
+
+// renderSSHKey
+func TestRenderSSHKey(t *testing.T) {
+	assert.Equal(t, renderSSHKey(SSHKey{Key: "ssh-ed25519 AAAA bob@laptop"}), "ssh-ed25519 AAAA bob@laptop")
+
+	key := SSHKey{
+		Key:     "ssh-ed25519 AAAA bob@laptop",
+		Comment: "ci deploy",
+		Options: SSHKeyOptions{
+			From:              []string{"10.0.0.0/8", "*.example.com"},
+			Command:           `/usr/bin/deploy "prod"`,
+			Environment:       map[string]string{"B": "2", "A": "1"},
+			ExpiryTime:        "20270101",
+			NoAgentForwarding: true,
+			NoPortForwarding:  true,
+			NoPty:             true,
+			NoX11Forwarding:   true,
+		},
+	}
+	assert.Equal(t, renderSSHKey(key), `from="10.0.0.0/8,*.example.com",command="/usr/bin/deploy \"prod\"",`+
+		`environment="A=1",environment="B=2",expiry-time="20270101",`+
+		`no-agent-forwarding,no-port-forwarding,no-pty,no-x11-forwarding ssh-ed25519 AAAA ci deploy`)
+}
+
+func TestRenderSSHKeyNormalized(t *testing.T) {
+	// a rendered key survives normalization as it is, so its options take part in the comparison with leveldb
+	key := SSHKey{Key: testSSHKey(t, "ci@laptop"), Options: SSHKeyOptions{From: []string{"10.0.0.0/8"}, Command: `echo "hi"`, NoPty: true}}
+	normalized, _, err := normalizeSSHKey(renderSSHKey(key))
+	assert.Nil(t, err)
+	assert.Equal(t, normalized, renderSSHKey(key))
+
+	key.Options.NoPty = false
+	assert.NotEqual(t, normalized, renderSSHKey(key))
+}
+
+// renderSSHKeys, plainSSHKeys
+func TestRenderSSHKeys(t *testing.T) {
+	lines := []string{"ssh-ed25519 AAAA bob@laptop", "ssh-ed25519 BBBB"}
+	assert.Equal(t, renderSSHKeys(plainSSHKeys(lines)), lines)
+	assert.Equal(t, len(renderSSHKeys(nil)), 0)
+}
+
+// sshKeyName
+func TestSSHKeyName(t *testing.T) {
+	assert.True(t, strings.HasPrefix(sshKeyName(SSHKey{Key: testSSHKey(t, "bob@laptop")}), "SHA256:"))
+	assert.Equal(t, sshKeyName(SSHKey{Key: "ssh_key1"}), `"ssh_key1"`)
+}
+
+// expireSSHKeys
+func TestExpireSSHKeys(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	permanent := SSHKey{Key: "ssh_key1"}
+	expired := SSHKey{Key: "ssh_key2", Expires: now}
+	expiring := SSHKey{Key: "ssh_key3", Expires: now.Add(48 * time.Hour)}
+	later := SSHKey{Key: "ssh_key4", Expires: now.Add(30 * 24 * time.Hour)}
+
+	keys, problems := expireSSHKeys([]SSHKey{permanent, expired, expiring, later}, now, 7*24*time.Hour)
+	assert.Equal(t, keys, []SSHKey{permanent, expiring, later})
+	assert.Equal(t, len(problems), 2)
+	assert.Equal(t, problems[0].Error(), `Key "ssh_key2" expired at 2026-10-19T12:00:00Z`)
+	assert.Equal(t, problems[1].Error(), `Key "ssh_key3" expires at 2026-10-21T12:00:00Z`)
+}
+
+func TestSSHKeyUnmarshalExpires(t *testing.T) {
+	expires := time.Date(2026, 12, 31, 18, 0, 0, 0, time.UTC)
+
+	var user ArgoUser
+	err := unmarshalStrict([]byte(`{"id":"ir","ssh_keys":[{"key":"ssh-ed25519 AAAA","expires":"2026-12-31T18:00:00Z"}]}`), &user)
+	assert.Nil(t, err)
+	assert.True(t, user.SSHkeys[0].Expires.Equal(expires))
+
+	err = unmarshalDefinition("ir.yaml", []byte("id: ir\nssh_keys:\n  - {key: ssh-ed25519 AAAA, expires: 2026-12-31T18:00:00Z}\n"), &user)
+	assert.Nil(t, err)
+	assert.True(t, user.SSHkeys[0].Expires.Equal(expires))
+
+	err = unmarshalDefinition("ir.toml", []byte("id = \"ir\"\nssh_keys = [{ key = \"ssh-ed25519 AAAA\", expires = 2026-12-31T18:00:00Z }]\n"), &user)
+	assert.Nil(t, err)
+	assert.True(t, user.SSHkeys[0].Expires.Equal(expires))
+}
@@ -1,23 +1,91 @@
 package main
 
+import "time"
+
 // ArgoGroup -
 type ArgoGroup struct {
-	ID     string   `json:"id"`
-	Users  []string `json:"users"`
-	Admins []string `json:"admins"`
+	ID     string   `json:"id" yaml:"id" toml:"id"`
+	Users  []string `json:"users" yaml:"users" toml:"users"`
+	Admins []string `json:"admins" yaml:"admins" toml:"admins"`
 }
 
 // ArgoUser -
 type ArgoUser struct {
-	SSHkeys []string `json:"ssh_keys"`
-	ID      string   `json:"id"`
-	Shell   string   `json:"shell"`
+	SSHkeys []SSHKey `json:"ssh_keys" yaml:"ssh_keys" toml:"ssh_keys"`
+	ID      string   `json:"id" yaml:"id" toml:"id"`
+	Shell   string   `json:"shell" yaml:"shell" toml:"shell"`
+	// certificate principals the user can log in with
+	Principals []string `json:"principals" yaml:"principals" toml:"principals"`
+	// a disabled user is kept but locked, without its keys, principals and sudo groups
+	Disabled       bool   `json:"disabled" yaml:"disabled" toml:"disabled"`
+	DisabledReason string `json:"disabled_reason" yaml:"disabled_reason" toml:"disabled_reason"`
+}
+
+// SSHKey - a ssh key of a user. In a user file it is either an authorized_keys line
+// or an object with the key, the options restricting it and a comment.
+type SSHKey struct {
+	Key     string        `json:"key" yaml:"key" toml:"key"`
+	Options SSHKeyOptions `json:"options" yaml:"options" toml:"options"`
+	Comment string        `json:"comment" yaml:"comment" toml:"comment"`
+	// the key is removed from authorized_keys once this time has passed, zero for never
+	Expires time.Time `json:"expires" yaml:"expires" toml:"expires"`
+}
+
+// SSHKeyOptions - the authorized_keys options of a key, see sshd(8)
+type SSHKeyOptions struct {
+	From              []string          `json:"from" yaml:"from" toml:"from"`
+	Command           string            `json:"command" yaml:"command" toml:"command"`
+	Environment       map[string]string `json:"environment" yaml:"environment" toml:"environment"`
+	ExpiryTime        string            `json:"expiry-time" yaml:"expiry-time" toml:"expiry-time"`
+	NoAgentForwarding bool              `json:"no-agent-forwarding" yaml:"no-agent-forwarding" toml:"no-agent-forwarding"`
+	NoPortForwarding  bool              `json:"no-port-forwarding" yaml:"no-port-forwarding" toml:"no-port-forwarding"`
+	NoPty             bool              `json:"no-pty" yaml:"no-pty" toml:"no-pty"`
+	NoX11Forwarding   bool              `json:"no-x11-forwarding" yaml:"no-x11-forwarding" toml:"no-x11-forwarding"`
 }
 
 // UserGroup -
 type UserGroup struct {
-	Groups  []string
-	SSHKeys []string
+	Groups     []string
+	SSHKeys    []string
+	ID         string
+	Shell      string
+	Principals []string
+	// when the user was locked after leaving the bundle, zero while it is active
+	LockedAt time.Time
+	// the user is locked because the bundle disables it
+	Disabled       bool
+	DisabledReason string
+}
+
+// SyncFailure - a user or group that failed to sync during a run
+type SyncFailure struct {
+	Kind string
+	ID   string
+	Err  error
+}
+
+// SyncWarning - a problem with a user or group that didn't stop it from syncing
+type SyncWarning struct {
+	Kind    string
 	ID      string
-	Shell   string
+	Message string
+}
+
+// Manifest - the manifest.json pack writes into a bundle, the sha256 of each file by its path in the bundle.
+// The serial increases with every bundle so hosts can refuse an older bundle than the one they applied.
+type Manifest struct {
+	Serial  uint64            `json:"serial"`
+	Created time.Time         `json:"created"`
+	Files   map[string]string `json:"files"`
+}
+
+// Bundle - a single file bundle with every user and group instead of the users and groups folders
+type Bundle struct {
+	Users  []ArgoUser  `json:"users" yaml:"users" toml:"users"`
+	Groups []ArgoGroup `json:"groups" yaml:"groups" toml:"groups"`
+	// public keys of the ssh certificate authorities
+	CAKeys []string `json:"ca_keys" yaml:"ca_keys" toml:"ca_keys"`
+	// the serial and creation time of the bundle, in place of the manifest of a tarball. A serial of 0 means none.
+	Serial  uint64    `json:"serial" yaml:"serial" toml:"serial"`
+	Created time.Time `json:"created" yaml:"created" toml:"created"`
 }
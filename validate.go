@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Valid user and group names, the same rule useradd and groupadd enforce by default
+var posixNamePattern = regexp.MustCompile(`^[a-z_][a-z0-9_-]*[$]?$`)
+
+const maxPosixNameLength = 32
+
+// Tested
+// Unmarshal a user or group file, rejecting unknown fields so a typo like "sshkeys" is an error instead of a user without keys
+func unmarshalStrict(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err != nil {
+		return err
+	}
+	if dec.More() {
+		return errors.New("Unexpected data after the json object")
+	}
+	return nil
+}
+
+// Tested
+// Check a user or group name against the POSIX portable name rules
+func validatePosixName(name string) error {
+	if len(name) == 0 {
+		return errors.New("Missing id")
+	}
+	if len(name) > maxPosixNameLength {
+		return fmt.Errorf("Id %q is longer than %d characters", name, maxPosixNameLength)
+	}
+	if !posixNamePattern.MatchString(name) {
+		return fmt.Errorf("Id %q is not a valid user or group name", name)
+	}
+	return nil
+}
+
+// Tested
+// Check a shell can go into a passwd line: it can't hold the field separator or a line break
+func validateShellLine(shell string) error {
+	if strings.ContainsAny(shell, ":\n") {
+		return fmt.Errorf("Shell %q contains ':' or a newline", shell)
+	}
+	return nil
+}
+
+// Tested
+// Check the shell is an executable file on this machine
+func validateShell(shell string) error {
+	if len(shell) == 0 {
+		return errors.New("Missing shell")
+	}
+	fi, err := os.Stat(shell)
+	if err != nil {
+		return fmt.Errorf("Shell %s does not exist", shell)
+	}
+	if fi.IsDir() || fi.Mode()&0111 == 0 {
+		return fmt.Errorf("Shell %s is not executable", shell)
+	}
+	return nil
+}
+
+// Tested
+// Check the key parses as an authorized_keys line
+func validateSSHKey(sshKey string) error {
+	_, _, err := normalizeSSHKey(sshKey)
+	return err
+}
+
+// Tested
+// Check a ca key parses as a public key without options
+func validateCAKey(caKey string) []error {
+	_, _, err := normalizeSSHKey(caKey)
+	if err != nil {
+		return []error{err}
+	}
+	// TrustedUserCAKeys doesn't take authorized_keys options
+	_, _, options, _, _ := ssh.ParseAuthorizedKey([]byte(caKey))
+	if len(options) > 0 {
+		return []error{fmt.Errorf("Ca key %q can't have options", caKey)}
+	}
+	return nil
+}
+
+// Tested
+// Check the fields of a user
+func validateUser(user ArgoUser) []error {
+	problems := make([]error, 0)
+	if err := validatePosixName(user.ID); err != nil {
+		problems = append(problems, err)
+	}
+	if err := validateShellLine(user.Shell); err != nil {
+		problems = append(problems, err)
+	} else if err := validateShell(user.Shell); err != nil {
+		problems = append(problems, err)
+	}
+	_, keyProblems := normalizeSSHKeys(renderSSHKeys(user.SSHkeys))
+	problems = append(problems, keyProblems...)
+	for _, principal := range user.Principals {
+		if err := validatePrincipal(principal); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	return problems
+}
+
+// Tested
+// Check the fields of a group. mUserSource has the users of the bundle by id.
+func validateGroup(group ArgoGroup, mUserSource map[string]string) []error {
+	problems := make([]error, 0)
+	if err := validatePosixName(group.ID); err != nil {
+		problems = append(problems, err)
+	}
+	for _, u := range group.Users {
+		if _, ok := mUserSource[u]; !ok {
+			problems = append(problems, fmt.Errorf("User %q is not in the bundle", u))
+		}
+	}
+	return problems
+}
+
+// Tested
+// Check every user and group in an uncompressed bundle or single file bundle and return all of the problems found
+func validateBundleDir(dir string) []error {
+	if document := findBundleDocument(dir); document != "" {
+		return validateBundleDocument(document)
+	}
+
+	problems := make([]error, 0)
+	addProblems := func(source string, errs ...error) {
+		for _, err := range errs {
+			problems = append(problems, fmt.Errorf("%s: %s", source, err.Error()))
+		}
+	}
+
+	// users by id to the file they came from
+	mUserSource := make(map[string]string)
+
+	usersDir := dir + "/users"
+	files, err := ioutil.ReadDir(usersDir)
+	if err != nil {
+		return append(problems, err)
+	}
+	for _, file := range files {
+		if !isDefinitionFile(file.Name()) {
+			continue
+		}
+		source := "users/" + file.Name()
+
+		user, err := getUserFromFile(file, usersDir)
+		if err != nil {
+			addProblems(source, err)
+			continue
+		}
+
+		addProblems(source, validateUser(*user)...)
+		if validatePosixName(user.ID) == nil && idFromFileName(file.Name()) != user.ID {
+			addProblems(source, fmt.Errorf("File name does not match id %q", user.ID))
+		}
+		if otherSource, ok := mUserSource[user.ID]; ok {
+			addProblems(source, fmt.Errorf("Duplicate user id %q, also defined in %s", user.ID, otherSource))
+		}
+		mUserSource[user.ID] = source
+	}
+
+	// groups by id to the file they came from
+	mGroupSource := make(map[string]string)
+
+	groupsDir := dir + "/groups"
+	files, err = ioutil.ReadDir(groupsDir)
+	if err != nil {
+		return append(problems, err)
+	}
+	for _, file := range files {
+		if !isDefinitionFile(file.Name()) {
+			continue
+		}
+		source := "groups/" + file.Name()
+
+		group, err := getGroupFromFile(file, groupsDir)
+		if err != nil {
+			addProblems(source, err)
+			continue
+		}
+
+		addProblems(source, validateGroup(*group, mUserSource)...)
+		if validatePosixName(group.ID) == nil && idFromFileName(file.Name()) != group.ID {
+			addProblems(source, fmt.Errorf("File name does not match id %q", group.ID))
+		}
+		if otherSource, ok := mGroupSource[group.ID]; ok {
+			addProblems(source, fmt.Errorf("Duplicate group id %q, also defined in %s", group.ID, otherSource))
+		}
+		mGroupSource[group.ID] = source
+	}
+
+	// the ca folder is optional
+	files, err = ioutil.ReadDir(dir + "/" + caKeysDir)
+	if err != nil && !os.IsNotExist(err) {
+		return append(problems, err)
+	}
+	for _, file := range files {
+		if file.IsDir() || !isCAKeyFile(file.Name()) {
+			continue
+		}
+		source := caKeysDir + "/" + file.Name()
+
+		caKeys, err := readCAKeyFile(dir + "/" + source)
+		if err != nil {
+			addProblems(source, err)
+			continue
+		}
+		for _, caKey := range caKeys {
+			addProblems(source, validateCAKey(caKey)...)
+		}
+	}
+
+	// bundles built by pack carry the digests of their files
+	manifest, err := readManifest(dir)
+	if err != nil {
+		return append(problems, err)
+	}
+	if manifest != nil {
+		problems = append(problems, verifyManifest(dir, manifest)...)
+	}
+
+	return problems
+}
+
+// Tested
+// Check every user and group in a single file bundle and return all of the problems found
+func validateBundleDocument(document string) []error {
+	problems := make([]error, 0)
+	addProblems := func(source string, errs ...error) {
+		for _, err := range errs {
+			problems = append(problems, fmt.Errorf("%s: %s", source, err.Error()))
+		}
+	}
+
+	bundle, err := getBundleFromFile(document)
+	if err != nil {
+		return append(problems, err)
+	}
+
+	mUserSource := make(map[string]string)
+	for i, user := range bundle.Users {
+		source := fmt.Sprintf("users[%d]", i)
+		addProblems(source, validateUser(user)...)
+		if otherSource, ok := mUserSource[user.ID]; ok {
+			addProblems(source, fmt.Errorf("Duplicate user id %q, also defined in %s", user.ID, otherSource))
+		}
+		mUserSource[user.ID] = source
+	}
+
+	mGroupSource := make(map[string]string)
+	for i, group := range bundle.Groups {
+		source := fmt.Sprintf("groups[%d]", i)
+		addProblems(source, validateGroup(group, mUserSource)...)
+		if otherSource, ok := mGroupSource[group.ID]; ok {
+			addProblems(source, fmt.Errorf("Duplicate group id %q, also defined in %s", group.ID, otherSource))
+		}
+		mGroupSource[group.ID] = source
+	}
+
+	for i, caKey := range bundle.CAKeys {
+		addProblems(fmt.Sprintf("ca_keys[%d]", i), validateCAKey(caKey)...)
+	}
+
+	return problems
+}
+
+// Tested
+// Check the bundle manifest is signed by the ssh public key in pubKeyFile
+func validateBundleSignature(dir string, pubKeyFile string) error {
+	publicKey, err := readSigningKey(pubKeyFile)
+	if err != nil {
+		return err
+	}
+	return verifyBundleSignature(dir, publicKey)
+}
+
+// Not testable
+// validate command: check a bundle tarball or directory without touching the machine
+func validateCommand(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	pubKey := flags.String("pubkey", "", "ssh public key the bundle manifest must be signed with")
+
+	bundle, err := parseCommandArgs(flags, args)
+	if err != nil {
+		return 1
+	}
+
+	dir, cleanup, err := openBundle(bundle)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	defer cleanup()
+
+	problems := validateBundleDir(dir)
+	if *pubKey != "" {
+		err = validateBundleSignature(dir, *pubKey)
+		if err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	if len(problems) > 0 {
+		fmt.Printf("%d problem(s) found in %s:\n", len(problems), bundle)
+		for _, problem := range problems {
+			fmt.Printf("  %s\n", problem.Error())
+		}
+		return 1
+	}
+
+	fmt.Printf("%s is valid\n", bundle)
+	return 0
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// generate an authorized_keys line for tests
+func testSSHKey(t *testing.T, comment string) string {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	sshPub, err := ssh.NewPublicKey(pub)
+	assert.Nil(t, err)
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub))) + " " + comment
+}
+
+// write the files of a bundle into a temp directory, keyed by their path in the bundle
+func testBundleDir(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "argo-lyte-test")
+	assert.Nil(t, err)
+	assert.Nil(t, os.Mkdir(dir+"/users", 0700))
+	assert.Nil(t, os.Mkdir(dir+"/groups", 0700))
+	for name, contents := range files {
+		assert.Nil(t, ioutil.WriteFile(dir+"/"+name, []byte(contents), 0600))
+	}
+	return dir
+}
+
+// unmarshalStrict
+func TestUnmarshalStrictPass(t *testing.T) {
+	var user ArgoUser
+	err := unmarshalStrict([]byte(`{"id":"bob","shell":"/bin/sh","ssh_keys":[]}`), &user)
+	assert.Nil(t, err)
+	assert.Equal(t, user.ID, "bob")
+}
+
+func TestUnmarshalStrictUnknownField(t *testing.T) {
+	var user ArgoUser
+	err := unmarshalStrict([]byte(`{"id":"bob","shell":"/bin/sh","sshkeys":[]}`), &user)
+	assert.Equal(t, err.Error(), `json: unknown field "sshkeys"`)
+}
+
+func TestUnmarshalStrictTrailingData(t *testing.T) {
+	var user ArgoUser
+	err := unmarshalStrict([]byte(`{"id":"bob"}{"id":"alice"}`), &user)
+	assert.Equal(t, err.Error(), "Unexpected data after the json object")
+}
+
+// validatePosixName
+func TestValidatePosixNamePass(t *testing.T) {
+	assert.Nil(t, validatePosixName("bob"))
+	assert.Nil(t, validatePosixName("_svc-deploy_2"))
+	assert.Nil(t, validatePosixName("machine$"))
+}
+
+func TestValidatePosixNameFail(t *testing.T) {
+	assert.Equal(t, validatePosixName("").Error(), "Missing id")
+	assert.Equal(t, validatePosixName("bob smith").Error(), `Id "bob smith" is not a valid user or group name`)
+	assert.Equal(t, validatePosixName("Bob").Error(), `Id "Bob" is not a valid user or group name`)
+	assert.Equal(t, validatePosixName("1bob").Error(), `Id "1bob" is not a valid user or group name`)
+	assert.Equal(t, validatePosixName(strings.Repeat("a", 33)).Error(), `Id "`+strings.Repeat("a", 33)+`" is longer than 32 characters`)
+}
+
+// validateShell
+func TestValidateShellPass(t *testing.T) {
+	assert.Nil(t, validateShell("/bin/sh"))
+}
+
+func TestValidateShellFail(t *testing.T) {
+	assert.Equal(t, validateShell("").Error(), "Missing shell")
+	assert.Equal(t, validateShell("/bin/thiswillfail").Error(), "Shell /bin/thiswillfail does not exist")
+	assert.Equal(t, validateShell("/bin").Error(), "Shell /bin is not executable")
+}
+
+// validateShellLine
+func TestValidateShellLine(t *testing.T) {
+	assert.Nil(t, validateShellLine("/bin/bash"))
+	assert.Nil(t, validateShellLine(""))
+	assert.Equal(t, validateShellLine("/bin/sh\nevil::0:0::/root:/bin/sh").Error(), `Shell "/bin/sh\nevil::0:0::/root:/bin/sh" contains ':' or a newline`)
+	assert.NotNil(t, validateShellLine("/bin/sh:x"))
+}
+
+// validateSSHKey
+func TestValidateSSHKeyPass(t *testing.T) {
+	assert.Nil(t, validateSSHKey(testSSHKey(t, "bob@laptop")))
+}
+
+func TestValidateSSHKeyFail(t *testing.T) {
+	err := validateSSHKey("ssh_key1")
+	assert.Equal(t, err.Error(), `Invalid ssh key "ssh_key1": ssh: no key found`)
+}
+
+// validateBundleDir
+func TestValidateBundleDirPass(t *testing.T) {
+	dir := testBundleDir(t, map[string]string{
+		"users/bob.json":    `{"id":"bob","shell":"/bin/sh","ssh_keys":["` + testSSHKey(t, "bob@laptop") + `"]}`,
+		"groups/devs.json":  `{"id":"devs","users":["bob"],"admins":[]}`,
+		"groups/README.txt": `not a group`,
+	})
+	defer os.RemoveAll(dir)
+
+	problems := validateBundleDir(dir)
+	assert.Equal(t, len(problems), 0)
+}
+
+func TestValidateBundleDirFail(t *testing.T) {
+	dir := testBundleDir(t, map[string]string{
+		"users/bob.json":   `{"id":"bob","shell":"/bin/sh","sshkeys":[]}`,
+		"users/alice.json": `{"id":"al ice","shell":"/bin/thiswillfail","ssh_keys":["ssh_key1"]}`,
+		"users/carl.json":  `{"id":"dave","shell":"/bin/sh","ssh_keys":[]}`,
+		"users/dave.json":  `{"id":"dave","shell":"/bin/sh","ssh_keys":[]}`,
+		"groups/devs.json": `{"id":"devs","users":["dave","zed"],"admins":[]}`,
+	})
+	defer os.RemoveAll(dir)
+
+	problems := validateBundleDir(dir)
+	messages := make([]string, 0)
+	for _, problem := range problems {
+		messages = append(messages, problem.Error())
+	}
+	assert.Equal(t, []string{
+		`users/alice.json: Id "al ice" is not a valid user or group name`,
+		`users/alice.json: Shell /bin/thiswillfail does not exist`,
+		`users/alice.json: Invalid ssh key "ssh_key1": ssh: no key found`,
+		`users/bob.json: json: unknown field "sshkeys"`,
+		`users/carl.json: File name does not match id "dave"`,
+		`users/dave.json: Duplicate user id "dave", also defined in users/carl.json`,
+		`groups/devs.json: User "zed" is not in the bundle`,
+	}, messages)
+}
+
+func TestValidateBundleDirFormats(t *testing.T) {
+	dir := testBundleDir(t, map[string]string{
+		"users/bob.yaml":   "id: bob\nshell: /bin/sh\nssh_keys: []\n",
+		"users/alice.toml": "id = \"alice\"\nshell = \"/bin/sh\"\nssh_keys = []\n",
+		"users/alice.json": `{"id":"alice","shell":"/bin/sh","ssh_keys":[]}`,
+		"groups/devs.yml":  "id: devs\nusers: [bob, alice]\nadmins: []\n",
+	})
+	defer os.RemoveAll(dir)
+
+	problems := validateBundleDir(dir)
+	assert.Equal(t, len(problems), 1)
+	assert.Equal(t, problems[0].Error(), `users/alice.toml: Duplicate user id "alice", also defined in users/alice.json`)
+}
+
+func TestValidateBundleDocument(t *testing.T) {
+	dir, err := ioutil.TempDir("", "argo-lyte-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	document := "users:\n" +
+		"  - {id: bob, shell: /bin/sh, ssh_keys: []}\n" +
+		"  - {id: bob, shell: /bin/sh, ssh_keys: [ssh_key1]}\n" +
+		"groups:\n" +
+		"  - {id: devs, users: [bob, zed], admins: []}\n"
+	assert.Nil(t, ioutil.WriteFile(dir+"/bundle.yaml", []byte(document), 0600))
+
+	problems := validateBundleDir(dir)
+	messages := make([]string, 0)
+	for _, problem := range problems {
+		messages = append(messages, problem.Error())
+	}
+	assert.Equal(t, []string{
+		`users[1]: Invalid ssh key "ssh_key1": ssh: no key found`,
+		`users[1]: Duplicate user id "bob", also defined in users[0]`,
+		`groups[0]: User "zed" is not in the bundle`,
+	}, messages)
+}
+
+func TestValidateBundleDirCA(t *testing.T) {
+	dir := testBundleDir(t, map[string]string{
+		"users/bob.json": `{"id":"bob","shell":"/bin/sh","ssh_keys":[],"principals":["bob","on call"]}`,
+	})
+	defer os.RemoveAll(dir)
+
+	assert.Nil(t, os.Mkdir(dir+"/ca", 0700))
+	assert.Nil(t, ioutil.WriteFile(dir+"/ca/prod.pub", []byte(testSSHKey(t, "prod-ca")+"\nssh_key1\n"), 0600))
+
+	problems := validateBundleDir(dir)
+	messages := make([]string, 0)
+	for _, problem := range problems {
+		messages = append(messages, problem.Error())
+	}
+	assert.Equal(t, []string{
+		`users/bob.json: Invalid principal "on call"`,
+		`ca/prod.pub: Invalid ssh key "ssh_key1": ssh: no key found`,
+	}, messages)
+}
+
+func TestValidateBundleDocumentCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "argo-lyte-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.Nil(t, ioutil.WriteFile(dir+"/bundle.json", []byte(`{"users":[],"groups":[],"ca_keys":["ssh_key1"]}`), 0600))
+
+	problems := validateBundleDir(dir)
+	assert.Equal(t, len(problems), 1)
+	assert.Equal(t, problems[0].Error(), `ca_keys[0]: Invalid ssh key "ssh_key1": ssh: no key found`)
+}
+
+func TestValidateBundleDirMissing(t *testing.T) {
+	problems := validateBundleDir("/tmp/thiswillfail")
+	assert.Equal(t, len(problems), 1)
+}